@@ -0,0 +1,160 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// With age encryption, uploads are encrypted client-side to one or more
+// X25519 public keys (recipients). Hosts that only upload don't need any
+// secret: they can't decrypt the backups, not even their own. Only the
+// private identity, kept on the restore workstation, decrypts the files.
+//
+// Objects encrypted with age are stored without SSE-C, so their checksums can
+// be verified by anyone with access to the backup.
+
+const configAgeRecipients = "age.recipients"
+const configAgeIdentityFile = "age.identity-file"
+const encryptionAge = "age"
+
+// ageEncryption tells if the files are uploaded encrypted with age instead of
+// the symmetric encryption key. It only depends on the recipients: a restore
+// workstation with the identity and the key uploads with the key.
+func ageEncryption() bool {
+	return viper.IsSet(configAgeRecipients)
+}
+
+// ageConfigured tells if any of the age settings is set.
+func ageConfigured() bool {
+	return viper.IsSet(configAgeRecipients) || viper.IsSet(configAgeIdentityFile)
+}
+
+// ageOnly tells if the host has no encryption key besides the age settings,
+// so it can only read the files encrypted with age.
+func ageOnly() bool {
+	return ageConfigured() && newKeyProvider(keySetting) == nil && !viper.IsSet("keyring")
+}
+
+func ageRecipients() ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, value := range viper.GetStringSlice(configAgeRecipients) {
+		for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			recipient, err := age.ParseX25519Recipient(field)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid age recipient %q: %w", field, err)
+			}
+			recipients = append(recipients, recipient)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("No age recipient is configured, set %s to upload files.", configAgeRecipients)
+	}
+	return recipients, nil
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	filename := viper.GetString(configAgeIdentityFile)
+	if filename == "" {
+		return nil, fmt.Errorf("The files are encrypted with age, set %s to the private identity to decrypt them. Hosts with only the recipient can't decrypt backups.", configAgeIdentityFile)
+	}
+	return readAgeIdentities(expandHome(filename))
+}
+
+func readAgeIdentities(filename string) ([]age.Identity, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the age identity %s: %w", filename, err)
+	}
+	return identities, nil
+}
+
+func encryptAge(dst io.Writer, src io.Reader) error {
+	recipients, err := ageRecipients()
+	if err != nil {
+		return err
+	}
+	w, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func decryptAge(dst io.Writer, src io.Reader) error {
+	identities, err := ageIdentities()
+	if err != nil {
+		return err
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return fmt.Errorf("the file could not be decrypted with the age identity: %w", err)
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		return fmt.Errorf("the file could not be decrypted with the age identity: %w", err)
+	}
+	return nil
+}
+
+var keyAgeKeygenCmd = &cobra.Command{
+	Use:   "age-keygen [identity-file]",
+	Short: "Generate an age identity for write-only hosts",
+	Long: `Generate an X25519 identity and print its public key (recipient).
+
+Keep the identity file on the workstation used to restore backups, and set
+age.identity-file to its path. The hosts that upload backups only need the
+recipient in age.recipients. If the identity file exists, its recipient is
+printed.`,
+	Example: `securae key age-keygen ~/.config/securae-identity.txt
+
+# on each production server
+securae config set age.recipients age1...`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename := expandHome(args[0])
+		if _, err := os.Stat(filename); err == nil {
+			identities, err := readAgeIdentities(filename)
+			if err != nil {
+				return err
+			}
+			for _, identity := range identities {
+				if x25519, ok := identity.(*age.X25519Identity); ok {
+					cmd.Printf("Public key: %s\n", x25519.Recipient())
+				}
+			}
+			return nil
+		}
+
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return err
+		}
+		content := fmt.Sprintf("# public key: %s\n%s\n", identity.Recipient(), identity)
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			return err
+		}
+		cmd.Printf("Public key: %s\n", identity.Recipient())
+		cmd.Println("WARNING: Please save the identity file in a safe place. It is the only way to decrypt the backups encrypted to this public key.")
+		return nil
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keyAgeKeygenCmd)
+}
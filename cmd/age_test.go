@@ -0,0 +1,151 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestWriteOnlyHostWithAge(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "db.sql")
+	if err := os.WriteFile(filename, []byte("secret dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The production server only knows the recipient, and no encryption key.
+	serverConfig := storage.writeConfig(t, "age:\n  recipients: "+identity.Recipient().String()+"\n")
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", serverConfig, "upload", filename, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if bytes.Contains(storage.get("db.sql").Data, []byte("secret dump")) {
+		t.Errorf("The storage provider should not receive the plaintext")
+	}
+
+	RootCmd.SetArgs([]string{"--config", serverConfig, "validate", "db.sql", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "Verifying file integrity... OK") {
+		t.Errorf("The checksum should be verified without the identity:\n%s", actual)
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	RootCmd.SetArgs([]string{"--config", serverConfig, "download", "db.sql", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err == nil {
+		t.Errorf("The server should not be able to decrypt the file")
+	}
+
+	// The restore workstation holds the identity.
+	workstationConfig := storage.writeConfig(t, "age:\n  identity-file: "+identityFile+"\n")
+	RootCmd.SetArgs([]string{"--config", workstationConfig, "download", "db.sql", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if content, _ := os.ReadFile("db.sql"); string(content) != "secret dump" {
+		t.Errorf("Result was incorrect, got: %q, want: %q.", content, "secret dump")
+	}
+}
+
+func TestDownloadAfterSwitchingToAge(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"before.sql", "after.sql"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("dump "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	configFile := storage.writeConfig(t, testKeyConfig)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filepath.Join(dir, "before.sql"), "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	configFile = storage.writeConfig(t, testKeyConfig+"age:\n  recipients: "+identity.Recipient().String()+"\n  identity-file: "+identityFile+"\n")
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filepath.Join(dir, "after.sql"), "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if encryption := storage.get("after.sql").Metadata.Get(metadataEncryption); encryption != encryptionAge {
+		t.Errorf("The encryption mode should be stored with the file, got %q", encryption)
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	for _, name := range []string{"before.sql", "after.sql"} {
+		RootCmd.SetArgs([]string{"--config", configFile, "download", name, "--backup-id", testBackupId})
+		if err := RootCmd.Execute(); err != nil {
+			t.Fatalf("%s: %v\n%s", name, err, actual)
+		}
+		if content, _ := os.ReadFile(name); string(content) != "dump "+name {
+			t.Errorf("Result was incorrect, got: %q, want: %q.", content, "dump "+name)
+		}
+	}
+}
+
+func TestUploadWithIdentityAndKey(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "identity.txt")
+	os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	filename := filepath.Join(dir, "db.sql")
+	os.WriteFile(filename, []byte("dump"), 0600)
+
+	// A restore workstation reads the age files, and uploads with the key.
+	configFile := storage.writeConfig(t, testKeyConfig+"age:\n  identity-file: "+identityFile+"\n")
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("The upload should use the encryption key without age recipients: %v\n%s", err, actual)
+	}
+	keyMD5, _ := hashEncryptionKey(testEncryptionKey)
+	if object := storage.get("db.sql"); object.KeyMD5 != keyMD5 || object.Metadata.Get(metadataEncryption) != "" {
+		t.Errorf("The file should be encrypted with the key, not age")
+	}
+}
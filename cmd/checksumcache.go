@@ -0,0 +1,230 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// The SHA-256 checksums of the uploaded files are cached locally, so an
+// unchanged file is not read twice. A file is identified by its device and
+// inode, and the checksum is only reused while its size and modification
+// time are the same.
+
+const flagRehash = "rehash"
+const flagAll = "all"
+
+// checksumCacheRacyWindow is how recent a modification time must be for the
+// checksum not to be cached: the file could still be modified within the
+// precision of the timestamps without changing them.
+const checksumCacheRacyWindow = 2 * time.Second
+
+type checksumCacheEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Checksum string    `json:"checksum"`
+	UsedAt   time.Time `json:"used_at"`
+}
+
+type checksumCache struct {
+	Entries map[string]checksumCacheEntry `json:"entries"`
+}
+
+var cacheCmd = &cobra.Command{
+	Use:     "cache",
+	Short:   "Manage the local checksum cache",
+	Args:    cobra.NoArgs,
+	GroupID: "setup",
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune [flags]",
+	Short: "Remove the checksums of deleted or modified files from the cache",
+	Long: `Remove the checksums of deleted or modified files from the local checksum cache.
+
+The cache stores the SHA-256 checksum of the uploaded files, so unchanged files
+are not read again by the next upload.`,
+	Example: `securae cache prune
+
+# empty the cache
+securae cache prune --all`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool(flagAll)
+
+		filename := checksumCachePath()
+		cache, err := loadChecksumCache(filename)
+		if err != nil {
+			return err
+		}
+		removed := 0
+		for id, entry := range cache.Entries {
+			if all || !entry.isCurrent(id) {
+				delete(cache.Entries, id)
+				removed++
+			}
+		}
+		if err := saveChecksumCache(filename, cache); err != nil {
+			return err
+		}
+		cmd.Printf("%d checksums removed, %d kept.\n", removed, len(cache.Entries))
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cachePruneCmd.Flags().Bool(flagAll, false, "Remove all the checksums")
+}
+
+func checksumCachePath() string {
+	filename := "securae-checksums.json"
+	if profile := currentProfile(); profile != "" {
+		filename = fmt.Sprintf("securae-checksums-%s.json", profile)
+	}
+	return filepath.Join(filepath.Dir(viper.ConfigFileUsed()), filename)
+}
+
+func loadChecksumCache(filename string) (checksumCache, error) {
+	cache := checksumCache{Entries: make(map[string]checksumCacheEntry)}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return cache, fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+	if cache.Entries == nil {
+		cache.Entries = make(map[string]checksumCacheEntry)
+	}
+	return cache, nil
+}
+
+// saveChecksumCache replaces the cache file atomically, so a concurrent
+// upload never reads a partial file.
+func saveChecksumCache(filename string, cache checksumCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("error saving the checksum cache: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("error saving the checksum cache: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("error saving the checksum cache: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return fmt.Errorf("error saving the checksum cache: %w", err)
+	}
+	return nil
+}
+
+// matches reports whether the file is still the one whose checksum was
+// cached.
+func (entry checksumCacheEntry) matches(info os.FileInfo) bool {
+	return entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime())
+}
+
+// isCurrent reports whether the file of the entry still exists unchanged.
+func (entry checksumCacheEntry) isCurrent(id string) bool {
+	info, err := os.Stat(entry.Path)
+	if err != nil {
+		return false
+	}
+	currentId, ok := fileIdentity(info)
+	return ok && currentId == id && entry.matches(info)
+}
+
+// forgetCachedChecksum removes the checksum of the file from the cache, e.g.
+// when it turned out to be stale.
+func forgetCachedChecksum(filename string) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+	id, ok := fileIdentity(info)
+	if !ok {
+		return
+	}
+	cacheFilename := checksumCachePath()
+	cache, err := loadChecksumCache(cacheFilename)
+	if err != nil {
+		return
+	}
+	if _, found := cache.Entries[id]; found {
+		delete(cache.Entries, id)
+		saveChecksumCache(cacheFilename, cache)
+	}
+}
+
+// cachedChecksumSHA256 returns the checksum of the file, from the cache when
+// the file is unchanged since it was cached, unless `rehash` is set. It also
+// reports whether the checksum came from the cache. A cache that can't be
+// read or written is ignored.
+func cachedChecksumSHA256(file *os.File, rehash bool) (string, bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	id, ok := fileIdentity(info)
+	if !ok || !info.Mode().IsRegular() {
+		checksum, err := ChecksumSHA256(file)
+		return checksum, false, err
+	}
+
+	filename := checksumCachePath()
+	cache, err := loadChecksumCache(filename)
+	if err != nil {
+		cache = checksumCache{Entries: make(map[string]checksumCacheEntry)}
+	}
+	if entry, found := cache.Entries[id]; found && !rehash && entry.matches(info) {
+		entry.UsedAt = time.Now()
+		cache.Entries[id] = entry
+		saveChecksumCache(filename, cache)
+		return entry.Checksum, true, nil
+	}
+
+	checksum, err := ChecksumSHA256(file)
+	if err != nil {
+		return "", false, err
+	}
+	// The file may have been modified while it was read.
+	if after, err := file.Stat(); err != nil || !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size() {
+		return checksum, false, nil
+	}
+	if time.Since(info.ModTime()) < checksumCacheRacyWindow {
+		delete(cache.Entries, id)
+	} else {
+		path, _ := filepath.Abs(file.Name())
+		cache.Entries[id] = checksumCacheEntry{
+			Path:     path,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			Checksum: checksum,
+			UsedAt:   time.Now(),
+		}
+	}
+	saveChecksumCache(filename, cache)
+	return checksum, false, nil
+}
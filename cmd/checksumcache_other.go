@@ -0,0 +1,15 @@
+//go:build !unix
+
+/*
+Copyright 2024-2025 Securae Backup
+*/
+
+package cmd
+
+import "os"
+
+// fileIdentity is only implemented on Unix, elsewhere the checksums are not
+// cached.
+func fileIdentity(info os.FileInfo) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestCachedChecksumSHA256(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The checksums are only cached on Unix")
+	}
+	viper.Reset()
+	dir := t.TempDir()
+	viper.SetConfigFile(filepath.Join(dir, "config.yaml"))
+
+	filename := filepath.Join(dir, "dump.sql")
+	if err := os.WriteFile(filename, []byte("dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	os.Chtimes(filename, lastWeek, lastWeek)
+
+	checksum := func(rehash bool) (string, bool) {
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		checksum, cached, err := cachedChecksumSHA256(file, rehash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return checksum, cached
+	}
+
+	first, cached := checksum(false)
+	if cached {
+		t.Errorf("The first checksum can't come from the cache")
+	}
+	if second, cached := checksum(false); !cached || second != first {
+		t.Errorf("The checksum of an unchanged file should come from the cache")
+	}
+	if _, cached := checksum(true); cached {
+		t.Errorf("The checksum should be calculated again with rehash")
+	}
+
+	// Same size, another modification time.
+	os.WriteFile(filename, []byte("DUMP"), 0600)
+	os.Chtimes(filename, lastWeek.Add(time.Second), lastWeek.Add(time.Second))
+	if modified, cached := checksum(false); cached || modified == first {
+		t.Errorf("The checksum of a modified file should be calculated again")
+	}
+
+	// A recently modified file is not cached.
+	os.WriteFile(filename, []byte("dump 2"), 0600)
+	checksum(false)
+	if _, cached := checksum(false); cached {
+		t.Errorf("The checksum of a file modified just now should not be cached")
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The checksums are only cached on Unix")
+	}
+	viper.Reset()
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte("api:\n  token: test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	for _, name := range []string{"kept.sql", "deleted.sql"} {
+		filename := filepath.Join(dir, name)
+		os.WriteFile(filename, []byte(name), 0600)
+		os.Chtimes(filename, lastWeek, lastWeek)
+		file, _ := os.Open(filename)
+		viper.SetConfigFile(configFile)
+		if _, _, err := cachedChecksumSHA256(file, false); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	os.Remove(filepath.Join(dir, "deleted.sql"))
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "cache", "prune"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "1 checksums removed, 1 kept.") {
+		t.Errorf("Only the deleted file should be removed from the cache:\n%s", actual)
+	}
+
+	actual.Reset()
+	defer cachePruneCmd.Flags().Set(flagAll, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "cache", "prune", "--all"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "1 checksums removed, 0 kept.") {
+		t.Errorf("All the checksums should be removed:\n%s", actual)
+	}
+}
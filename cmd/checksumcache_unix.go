@@ -0,0 +1,22 @@
+//go:build unix
+
+/*
+Copyright 2024-2025 Securae Backup
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the device and inode of a file.
+func fileIdentity(info os.FileInfo) (string, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino), true
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bufio"
+	"io"
+)
+
+// Content-defined chunking with FastCDC: the cut points depend on the content
+// (a gear rolling hash over the last 64 bytes), so inserting or removing
+// bytes only changes the chunks around the modification. Normalized chunking
+// uses a harder mask before the average size and an easier one after it, to
+// keep the chunk sizes close to the average.
+//
+// The gear table and the sizes must never change, otherwise the chunks of new
+// uploads wouldn't match the ones already stored.
+const (
+	chunkMinSize = 256 * 1024
+	chunkAvgSize = 1024 * 1024
+	chunkMaxSize = 4 * 1024 * 1024
+
+	// The top bits of the fingerprint depend on the last 64 bytes. 22 bits
+	// before the average size, 18 bits after it.
+	chunkMaskS = uint64(0xFFFFFC0000000000)
+	chunkMaskL = uint64(0xFFFFC00000000000)
+)
+
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64, with a fixed seed.
+	seed := uint64(0x5ec07ae5ec07ae00)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// cutPoint returns the size of the chunk at the beginning of `data`.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= chunkMinSize {
+		return n
+	}
+	if n > chunkMaxSize {
+		n = chunkMaxSize
+	}
+	normal := chunkAvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := chunkMinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&chunkMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&chunkMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// A chunker splits a stream into content-defined chunks.
+type chunker struct {
+	reader *bufio.Reader
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{reader: bufio.NewReaderSize(r, chunkMaxSize)}
+}
+
+// Next returns the next chunk, or io.EOF at the end of the stream.
+func (c *chunker) Next() ([]byte, error) {
+	data, err := c.reader.Peek(chunkMaxSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	n := cutPoint(data)
+	chunk := make([]byte, n)
+	copy(chunk, data)
+	if _, err := c.reader.Discard(n); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func splitChunks(t *testing.T, data []byte) [][]byte {
+	var chunks [][]byte
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(16*1024*1024, 1)
+	chunks := splitChunks(t, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("The chunks should rebuild the data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > chunkMaxSize || (len(chunk) < chunkMinSize && i != len(chunks)-1) {
+			t.Errorf("The chunk %d has an invalid size: %d", i, len(chunk))
+		}
+	}
+	if len(chunks) < 8 || len(chunks) > 32 {
+		t.Errorf("16 MiB should be split into about 16 chunks, got %d", len(chunks))
+	}
+
+	// Inserting bytes at the beginning only changes the first chunks.
+	shifted := splitChunks(t, append([]byte("inserted"), data...))
+	known := make(map[string]bool)
+	for _, chunk := range chunks {
+		known[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range shifted {
+		if !known[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("Inserting bytes should change one or two chunks, %d changed", changed)
+	}
+}
+
+func TestUploadAndDownloadChunked(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	dir := t.TempDir()
+	data := randomData(8*1024*1024, 2)
+	filename := filepath.Join(dir, "vm.img")
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer uploadCmd.Flags().Set(flagChunked, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--chunked", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if storage.get("vm.img").Metadata.Get(metadataFormat) != formatChunked {
+		t.Errorf("The index should be marked as chunked in the object metadata")
+	}
+	chunks := len(storage.backup().Backupobjects) - 1
+
+	// Modify a few bytes in the middle of the file.
+	copy(data[4*1024*1024:], "modified")
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	actual.Reset()
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--chunked", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	// The index is uploaded again as a new version of vm.img.
+	if newChunks := len(storage.backup().Backupobjects) - 2 - chunks; newChunks != 1 {
+		t.Errorf("Only the modified chunk should be uploaded, %d were:\n%s", newChunks, actual)
+	}
+	if !strings.Contains(actual.String(), "OK (1 new of ") {
+		t.Errorf("The number of new chunks should be reported:\n%s", actual)
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	RootCmd.SetArgs([]string{"--config", configFile, "download", "vm.img", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if content, _ := os.ReadFile("vm.img"); !bytes.Equal(content, data) {
+		t.Errorf("The downloaded file should be rebuilt from its chunks")
+	}
+}
+
+func TestChunksNotReusedAcrossEncryptionModes(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	dir := t.TempDir()
+	data := randomData(2*1024*1024, 3)
+	filename := filepath.Join(dir, "vm.img")
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer uploadCmd.Flags().Set(flagChunked, "false")
+	configFile := storage.writeConfig(t, testKeyConfig)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--chunked", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+
+	configFile = storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	actual.Reset()
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--chunked", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	chunks := len(splitChunks(t, data))
+	if !strings.Contains(actual.String(), fmt.Sprintf("OK (%d new of %d chunks)", chunks, chunks)) {
+		t.Errorf("The chunks uploaded without client-side encryption should not be reused:\n%s", actual)
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	RootCmd.SetArgs([]string{"--config", configFile, "download", "vm.img", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if content, _ := os.ReadFile("vm.img"); !bytes.Equal(content, data) {
+		t.Errorf("The downloaded file should be rebuilt from its chunks")
+	}
+}
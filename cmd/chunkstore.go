@@ -0,0 +1,258 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// With chunked uploads, a file is split into content-defined chunks, each
+// stored once in the backup as an object named after its ID, an HMAC of its
+// content. The object named after the file is an index listing its chunks,
+// so only the chunks that changed since the previous upload are sent.
+//
+// The chunk IDs are keyed with the master key, so they don't reveal whether
+// a known content is stored in the backup. The key also depends on the
+// encryption mode, so the chunks uploaded before enabling client-side
+// encryption are not reused by the files uploaded afterwards.
+
+const chunkPrefix = "chunk-"
+const flagChunked = "chunked"
+const metadataFormat = "X-Amz-Meta-Securae-Format"
+const formatChunked = "chunked"
+const chunkIndexVersion = 1
+
+type chunkRef struct {
+	Id   string `json:"id"`
+	Size int    `json:"size"`
+}
+
+type chunkIndex struct {
+	Version int `json:"version"`
+	// Size and SHA-256 checksum of the whole file.
+	Size     int64      `json:"size"`
+	Checksum string     `json:"checksum"`
+	Chunks   []chunkRef `json:"chunks"`
+}
+
+// A chunkStore reads and writes the chunks of a backup through presigned
+// URLs.
+type chunkStore struct {
+	apiURL                  string
+	apiToken                string
+	backupId                string
+	encryptionKeyB64Encoded string
+	// Compression applied to the new chunks.
+	codec string
+	// Keys of the chunk IDs, by encryption mode.
+	idKeys   map[string]*secureBuffer
+	existing map[string]bool
+}
+
+func newChunkStore(apiURL string, apiToken string, backupId string, encryptionKeyB64Encoded string) (*chunkStore, error) {
+	if encryptionKeyB64Encoded == "" {
+		return nil, fmt.Errorf("Chunked files need the encryption key, they can't be used with age encryption.")
+	}
+	masterKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	defer masterKey.Destroy()
+	store := &chunkStore{
+		apiURL:                  apiURL,
+		apiToken:                apiToken,
+		backupId:                backupId,
+		encryptionKeyB64Encoded: encryptionKeyB64Encoded,
+		idKeys:                  make(map[string]*secureBuffer),
+	}
+	for encryption, info := range map[string]string{"": "securae chunks", encryptionEnvelope: "securae chunks envelope"} {
+		idKey := newSecureBuffer(32)
+		store.idKeys[encryption] = idKey
+		if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey.Bytes(), nil, []byte(info)), idKey.Bytes()); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func (s *chunkStore) Close() {
+	for _, idKey := range s.idKeys {
+		idKey.Destroy()
+	}
+}
+
+// chunkId returns the ID of a chunk uploaded with the `encryption` mode.
+func (s *chunkStore) chunkId(data []byte, encryption string) string {
+	mac := hmac.New(sha256.New, s.idKeys[encryption].Bytes())
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadExisting lists the chunks already stored in the backup.
+func (s *chunkStore) loadExisting() error {
+	backup, err := fetchBackupData(fmt.Sprintf("%s/backups/%s", s.apiURL, s.backupId), s.apiToken)
+	if err != nil {
+		return err
+	}
+	s.existing = make(map[string]bool)
+	for _, bo := range backup.Backupobjects {
+		if strings.HasPrefix(bo.Name, chunkPrefix) {
+			s.existing[strings.TrimPrefix(bo.Name, chunkPrefix)] = true
+		}
+	}
+	return nil
+}
+
+func (s *chunkStore) put(id string, data []byte) error {
+	var metadata map[string]string
+	if s.codec != "" {
+		var compressed bytes.Buffer
+		w, err := newCompressor(&compressed, s.codec, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+		metadata = map[string]string{metadataCompression: s.codec}
+	}
+	if uploadEncryption() == encryptionEnvelope {
+		var encrypted bytes.Buffer
+		if err := encryptEnvelope(&encrypted, bytes.NewReader(data), s.encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+		data = encrypted.Bytes()
+	}
+
+	sum := sha256.Sum256(data)
+	checksum := base64.StdEncoding.EncodeToString(sum[:])
+	postData, err := json.Marshal(map[string]interface{}{"filename": chunkPrefix + id, "size": len(data), "checksum": checksum})
+	if err != nil {
+		return err
+	}
+	presignedURL, err := fetchPresignedURL(fmt.Sprintf("%s/backups/%s/preupload/", s.apiURL, s.backupId), s.apiToken, postData)
+	if err != nil {
+		return err
+	}
+	return putObject(presignedURL, s.encryptionKeyB64Encoded, bytes.NewReader(data), int64(len(data)), checksum, withUploadEncryption(metadata))
+}
+
+// get downloads a chunk and checks its content against its ID.
+func (s *chunkStore) get(id string) ([]byte, error) {
+	postData, err := json.Marshal(map[string]interface{}{"filename": chunkPrefix + id})
+	if err != nil {
+		return nil, err
+	}
+	presignedURL, err := fetchPresignedURL(fmt.Sprintf("%s/backups/%s/predownload/", s.apiURL, s.backupId), s.apiToken, postData)
+	if err != nil {
+		return nil, err
+	}
+	resp, encryption, err := fetchEncryptedObject(presignedURL, s.encryptionKeyB64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if s.idKeys[encryption] == nil {
+		return nil, fmt.Errorf("The chunk %s is encrypted with %s, chunked files can't be.", id, encryption)
+	}
+
+	var src io.Reader = resp.Body
+	if encryption == encryptionEnvelope {
+		var decrypted bytes.Buffer
+		if err := decryptEnvelope(&decrypted, resp.Body, s.encryptionKeyB64Encoded); err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", id, err)
+		}
+		src = &decrypted
+	}
+	if codec := resp.Header.Get(metadataCompression); codec != "" {
+		decompressed, err := decompressReader(src, codec)
+		if err != nil {
+			return nil, err
+		}
+		defer decompressed.Close()
+		src = decompressed
+	}
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	// The envelope chunks uploaded by older versions have the IDs of the
+	// chunks without client-side encryption.
+	if s.chunkId(data, encryption) != id && (encryption != encryptionEnvelope || s.chunkId(data, "") != id) {
+		return nil, fmt.Errorf("The chunk %s is corrupted, its content doesn't match its ID.", id)
+	}
+	return data, nil
+}
+
+// uploadChunks splits `src` into chunks and uploads the ones not stored yet.
+// It returns the index of the file and the number of new chunks.
+func uploadChunks(store *chunkStore, src io.Reader) (chunkIndex, int, error) {
+	index := chunkIndex{Version: chunkIndexVersion}
+	if err := store.loadExisting(); err != nil {
+		return index, 0, err
+	}
+
+	hasher := sha256.New()
+	chunks := newChunker(io.TeeReader(src, hasher))
+	newChunks := 0
+	for {
+		data, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return index, newChunks, err
+		}
+		id := store.chunkId(data, uploadEncryption())
+		if !store.existing[id] {
+			if err := store.put(id, data); err != nil {
+				return index, newChunks, err
+			}
+			store.existing[id] = true
+			newChunks++
+		}
+		index.Chunks = append(index.Chunks, chunkRef{Id: id, Size: len(data)})
+		index.Size += int64(len(data))
+	}
+	index.Checksum = base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+	return index, newChunks, nil
+}
+
+// restoreChunks writes the file described by the index, and checks it
+// against the checksum of the whole file.
+func restoreChunks(dst io.Writer, index chunkIndex, store *chunkStore) error {
+	if index.Version != chunkIndexVersion {
+		return fmt.Errorf("The chunked file uses the index version %d, which is not supported by this version.", index.Version)
+	}
+	hasher := sha256.New()
+	for _, ref := range index.Chunks {
+		data, err := store.get(ref.Id)
+		if err != nil {
+			return err
+		}
+		hasher.Write(data)
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+	}
+	if checksum := base64.StdEncoding.EncodeToString(hasher.Sum(nil)); checksum != index.Checksum {
+		return fmt.Errorf("The rebuilt file doesn't match its checksum.")
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Files can be compressed before they are encrypted and uploaded. The codec
+// is stored in the object metadata, so downloads are decompressed without
+// any option.
+
+const flagCompress = "compress"
+const flagCompressLevel = "compress-level"
+const flagRaw = "raw"
+
+const metadataCompression = "X-Amz-Meta-Securae-Compression"
+
+// compressionExtensions are added to the name of the files downloaded with
+// --raw.
+var compressionExtensions = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+func validateCompression(value string) error {
+	if _, ok := compressionExtensions[value]; !ok && value != "" {
+		return fmt.Errorf("unknown compression %q, use gzip or zstd", value)
+	}
+	return nil
+}
+
+func newCompressor(dst io.Writer, codec string, level int) (io.WriteCloser, error) {
+	switch codec {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		w, err := gzip.NewWriterLevel(dst, level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip level %d, it must be between 1 and 9", level)
+		}
+		return w, nil
+	case "zstd":
+		options := []zstd.EOption{}
+		if level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(dst, options...)
+	}
+	return nil, validateCompression(codec)
+}
+
+// compressReader returns the compressed content of `src`, compressed while it
+// is read.
+func compressReader(src io.Reader, codec string, level int) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	w, err := newCompressor(pw, codec, level)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(w, src)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func decompressReader(src io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case "gzip":
+		r, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing the file: %w", err)
+		}
+		return r, nil
+	case "zstd":
+		r, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing the file: %w", err)
+		}
+		return r.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("The file was compressed with %q, which is not supported by this version. Use --raw to download it as is.", codec)
+}
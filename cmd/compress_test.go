@@ -0,0 +1,91 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := strings.Repeat("INSERT INTO customers VALUES (1, 'name');\n", 1000)
+	for _, codec := range []string{"gzip", "zstd"} {
+		compressed, err := compressReader(strings.NewReader(data), codec, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, _ := io.ReadAll(compressed)
+		if len(result) >= len(data) {
+			t.Errorf("%s: the data was not compressed", codec)
+		}
+		decompressed, err := decompressReader(bytes.NewReader(result), codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, _ := io.ReadAll(decompressed); string(result) != data {
+			t.Errorf("%s: the decompressed data doesn't match the original", codec)
+		}
+	}
+	if _, err := compressReader(strings.NewReader(data), "lzma", 0); err == nil {
+		t.Errorf("An unknown codec should be rejected")
+	}
+}
+
+func TestUploadAndDownloadCompressed(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	dir := t.TempDir()
+	data := strings.Repeat("2025-03-01 12:00:00 GET /index.html 200\n", 1000)
+	filename := filepath.Join(dir, "access.log")
+	if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer uploadCmd.Flags().Set(flagCompress, "")
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--compress", "zstd", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	object := storage.get("access.log")
+	if object.Metadata.Get(metadataCompression) != "zstd" {
+		t.Errorf("The codec should be stored in the object metadata")
+	}
+	if len(object.Data) >= len(data) {
+		t.Errorf("The file was not compressed")
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	RootCmd.SetArgs([]string{"--config", configFile, "download", "access.log", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if content, _ := os.ReadFile("access.log"); string(content) != data {
+		t.Errorf("The downloaded file should be decompressed")
+	}
+
+	defer downloadCmd.Flags().Set(flagRaw, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "download", "access.log", "--raw", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	content, err := os.ReadFile("access.log.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, _ := decompressReader(bytes.NewReader(content), "zstd")
+	if result, _ := io.ReadAll(decompressed); string(result) != data {
+		t.Errorf("With --raw, the file should be decrypted but still compressed")
+	}
+}
@@ -0,0 +1,351 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type configKey struct {
+	Name string
+	// Secret values are redacted by `config view`.
+	Secret bool
+	// Global keys are always stored at the top level of the config file,
+	// even when a profile is in use.
+	Global bool
+	// Required keys are reported as errors by `config validate` when missing.
+	Required bool
+	Validate func(value string) error
+}
+
+var configKeys = []configKey{
+	{Name: flagProfile, Global: true, Validate: validateProfileName},
+	{Name: "api.url", Required: true, Validate: validateAPIURL},
+	{Name: "api.token", Secret: true, Required: true, Validate: validateAPITokenFormat},
+	{Name: "encryption-key-b64encoded", Secret: true, Validate: validateEncryptionKey},
+	{Name: "encryption-key-keystore", Validate: validateFileExists},
+	{Name: "encryption-key-file", Validate: validateFileExists},
+	{Name: "encryption-key-command", Validate: validateNotEmpty},
+	{Name: configClientSideEncryption, Validate: validateBool},
+	{Name: configObfuscateFilenames, Validate: validateBool},
+	{Name: configTempDir, Validate: validateDirectory},
+	{Name: flagCompress, Validate: validateCompression},
+	{Name: flagCompressLevel, Validate: validateInt},
+	{Name: flagChunked, Validate: validateBool},
+	{Name: flagMerkle, Validate: validateBool},
+	{Name: configAgeRecipients, Validate: validateAgeRecipients},
+	{Name: configAgeIdentityFile, Validate: validateFileExists},
+	{Name: "vault.address", Validate: validateAPIURL},
+	{Name: "vault.token", Secret: true, Validate: validateNotEmpty},
+	{Name: "vault.namespace", Validate: validateNotEmpty},
+	{Name: "vault.kv-path", Validate: validateNotEmpty},
+	{Name: "vault.kv-field", Validate: validateNotEmpty},
+	{Name: "vault.transit-mount", Validate: validateNotEmpty},
+	{Name: "vault.transit-key", Validate: validateNotEmpty},
+	{Name: "vault.ciphertext", Validate: validateNotEmpty},
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "View and edit the configuration",
+	Long: `View and edit the configuration file without editing the YAML by hand.
+
+When a profile is in use, "set" and "unset" change the settings of that profile.`,
+	Example: `# show the current configuration, secrets are redacted
+securae config view
+
+# change a setting
+securae config set api.url https://dashboard.securaebackup.com/api/v1
+
+# check the configuration
+securae config validate`,
+	Args:    cobra.NoArgs,
+	GroupID: "setup",
+}
+
+var configViewCmd = &cobra.Command{
+	Use:   "view",
+	Short: "Show the configuration with secrets redacted",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.Printf("Config file: %s\n", viper.ConfigFileUsed())
+		for _, key := range configKeys {
+			value := viper.GetString(key.Name)
+			if value == "" {
+				continue
+			}
+			if key.Secret {
+				value = redactSecret(value)
+			}
+			cmd.Printf("%s: %s\n", key.Name, value)
+		}
+		return nil
+	},
+}
+
+var configGetCmd = &cobra.Command{
+	Use:     "get [key]",
+	Short:   "Print the value of a setting",
+	Example: `securae config get api.url`,
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := lookupConfigKey(args[0])
+		if err != nil {
+			return err
+		}
+		value := viper.GetString(key.Name)
+		if value == "" {
+			return fmt.Errorf("%s is not set.", key.Name)
+		}
+		cmd.Println(value)
+		return nil
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:     "set [key] [value]",
+	Short:   "Change the value of a setting",
+	Example: `securae config set api.token xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx`,
+	Args:    cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := lookupConfigKey(args[0])
+		if err != nil {
+			return err
+		}
+		value := args[1]
+		if err := key.Validate(value); err != nil {
+			return err
+		}
+		return updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+			setConfigValue(content, key.path(), value)
+			return nil
+		})
+	},
+}
+
+var configUnsetCmd = &cobra.Command{
+	Use:     "unset [key]",
+	Short:   "Remove a setting",
+	Example: `securae config unset profile`,
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := lookupConfigKey(args[0])
+		if err != nil {
+			return err
+		}
+		return updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+			if !unsetConfigValue(content, key.path()) {
+				cmd.Printf("%s is not set in %s.\n", key.Name, viper.ConfigFileUsed())
+			}
+			return nil
+		})
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the configuration",
+	Long: `Check the format of every setting, and that the API is reachable and accepts
+the API token.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		valid := true
+		for _, key := range configKeys {
+			value := viper.GetString(key.Name)
+			if value == "" && !key.Required {
+				continue
+			}
+			cmd.Printf("Verifying %s... ", key.Name)
+			if value == "" {
+				cmd.Printf("Error (not set)\n")
+				valid = false
+			} else if err := key.Validate(value); err != nil {
+				cmd.Printf("Error (%s)\n", err)
+				valid = false
+			} else {
+				cmd.Printf("OK\n")
+			}
+		}
+
+		if jobs, err := getJobs(); err != nil {
+			cmd.Printf("Verifying jobs... Error (%s)\n", err)
+			valid = false
+		} else {
+			var names []string
+			for name := range jobs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				cmd.Printf("Verifying job %s... ", name)
+				if _, err := jobs[name].validate(); err != nil {
+					cmd.Printf("Error (%s)\n", err)
+					valid = false
+				} else {
+					cmd.Printf("OK\n")
+				}
+			}
+		}
+
+		cmd.Printf("Verifying encryption key... ")
+		if encryptionKeyB64Encoded, err := getEncryptionKey(); err != nil {
+			cmd.Printf("Error (%s)\n", err)
+			valid = false
+		} else if err := validateEncryptionKey(encryptionKeyB64Encoded); err != nil {
+			cmd.Printf("Error (%s)\n", err)
+			valid = false
+		} else {
+			cmd.Printf("OK\n")
+		}
+
+		cmd.Printf("Verifying API access... ")
+		if err := verifyAPIToken(viper.GetString("api.url"), viper.GetString("api.token")); err != nil {
+			cmd.Printf("Error (%s)\n", err)
+			valid = false
+		} else {
+			cmd.Printf("OK\n")
+		}
+
+		if !valid {
+			return fmt.Errorf("The configuration in %s is not valid.", viper.ConfigFileUsed())
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configViewCmd)
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configUnsetCmd)
+	configCmd.AddCommand(configValidateCmd)
+}
+
+func lookupConfigKey(name string) (configKey, error) {
+	for _, key := range configKeys {
+		if key.Name == strings.ToLower(name) {
+			return key, nil
+		}
+	}
+	var names []string
+	for _, key := range configKeys {
+		names = append(names, key.Name)
+	}
+	return configKey{}, fmt.Errorf("Unknown setting %q. Valid settings are: %s.", name, strings.Join(names, ", "))
+}
+
+// path returns where the key is stored in the config file.
+func (key configKey) path() string {
+	if key.Global {
+		return key.Name
+	}
+	return profileConfigKey(key.Name)
+}
+
+func validateNotEmpty(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("the value can't be empty")
+	}
+	return nil
+}
+
+func validateBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("the value must be true or false")
+	}
+	return nil
+}
+
+func validateAgeRecipients(value string) error {
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if _, err := age.ParseX25519Recipient(field); err != nil {
+			return fmt.Errorf("invalid age recipient %s", field)
+		}
+	}
+	return nil
+}
+
+func validateInt(value string) error {
+	if _, err := strconv.Atoi(value); err != nil {
+		return fmt.Errorf("the value must be a number")
+	}
+	return nil
+}
+
+func validateDirectory(value string) error {
+	if fi, err := os.Stat(expandHome(value)); err != nil || !fi.IsDir() {
+		return fmt.Errorf("directory not found")
+	}
+	return nil
+}
+
+func validateFileExists(value string) error {
+	if _, err := os.Stat(expandHome(value)); err != nil {
+		return fmt.Errorf("file not found")
+	}
+	return nil
+}
+
+func validateProfileName(value string) error {
+	if !isValidProfileName(value) {
+		return fmt.Errorf("invalid profile name, only letters, digits, `-` and `_` are allowed")
+	}
+	return nil
+}
+
+func validateAPIURL(value string) error {
+	parsedURL, err := url.Parse(value)
+	if err != nil || parsedURL.Host == "" {
+		return fmt.Errorf("invalid URL, it must start with https://")
+	}
+	// Plain HTTP would send the API token and the SSE-C keys in the clear,
+	// it is only accepted for a local server.
+	if parsedURL.Scheme == "http" && isLoopbackHost(parsedURL.Hostname()) {
+		return nil
+	}
+	if parsedURL.Scheme != "https" {
+		return fmt.Errorf("invalid URL, it must start with https:// (http:// is only accepted for localhost)")
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func validateAPITokenFormat(value string) error {
+	re := regexp.MustCompile(`^[a-zA-Z0-9]{40}$`)
+	if !re.MatchString(value) {
+		return fmt.Errorf("invalid API token, it must contain 40 letters or digits")
+	}
+	return nil
+}
+
+func validateEncryptionKey(value string) error {
+	key, err := decodeKey(value)
+	if err != nil {
+		return fmt.Errorf("invalid encryption key, it is not base64 encoded")
+	}
+	defer key.Destroy()
+	if len(key.Bytes()) != 32 {
+		return fmt.Errorf("invalid encryption key, it must be 32 bytes long but it is %d bytes long", len(key.Bytes()))
+	}
+	return nil
+}
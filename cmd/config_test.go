@@ -0,0 +1,135 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfigSetAndUnset(t *testing.T) {
+	viper.Reset()
+
+	tmpDir := t.TempDir()
+	configFile := tmpDir + "/config.yaml"
+	if err := os.WriteFile(configFile, []byte("api:\n  url: https://example.com/api/v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "config", "set", "encryption-key-b64encoded", "nMncUq8SsU7uz3cMucmFmgvUGXZ8LiBm8qx93hzrh6k="})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Config file permissions should be 0600, got: %o", fi.Mode().Perm())
+	}
+
+	content, err := readConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := getConfigValue(content, "encryption-key-b64encoded"); value != "nMncUq8SsU7uz3cMucmFmgvUGXZ8LiBm8qx93hzrh6k=" {
+		t.Errorf("Encryption key was not stored, got: %v", value)
+	}
+	if value, _ := getConfigValue(content, "api.url"); value != "https://example.com/api/v1" {
+		t.Errorf("Existing settings must be kept, got: %v", value)
+	}
+
+	viper.Reset()
+	actual.Reset()
+	RootCmd.SetArgs([]string{"--config", configFile, "config", "view"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(actual.String(), "nMncUq8SsU7uz3cMucmFmgvUGXZ8LiBm8qx93hzrh6k=") {
+		t.Errorf("`config view` must not display secrets")
+	}
+
+	RootCmd.SetArgs([]string{"--config", configFile, "config", "unset", "api.url"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	content, err = readConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := getConfigValue(content, "api"); exists {
+		t.Errorf("Setting was not removed: %v", content)
+	}
+}
+
+func TestConfigSetRejectsInvalidValues(t *testing.T) {
+	viper.Reset()
+
+	configFile := t.TempDir() + "/config.yaml"
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "config", "set", "encryption-key-b64encoded", "c2hvcnQ="})
+	if err := RootCmd.Execute(); err == nil {
+		t.Errorf("A short encryption key should be rejected")
+	}
+	RootCmd.SetArgs([]string{"--config", configFile, "config", "set", "unknown", "value"})
+	if err := RootCmd.Execute(); err == nil {
+		t.Errorf("An unknown setting should be rejected")
+	}
+	if _, err := os.Stat(configFile); err == nil {
+		t.Errorf("Config file should not be written when the value is invalid")
+	}
+}
+
+func TestValidateEncryptionKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		expectErr bool
+	}{
+		{"Valid key", "nMncUq8SsU7uz3cMucmFmgvUGXZ8LiBm8qx93hzrh6k=", false},
+		{"Not base64", "not a base64 string", true},
+		{"Too short", "c2hvcnQ=", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateEncryptionKey(test.key)
+			if test.expectErr && err == nil {
+				t.Errorf("Expected error but got nil")
+			}
+			if !test.expectErr && err != nil {
+				t.Errorf("Did not expect error but got: %q", err.Error())
+			}
+		})
+	}
+}
+
+func TestValidateAPIURL(t *testing.T) {
+	tests := []struct {
+		url       string
+		expectErr bool
+	}{
+		{"https://dashboard.securaebackup.com/api/v1", false},
+		{"http://dashboard.securaebackup.com/api/v1", true},
+		{"http://localhost:8000/api/v1", false},
+		{"http://127.0.0.1:8000", false},
+		{"ftp://dashboard.securaebackup.com", true},
+		{"dashboard.securaebackup.com", true},
+	}
+	for _, test := range tests {
+		if err := validateAPIURL(test.url); (err != nil) != test.expectErr {
+			t.Errorf("%s: got %v, expected an error: %v", test.url, err, test.expectErr)
+		}
+	}
+}
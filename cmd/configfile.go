@@ -0,0 +1,169 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile returns the raw content of a YAML config file. A missing
+// file is not an error, it just returns an empty map.
+func readConfigFile(filename string) (map[string]interface{}, error) {
+	content := make(map[string]interface{})
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return content, nil
+		}
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("error parsing YAML: %w", err)
+	}
+	if content == nil {
+		content = make(map[string]interface{})
+	}
+	return content, nil
+}
+
+// writeConfigFile atomically replaces the config file with writeFileAtomic.
+func writeConfigFile(filename string, content map[string]interface{}) error {
+	data, err := yaml.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("error encoding updated YAML: %w", err)
+	}
+	if err := writeFileAtomic(filename, data); err != nil {
+		return fmt.Errorf("error writing updated file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces a file containing secrets: the content is written
+// to a temporary file in the same directory, synced and renamed over the
+// original one, so a crash or a full disk never leaves a truncated file. The
+// file is on disk when it returns, and always ends up with 0600 permissions.
+func writeFileAtomic(filename string, data []byte) error {
+	// Keep symlinked files (e.g. from a dotfiles repository) in place.
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+	}
+
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, ".securae-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if err := tmpFile.Chmod(0600); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return err
+	}
+	// The rename itself is only durable once the directory is synced,
+	// which is not supported everywhere, e.g. on Windows.
+	if dirFile, err := os.Open(dir); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
+
+// updateConfigFile reads the config file, lets `update` modify its content
+// and writes it back. Only the keys touched by `update` change, so values
+// coming from flags or environment variables never end up in the file.
+func updateConfigFile(filename string, update func(content map[string]interface{}) error) error {
+	content, err := readConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := update(content); err != nil {
+		return err
+	}
+	return writeConfigFile(filename, content)
+}
+
+// getConfigValue looks up a dotted key (e.g. `api.token`) in the raw content.
+func getConfigValue(content map[string]interface{}, key string) (interface{}, bool) {
+	parts := strings.Split(key, ".")
+	var current interface{} = content
+	for _, part := range parts {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// setConfigValue stores a value under a dotted key, creating the
+// intermediate maps when needed.
+func setConfigValue(content map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	current := content
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			current[part] = next
+		}
+		current = next
+	}
+	current[parts[len(parts)-1]] = value
+}
+
+// unsetConfigValue removes a dotted key and any parent map left empty.
+// It returns false when the key was not present.
+func unsetConfigValue(content map[string]interface{}, key string) bool {
+	parts := strings.Split(key, ".")
+	if len(parts) == 1 {
+		if _, exists := content[key]; !exists {
+			return false
+		}
+		delete(content, key)
+		return true
+	}
+
+	child, ok := content[parts[0]].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if !unsetConfigValue(child, strings.Join(parts[1:], ".")) {
+		return false
+	}
+	if len(child) == 0 {
+		delete(content, parts[0])
+	}
+	return true
+}
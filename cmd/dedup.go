@@ -0,0 +1,108 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// An HMAC of the checksum of the file before compression and encryption is
+// stored in the object metadata, as the checksum of the uploaded data changes
+// on every upload with client-side encryption. Like the chunk IDs, it is
+// keyed with the master key, so the unencrypted metadata doesn't reveal
+// whether a known content is stored in the backup. The files encrypted with
+// age, uploaded without the key, don't have it.
+const metadataSourceMAC = "X-Amz-Meta-Securae-Source-Hmac-Sha256"
+
+const flagSkipExisting = "skip-existing"
+
+// sourceChecksumMAC returns the value of metadataSourceMAC for the SHA-256
+// `checksum` of a file, or an empty string without the encryption key.
+func sourceChecksumMAC(encryptionKeyB64Encoded string, checksum string) (string, error) {
+	if encryptionKeyB64Encoded == "" {
+		return "", nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(checksum)
+	if err != nil {
+		return "", fmt.Errorf("invalid checksum %q", checksum)
+	}
+	masterKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return "", err
+	}
+	defer masterKey.Destroy()
+	macKey := newSecureBuffer(32)
+	defer macKey.Destroy()
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey.Bytes(), nil, []byte("securae source checksum")), macKey.Bytes()); err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, macKey.Bytes())
+	mac.Write(sum)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// maxStoredSize is the largest size a file of `size` bytes can take once
+// compressed and encrypted, with some margin: incompressible data grows a
+// little, and the envelope and age add a few bytes per chunk.
+func maxStoredSize(size int64) int64 {
+	return size + size/64 + 64*1024
+}
+
+// findIdenticalObject returns the name of an object of the backup with the
+// same content as the file, as given by its SHA-256 `checksum` and its
+// `size`, or an empty string. The most recent objects are checked first, the
+// latest version of each name once, and the objects too large to hold the
+// file are not checked. Objects uploaded with another encryption key are
+// ignored.
+func findIdenticalObject(apiURL string, apiToken string, backupId string, encryptionKeyB64Encoded string, checksum string, size int64) (string, error) {
+	backup, err := fetchBackupData(fmt.Sprintf("%s/backups/%s", apiURL, backupId), apiToken)
+	if err != nil {
+		return "", err
+	}
+	sourceMAC, err := sourceChecksumMAC(encryptionKeyB64Encoded, checksum)
+	if err != nil {
+		return "", err
+	}
+
+	metadataURL := fmt.Sprintf("%s/backups/%s/metadata/", apiURL, backupId)
+	checked := make(map[string]bool)
+	for i := len(backup.Backupobjects) - 1; i >= 0; i-- {
+		name := backup.Backupobjects[i].Name
+		if strings.HasPrefix(name, chunkPrefix) || checked[name] {
+			continue
+		}
+		// Only the latest version of a name can be read.
+		checked[name] = true
+		if int64(backup.Backupobjects[i].Size) > maxStoredSize(size) {
+			continue
+		}
+		postData, err := json.Marshal(map[string]interface{}{"filename": name, "include_checksum": true})
+		if err != nil {
+			return "", err
+		}
+		presignedURL, err := fetchPresignedURL(metadataURL, apiToken, postData)
+		if err != nil {
+			return "", err
+		}
+		headers, _, err := fetchEncryptedObjectMetadata(presignedURL, encryptionKeyB64Encoded)
+		if err != nil {
+			if strings.Contains(err.Error(), "does not match") {
+				continue
+			}
+			return "", err
+		}
+		if (sourceMAC != "" && headers.Get(metadataSourceMAC) == sourceMAC) || headers.Get("X-Amz-Checksum-Sha256") == checksum {
+			return name, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadSkipExisting(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("other-key.sql", []byte("same dump"), testKeyringKey)
+
+	configFile := storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "dump-1.sql")
+	if err := os.WriteFile(dump, []byte("same dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer uploadCmd.Flags().Set(flagSkipExisting, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", dump, "--skip-existing", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	uploaded := storage.get("dump-1.sql")
+	if uploaded == nil {
+		t.Fatalf("The file should be uploaded when no file has the same content:\n%s", actual)
+	}
+	sum := sha256.Sum256([]byte("same dump"))
+	for name, values := range uploaded.Metadata {
+		if strings.Contains(strings.Join(values, ","), base64.StdEncoding.EncodeToString(sum[:])) {
+			t.Errorf("The checksum of the file should not be stored in clear in %s", name)
+		}
+	}
+
+	// The same content under another name, encrypted with another data key.
+	again := filepath.Join(dir, "dump-2.sql")
+	if err := os.WriteFile(again, []byte("same dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	actual.Reset()
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", again, "--skip-existing", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if storage.get("dump-2.sql") != nil {
+		t.Errorf("The file should not be uploaded again")
+	}
+	if !strings.Contains(actual.String(), "unchanged (same content as dump-1.sql)") {
+		t.Errorf("The upload should be reported as unchanged:\n%s", actual)
+	}
+}
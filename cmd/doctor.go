@@ -0,0 +1,394 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/mod/semver"
+)
+
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// Presigned URLs are rejected by the storage provider when the clock is
+// more than 15 minutes off.
+const maxClockSkew = 15 * time.Minute
+const warnClockSkew = 1 * time.Minute
+
+type doctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [flags]",
+	Short: "Diagnose configuration and connectivity issues",
+	Long: `Run a set of checks on the configuration, the network connection and the
+encryption key, and show how to fix the issues found.
+
+When a backup ID is given, the encryption key is also checked against the
+latest file of that backup.`,
+	Example: `securae doctor
+
+# also check the encryption key against the latest file of a backup
+securae doctor --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456`,
+	Args:    cobra.NoArgs,
+	GroupID: "setup",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(flagBackupId, cmd.Flags().Lookup(flagBackupId))
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		apiURL := viper.GetString("api.url")
+		apiToken := viper.GetString("api.token")
+
+		checks := []doctorCheck{checkConfigFile(viper.ConfigFileUsed())}
+		checks = append(checks, checkNetwork(apiURL)...)
+		checks = append(checks, checkAPI(apiURL, apiToken, time.Now())...)
+		// The key is read once, as reading it can prompt for a passphrase
+		// or run a command.
+		keyCheck, encryptionKeyB64Encoded := checkEncryptionKey()
+		checks = append(checks, keyCheck)
+		checks = append(checks, checkEncryptionKeyMatch(apiURL, apiToken, encryptionKeyB64Encoded))
+
+		showDoctorChecks(cmd, checks)
+		for _, check := range checks {
+			if check.Status == checkFail {
+				return fmt.Errorf("Some checks failed, see the hints above.")
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) used to check the encryption key. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+}
+
+func showDoctorChecks(cmd *cobra.Command, checks []doctorCheck) {
+	textStatus := map[string]func(a ...interface{}) string{
+		checkPass: color.New(color.Bold, color.FgGreen).SprintFunc(),
+		checkWarn: color.New(color.Bold, color.FgYellow).SprintFunc(),
+		checkFail: color.New(color.Bold, color.FgRed).SprintFunc(),
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "CHECK\tSTATUS\tDETAILS\n")
+	for _, check := range checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, textStatus[check.Status](check.Status), check.Detail)
+	}
+	w.Flush()
+
+	var hints []string
+	for _, check := range checks {
+		if check.Status != checkPass && check.Hint != "" {
+			hints = append(hints, fmt.Sprintf("- %s: %s", check.Name, check.Hint))
+		}
+	}
+	if len(hints) > 0 {
+		cmd.Printf("\nHints:\n%s\n", strings.Join(hints, "\n"))
+	}
+}
+
+func checkConfigFile(filename string) doctorCheck {
+	check := doctorCheck{Name: "Config file"}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		check.Status = checkFail
+		if errors.Is(err, fs.ErrNotExist) {
+			check.Detail = fmt.Sprintf("%s not found", filename)
+			check.Hint = "Run `securae init --api-token <token>` to create it."
+		} else {
+			check.Detail = err.Error()
+			check.Hint = "Check that the config file can be read by the current user."
+		}
+		return check
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		check.Status = checkWarn
+		check.Detail = fmt.Sprintf("%s is readable by other users (%o)", filename, fi.Mode().Perm())
+		check.Hint = fmt.Sprintf("It contains secrets, restrict its permissions with `chmod 600 %s`.", filename)
+		return check
+	}
+
+	check.Status = checkPass
+	check.Detail = filename
+	return check
+}
+
+func checkNetwork(apiURL string) []doctorCheck {
+	proxyCheck := doctorCheck{Name: "Proxy", Status: checkPass}
+	dnsCheck := doctorCheck{Name: "DNS"}
+
+	parsedURL, err := url.Parse(apiURL)
+	if err != nil || parsedURL.Host == "" {
+		dnsCheck.Status = checkFail
+		dnsCheck.Detail = fmt.Sprintf("invalid API URL %q", apiURL)
+		dnsCheck.Hint = "Fix it with `securae config set api.url <url>`."
+		proxyCheck.Status = checkWarn
+		proxyCheck.Detail = "skipped"
+		return []doctorCheck{proxyCheck, dnsCheck}
+	}
+
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: parsedURL})
+	if err != nil {
+		proxyCheck.Status = checkFail
+		proxyCheck.Detail = err.Error()
+		proxyCheck.Hint = "Check the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables."
+	} else if proxyURL != nil {
+		proxyCheck.Detail = fmt.Sprintf("using %s", proxyURL.Redacted())
+	} else {
+		proxyCheck.Detail = "direct connection"
+	}
+
+	addrs, err := net.LookupHost(parsedURL.Hostname())
+	if err != nil {
+		dnsCheck.Status = checkFail
+		dnsCheck.Detail = err.Error()
+		dnsCheck.Hint = fmt.Sprintf("Check the DNS settings of this device, %s must be resolvable.", parsedURL.Hostname())
+		if proxyURL != nil {
+			// The proxy may resolve the name on our behalf.
+			dnsCheck.Status = checkWarn
+		}
+	} else {
+		dnsCheck.Status = checkPass
+		dnsCheck.Detail = fmt.Sprintf("%s resolves to %s", parsedURL.Hostname(), strings.Join(addrs, ", "))
+	}
+
+	return []doctorCheck{proxyCheck, dnsCheck}
+}
+
+// checkAPI makes a single request to the API and derives from it the checks
+// about TLS, the API token, the clock and the CLI version.
+func checkAPI(apiURL string, token string, now time.Time) []doctorCheck {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+
+	req, err := http.NewRequest("GET", apiURL+"/users/me", nil)
+	if err == nil {
+		req.Header.Set("Authorization", "Token "+token)
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	var resp *http.Response
+	if err == nil {
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		return []doctorCheck{{
+			Name:   "API connection",
+			Status: checkFail,
+			Detail: err.Error(),
+			Hint:   fmt.Sprintf("Please verify that %s is reachable from this device.", apiURL),
+		}}
+	}
+	defer resp.Body.Close()
+
+	return []doctorCheck{
+		checkTLS(resp.TLS, now),
+		checkAPIToken(resp.StatusCode),
+		checkClockSkew(resp.Header.Get("Date"), now),
+		checkCLIVersion(resp.Header, version),
+	}
+}
+
+func checkTLS(state *tls.ConnectionState, now time.Time) doctorCheck {
+	check := doctorCheck{Name: "TLS"}
+	if state == nil {
+		check.Status = checkWarn
+		check.Detail = "the API is not using HTTPS"
+		check.Hint = "Use an https:// URL for `api.url`."
+		return check
+	}
+
+	check.Status = checkPass
+	check.Detail = tls.VersionName(state.Version)
+	if len(state.PeerCertificates) > 0 {
+		expiry := state.PeerCertificates[0].NotAfter
+		check.Detail += fmt.Sprintf(", certificate valid until %s", expiry.Format(time.RFC822Z))
+		if expiry.Sub(now) < 7*24*time.Hour {
+			check.Status = checkWarn
+			check.Hint = "The API certificate expires soon, contact Securae support if it is not renewed."
+		}
+	}
+	return check
+}
+
+func checkAPIToken(statusCode int) doctorCheck {
+	check := doctorCheck{Name: "API token"}
+	switch statusCode {
+	case http.StatusOK:
+		check.Status = checkPass
+		check.Detail = "valid"
+	case http.StatusUnauthorized:
+		check.Status = checkFail
+		check.Detail = "rejected by the API"
+		check.Hint = "Check the API token with `securae config set api.token <token>`."
+	default:
+		check.Status = checkFail
+		check.Detail = fmt.Sprintf("unexpected status code %d", statusCode)
+		check.Hint = "The API service is unavailable. Please, try again in a few minutes."
+	}
+	return check
+}
+
+func checkClockSkew(date string, now time.Time) doctorCheck {
+	check := doctorCheck{Name: "Clock"}
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		check.Status = checkWarn
+		check.Detail = "the API didn't report its time"
+		return check
+	}
+
+	skew := now.Sub(serverTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	skew = skew.Round(time.Second)
+
+	check.Detail = fmt.Sprintf("%s off from the API", skew)
+	switch {
+	case skew > maxClockSkew:
+		check.Status = checkFail
+		check.Hint = "Uploads and downloads will be rejected, synchronize the clock of this device (e.g. enable NTP)."
+	case skew > warnClockSkew:
+		check.Status = checkWarn
+		check.Hint = "Synchronize the clock of this device (e.g. enable NTP)."
+	default:
+		check.Status = checkPass
+	}
+	return check
+}
+
+func checkCLIVersion(headers http.Header, ownVersion string) doctorCheck {
+	check := doctorCheck{Name: "CLI version", Status: checkPass, Detail: ownVersion}
+	latestVersion := headers.Get("X-Securae-Cli-Latest-Version")
+	if err := CheckCLIVersionHeaders(headers, ownVersion); err != nil {
+		check.Status = checkFail
+		check.Detail = fmt.Sprintf("%s is no longer supported, latest is %s", ownVersion, latestVersion)
+		check.Hint = "Update the CLI, see https://docs.securaebackup.com/"
+		return check
+	}
+	if latestVersion != "" && semver.Compare("v"+ownVersion, "v"+latestVersion) < 0 {
+		check.Status = checkWarn
+		check.Detail = fmt.Sprintf("%s, latest is %s", ownVersion, latestVersion)
+		check.Hint = "A newer version is available, see https://docs.securaebackup.com/"
+	}
+	return check
+}
+
+// checkEncryptionKey also returns the key when it is valid.
+func checkEncryptionKey() (doctorCheck, string) {
+	check := doctorCheck{Name: "Encryption key"}
+	provider := newKeyProvider(keySetting)
+	if provider == nil && ageConfigured() {
+		check.Status = checkPass
+		check.Detail = "not needed, files are encrypted with age"
+		if _, err := ageRecipients(); err != nil && !viper.IsSet(configAgeIdentityFile) {
+			check.Status = checkFail
+			check.Detail = err.Error()
+		}
+		return check, ""
+	}
+	if provider == nil {
+		check.Status = checkFail
+		check.Detail = "not set"
+		check.Hint = "Run `securae init` to generate one, or set the key you used to upload your files."
+		return check, ""
+	}
+	encryptionKeyB64Encoded, err := provider.EncryptionKey()
+	if err != nil {
+		check.Status = checkFail
+		check.Detail = err.Error()
+		check.Hint = fmt.Sprintf("Check that the key can be read from %s.", provider.Name())
+		return check, ""
+	}
+	if err := validateEncryptionKey(encryptionKeyB64Encoded); err != nil {
+		check.Status = checkFail
+		check.Detail = err.Error()
+		check.Hint = fmt.Sprintf("Verify the key stored in %s.", provider.Name())
+		return check, ""
+	}
+	fingerprint, _ := hashEncryptionKey(encryptionKeyB64Encoded)
+	check.Status = checkPass
+	check.Detail = fmt.Sprintf("32 bytes from %s, fingerprint (MD5) %s", provider.Name(), fingerprint)
+	return check, encryptionKeyB64Encoded
+}
+
+// checkEncryptionKeyMatch sends a HEAD request for the latest file of the
+// backup, which is rejected if it was uploaded with another key. The key is
+// the one returned by checkEncryptionKey, empty when it is not valid.
+func checkEncryptionKeyMatch(apiURL string, token string, encryptionKeyB64Encoded string) doctorCheck {
+	check := doctorCheck{Name: "Key matches backup"}
+	backupId, err := getBackupId()
+	if err != nil {
+		check.Status = checkWarn
+		check.Detail = "skipped, no backup ID"
+		check.Hint = "Run `securae doctor --backup-id <id>` to check the key against your files."
+		return check
+	}
+	if encryptionKeyB64Encoded == "" {
+		check.Status = checkWarn
+		check.Detail = "skipped, no valid encryption key"
+		return check
+	}
+
+	metadataURL := fmt.Sprintf("%s/backups/%s/metadata/", apiURL, backupId)
+	presignedURL, err := fetchPresignedURL(metadataURL, token, []byte(`{"include_checksum": true}`))
+	if err != nil {
+		check.Status = checkWarn
+		check.Detail = "skipped, " + strings.TrimSuffix(err.Error(), ".")
+		return check
+	}
+
+	// The file may have been uploaded with a key of the keyring, set for
+	// the backup with `key use`.
+	matched := encryptionKeyB64Encoded
+	if viper.IsSet("keyring") {
+		matched, _, _, err = findEncryptionKey(presignedURL)
+	} else {
+		_, err = fetchChecksum(presignedURL, encryptionKeyB64Encoded)
+	}
+	if err != nil {
+		check.Status = checkFail
+		check.Detail = err.Error()
+		if strings.Contains(err.Error(), "does not match") {
+			check.Detail = "the latest file was uploaded with another key"
+			check.Hint = "Verify the value of `encryption-key-b64encoded` in your configuration file."
+		}
+		return check
+	}
+
+	parsedURL, _ := url.Parse(presignedURL)
+	check.Status = checkPass
+	check.Detail = fmt.Sprintf("checked with %s", filepath.Base(parsedURL.Path))
+	if matched != encryptionKeyB64Encoded {
+		fingerprint, _ := hashEncryptionKey(matched)
+		check.Detail += fmt.Sprintf(", uploaded with the keyring key %s", fingerprint)
+	}
+	return check
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestCheckConfigFilePermissions(t *testing.T) {
+	configFile := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(configFile, []byte("api:\n  token: xxxxx\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if check := checkConfigFile(configFile); check.Status != checkWarn {
+		t.Errorf("A config file readable by other users should be reported, got: %s", check.Status)
+	}
+	if err := os.Chmod(configFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if check := checkConfigFile(configFile); check.Status != checkPass {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", check.Status, checkPass)
+	}
+	if check := checkConfigFile(configFile + ".missing"); check.Status != checkFail {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", check.Status, checkFail)
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		date   string
+		status string
+	}{
+		{"In sync", now.Add(2 * time.Second).Format(http.TimeFormat), checkPass},
+		{"Slightly off", now.Add(-5 * time.Minute).Format(http.TimeFormat), checkWarn},
+		{"Too far off", now.Add(20 * time.Minute).Format(http.TimeFormat), checkFail},
+		{"No date", "", checkWarn},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check := checkClockSkew(test.date, now)
+			if check.Status != test.status {
+				t.Errorf("Result was incorrect, got: %s, want: %s.", check.Status, test.status)
+			}
+		})
+	}
+}
+
+func TestCheckAPI(t *testing.T) {
+	now := time.Now()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", now.Add(-30*time.Minute).UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Securae-Cli-Min-Supported-Version", "0.0.1")
+		w.Header().Set("X-Securae-Cli-Latest-Version", "99.0.0")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	want := map[string]string{
+		"TLS":         checkWarn,
+		"API token":   checkFail,
+		"Clock":       checkFail,
+		"CLI version": checkWarn,
+	}
+	checks := checkAPI(server.URL, "xxxxx", now)
+	if len(checks) != len(want) {
+		t.Fatalf("Unexpected checks: %v", checks)
+	}
+	for _, check := range checks {
+		if want[check.Name] != check.Status {
+			t.Errorf("%s: got: %s, want: %s.", check.Name, check.Status, want[check.Name])
+		}
+	}
+}
+
+func TestCheckEncryptionKeyReadOnce(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql", []byte("dump"), testEncryptionKey)
+
+	viper.Reset()
+	counter := filepath.Join(t.TempDir(), "counter")
+	viper.Set("encryption-key-command", "echo x >> "+counter+"; echo "+testEncryptionKey)
+	viper.Set(flagBackupId, testBackupId)
+
+	keyCheck, encryptionKeyB64Encoded := checkEncryptionKey()
+	if keyCheck.Status != checkPass {
+		t.Fatalf("The key should be valid: %v", keyCheck)
+	}
+	if check := checkEncryptionKeyMatch(storage.URL, "xxxxx", encryptionKeyB64Encoded); check.Status != checkPass {
+		t.Errorf("The key should match the backup: %v", check)
+	}
+	if runs, _ := os.ReadFile(counter); strings.Count(string(runs), "x") != 1 {
+		t.Errorf("The key command should run once, it ran %d times", strings.Count(string(runs), "x"))
+	}
+}
+
+func TestCheckEncryptionKeyMatchWithKeyring(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql", []byte("dump"), testKeyringKey)
+
+	viper.Reset()
+	viper.Set("encryption-key-b64encoded", testEncryptionKey)
+	viper.Set("keyring", []interface{}{map[string]interface{}{"label": "old", "key": testKeyringKey}})
+	viper.Set(flagBackupId, testBackupId)
+
+	check := checkEncryptionKeyMatch(storage.URL, "xxxxx", testEncryptionKey)
+	if check.Status != checkPass || !strings.Contains(check.Detail, "keyring key") {
+		t.Errorf("The key of the keyring should match the backup: %v", check)
+	}
+}
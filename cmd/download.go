@@ -4,6 +4,7 @@ Copyright 2024-2025 Securae Backup
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -23,6 +24,14 @@ var downloadCmd = &cobra.Command{
 	Long: `Download files using a backup ID (UUID format), as defined in the web UI.
 
 If there is no filename argument, this command downloads the latest file from the backup.
+
+Files uploaded with --compress are decompressed, unless --raw is used.
+
+With --preserve, the mode, modification time and extended attributes of the
+uploaded file are restored. As they are stored unencrypted and can be changed
+by anyone with access to the bucket, the setuid and setgid bits and the
+extended attributes outside user.* are only restored with
+--preserve-privileged, and the owner too when running as root.
 `,
 	Example: `# using --backup-id
 securae download database-dump.tar.gz --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
@@ -30,6 +39,9 @@ securae download database-dump.tar.gz --backup-id=abcd1234-ab12-ab12-ab12-abcdef
 # without specifying a filename it downloads the latest uploaded file
 securae download --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
 
+# restore the permissions and the modification time of a key
+securae download server.key --preserve --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
 # download a file using an environment variable
 export SECURAE_BACKUP_ID=abcd1234-ab12-ab12-ab12-abcdef123456
 securae download database-dump.tar.gz`,
@@ -52,7 +64,7 @@ securae download database-dump.tar.gz`,
 			return err
 		}
 
-		encryptionKeyB64Encoded, err := getEncryptionKey()
+		nameKey, err := filenameKey()
 		if err != nil {
 			return err
 		}
@@ -60,10 +72,18 @@ securae download database-dump.tar.gz`,
 		postData := []byte(fmt.Sprintf(`{"include_checksum": true}`))
 		if len(args) > 0 {
 			filename := args[0]
-			filenameOnly := filepath.Base(filename)
+			filenameOnly, err := encryptFilename(filepath.Base(filename), nameKey)
+			if err != nil {
+				return err
+			}
 			postData = []byte(fmt.Sprintf(`{"filename": "%s", "include_checksum": true}`, filenameOnly))
 		}
 
+		encryptionKeyB64Encoded, err := getDownloadEncryptionKey(apiURL, apiToken, backupId, postData)
+		if err != nil {
+			return err
+		}
+
 		preDownloadURL := fmt.Sprintf("%s/backups/%s/predownload/", apiURL, backupId)
 		presignedURL, err := fetchPresignedURL(preDownloadURL, apiToken, postData)
 		if err != nil {
@@ -71,14 +91,42 @@ securae download database-dump.tar.gz`,
 		}
 
 		parsedURL, _ := url.Parse(presignedURL)
-		fileToDownload := filepath.Base(parsedURL.Path)
+		fileToDownload := filepath.Base(decryptFilename(filepath.Base(parsedURL.Path), nameKey))
+		raw, _ := cmd.Flags().GetBool(flagRaw)
 		cmd.Printf("Downloading file %s... ", fileToDownload)
-		err = downloadFile(presignedURL, encryptionKeyB64Encoded, fileToDownload)
+		savedAs, err := restoreFile(presignedURL, encryptionKeyB64Encoded, fileToDownload, raw, func() (*chunkStore, error) {
+			return newChunkStore(apiURL, apiToken, backupId, encryptionKeyB64Encoded)
+		})
 		if err == nil {
 			cmd.Printf("OK\n")
 		} else {
 			return err
 		}
+		privileged, _ := cmd.Flags().GetBool(flagPreservePrivileged)
+		if preserve, _ := cmd.Flags().GetBool(flagPreserve); preserve || privileged {
+			cmd.Printf("Restoring file metadata... ")
+			metadataURL, err := presignedMetadataURL(apiURL, apiToken, backupId, fileToDownload)
+			if err != nil {
+				return err
+			}
+			headers, _, err := fetchEncryptedObjectMetadata(metadataURL, encryptionKeyB64Encoded)
+			if err != nil {
+				return err
+			}
+			if headers.Get(metadataMode) == "" {
+				cmd.Printf("none (the file was uploaded by an older version)\n")
+			} else if skipped, err := applyFileMetadata(savedAs, headers, privileged); err != nil {
+				cmd.Printf("Error\n")
+				return err
+			} else if skipped {
+				cmd.Printf("OK (without the owner, setuid and setgid bits and extended attributes outside user.*, use --%s to restore them)\n", flagPreservePrivileged)
+			} else {
+				cmd.Printf("OK\n")
+			}
+		}
+		if savedAs != fileToDownload {
+			cmd.Printf("The file is compressed, it was saved as %s.\n", savedAs)
+		}
 		return nil
 
 	},
@@ -87,9 +135,118 @@ securae download database-dump.tar.gz`,
 func init() {
 	RootCmd.AddCommand(downloadCmd)
 	downloadCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) where your files will be stored. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+	downloadCmd.Flags().Bool(flagRaw, false, "Don't decompress the file, save it as it was uploaded")
+	downloadCmd.Flags().Bool(flagPreserve, false, "Restore the mode, modification time and user extended attributes of the uploaded file")
+	downloadCmd.Flags().Bool(flagPreservePrivileged, false, "Like --preserve, and also restore the owner, the setuid and setgid bits and all the extended attributes, trusting the unauthenticated metadata of the file")
 }
 
 func downloadFile(url, encryptionKeyB64Encoded, filename string) error {
+	resp, err := fetchObject(url, encryptionKeyB64Encoded)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create the file: %v", err)
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to write content to file: %v", err)
+	}
+
+	return nil
+}
+
+// restoreFile downloads a file and undoes what was done before the upload:
+// the client-side encryption, the chunking and, unless `raw` is set, the
+// compression. It returns the name of the file written, with the extension of
+// the codec when a compressed file is saved as is. The file is removed if it
+// can't be decrypted or decompressed.
+//
+// The chunks of a chunked file are read from the store returned by
+// `chunks`, only called for chunked files.
+func restoreFile(url, encryptionKeyB64Encoded, filename string, raw bool, chunks func() (*chunkStore, error)) (string, error) {
+	resp, encryption, err := fetchEncryptedObject(url, encryptionKeyB64Encoded)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var src io.Reader = resp.Body
+	if decrypt := clientSideDecrypter(encryption, encryptionKeyB64Encoded); decrypt != nil {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(decrypt(pw, resp.Body))
+		}()
+		src = pr
+	}
+	codec := resp.Header.Get(metadataCompression)
+	chunked := resp.Header.Get(metadataFormat) == formatChunked
+	if codec != "" && (!raw || chunked) {
+		// The index of a chunked file is always decompressed.
+		decompressed, err := decompressReader(src, codec)
+		if err != nil {
+			return "", err
+		}
+		defer decompressed.Close()
+		src = decompressed
+	} else if codec != "" {
+		filename += compressionExtensions[codec]
+	}
+
+	var index chunkIndex
+	var store *chunkStore
+	if chunked {
+		if err := json.NewDecoder(src).Decode(&index); err != nil {
+			return "", fmt.Errorf("error reading the index of the chunked file: %w", err)
+		}
+		store, err = chunks()
+		if err != nil {
+			return "", err
+		}
+		defer store.Close()
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the file: %v", err)
+	}
+	defer file.Close()
+
+	if chunked {
+		err = restoreChunks(file, index, store)
+	} else {
+		_, err = io.Copy(file, src)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(filename)
+		return "", err
+	}
+	return filename, nil
+}
+
+// clientSideDecrypter returns the function decrypting the files uploaded with
+// client-side or age encryption, or nil when they are only encrypted by the
+// storage provider. `encryption` is the mode of the file.
+func clientSideDecrypter(encryption string, encryptionKeyB64Encoded string) func(dst io.Writer, src io.Reader) error {
+	switch encryption {
+	case encryptionAge:
+		return decryptAge
+	case encryptionEnvelope:
+		return func(dst io.Writer, src io.Reader) error {
+			return decryptEnvelope(dst, src, encryptionKeyB64Encoded)
+		}
+	}
+	return nil
+}
+
+func fetchObject(url, encryptionKeyB64Encoded string) (*http.Response, error) {
 	tr := &http.Transport{
 		TLSHandshakeTimeout:   5 * time.Second,
 		IdleConnTimeout:       5 * time.Second,
@@ -99,43 +256,31 @@ func downloadFile(url, encryptionKeyB64Encoded, filename string) error {
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %v", err)
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
 	}
 
-	encryptionKeyMD5, _ := hashEncryptionKey(encryptionKeyB64Encoded)
-	req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
-	req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key", encryptionKeyB64Encoded)
-	req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key-MD5", encryptionKeyMD5)
+	setEncryptionHeaders(req.Header, encryptionKeyB64Encoded)
 	req.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
 	req.Header.Set("User-Agent", userAgent)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		body, _ := io.ReadAll(resp.Body)
-		if strings.Contains(string(body), "must provide the correct secret key") {
+		// Missing or unexpected SSE-C headers, for an object uploaded in
+		// another encryption mode, make the request invalid.
+		if strings.Contains(string(body), "must provide the correct secret key") || resp.StatusCode == http.StatusBadRequest {
 			msg := "the encryption key used to download the file does not match " +
 				"the one used to upload it.\nPlease, verify the value of " +
 				"`encryption-key-b64encoded` in your configuration file."
-			return fmt.Errorf(msg)
+			return nil, fmt.Errorf(msg)
 		}
-		return fmt.Errorf("status code: %s", resp.Status)
+		return nil, fmt.Errorf("status code: %s", resp.Status)
 	}
 
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create the file: %v", err)
-	}
-	defer file.Close()
-
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to write content to file: %v", err)
-	}
-
-	return nil
+	return resp, nil
 }
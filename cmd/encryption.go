@@ -0,0 +1,126 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The encryption mode of each object is stored in its metadata when it is
+// uploaded, so the objects uploaded before the configuration changed can
+// still be read. As the SSE-C key sent to the storage provider depends on the
+// mode, the mode of an object is found by trying the key of each mode, the
+// one of the current configuration first.
+
+const metadataEncryption = "X-Amz-Meta-Securae-Encryption"
+
+// Encryption modes stored in the metadata, along with encryptionAge. The
+// objects only encrypted by the storage provider have no mode.
+const encryptionEnvelope = "envelope"
+
+// uploadEncryption returns the mode of the files uploaded with the current
+// configuration.
+func uploadEncryption() string {
+	switch {
+	case ageEncryption():
+		return encryptionAge
+	case clientSideEncryption():
+		return encryptionEnvelope
+	}
+	return ""
+}
+
+// withUploadEncryption adds the mode of the current configuration to the
+// metadata of an object to upload.
+func withUploadEncryption(metadata map[string]string) map[string]string {
+	encryption := uploadEncryption()
+	if encryption == "" {
+		return metadata
+	}
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[metadataEncryption] = encryption
+	return metadata
+}
+
+// objectEncryptions returns the modes an object may have been uploaded with,
+// the one of the current configuration first.
+func objectEncryptions() []string {
+	encryptions := []string{uploadEncryption()}
+	for _, encryption := range []string{"", encryptionEnvelope, encryptionAge} {
+		if encryption != encryptions[0] {
+			encryptions = append(encryptions, encryption)
+		}
+	}
+	return encryptions
+}
+
+// findObjectEncryption calls `fetch` with the SSE-C key of each mode until
+// the storage provider accepts one, and returns the mode of the object. The
+// mode stored in the metadata takes precedence over the one of the key.
+func findObjectEncryption(encryptionKeyB64Encoded string, fetch func(sseKey string) (http.Header, error)) (string, error) {
+	var mismatch error
+	for _, encryption := range objectEncryptions() {
+		// Without a key, only the files encrypted with age can be read.
+		if encryptionKeyB64Encoded == "" && encryption != encryptionAge {
+			continue
+		}
+		headers, err := fetch(sseCustomerKey(encryptionKeyB64Encoded, encryption))
+		if err != nil {
+			if !strings.Contains(err.Error(), "does not match") {
+				return "", err
+			}
+			if mismatch == nil {
+				mismatch = err
+			}
+			continue
+		}
+		if stored := headers.Get(metadataEncryption); stored != "" {
+			encryption = stored
+		}
+		if encryption != "" && encryption != encryptionEnvelope && encryption != encryptionAge {
+			return "", fmt.Errorf("The file was uploaded with the encryption mode %q, which is not supported by this version.", encryption)
+		}
+		return encryption, nil
+	}
+	return "", mismatch
+}
+
+// fetchEncryptedObject downloads an object, and returns its encryption mode.
+func fetchEncryptedObject(url string, encryptionKeyB64Encoded string) (*http.Response, string, error) {
+	var resp *http.Response
+	encryption, err := findObjectEncryption(encryptionKeyB64Encoded, func(sseKey string) (http.Header, error) {
+		var err error
+		resp, err = fetchObject(url, sseKey)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Header, nil
+	})
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, "", err
+	}
+	return resp, encryption, nil
+}
+
+// fetchEncryptedObjectMetadata returns the headers of an object, and its
+// encryption mode.
+func fetchEncryptedObjectMetadata(url string, encryptionKeyB64Encoded string) (http.Header, string, error) {
+	var headers http.Header
+	encryption, err := findObjectEncryption(encryptionKeyB64Encoded, func(sseKey string) (http.Header, error) {
+		var err error
+		headers, err = fetchObjectMetadata(url, sseKey)
+		return headers, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return headers, encryption, nil
+}
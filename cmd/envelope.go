@@ -0,0 +1,260 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/spf13/viper"
+)
+
+// Client-side encryption wraps every file in an envelope before it is
+// uploaded, so the storage provider never sees the plaintext nor the key.
+//
+// A random data key encrypts the file with AES-256-GCM in chunks of
+// envelopeChunkSize bytes, and the data key itself is encrypted with the
+// master key. Each chunk nonce is a random prefix followed by the chunk
+// counter, and the last chunk is authenticated as such, so reordered or
+// truncated files are rejected.
+//
+//	magic (8) | key fingerprint (16) | wrap nonce (12) | wrapped data key (48) | nonce prefix (8)
+//	chunk 0 | chunk 1 | ... | last chunk
+const envelopeMagic = "SECURAE1"
+const envelopeChunkSize = 64 * 1024
+const envelopeHeaderSize = len(envelopeMagic) + md5.Size + 12 + 32 + 16 + 8
+
+const configClientSideEncryption = "client-side-encryption"
+
+func clientSideEncryption() bool {
+	return viper.GetBool(configClientSideEncryption)
+}
+
+// sseCustomerKey returns the key sent in the SSE-C headers for an object
+// uploaded with the `encryption` mode. With client-side encryption it is
+// derived from the master key, which never leaves the device.
+// Files encrypted with age are stored without SSE-C.
+func sseCustomerKey(encryptionKeyB64Encoded string, encryption string) string {
+	if encryption == encryptionAge {
+		return ""
+	}
+	if encryption != encryptionEnvelope || encryptionKeyB64Encoded == "" {
+		return encryptionKeyB64Encoded
+	}
+	encryptionKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return encryptionKeyB64Encoded
+	}
+	defer encryptionKey.Destroy()
+	mac := hmac.New(sha256.New, encryptionKey.Bytes())
+	mac.Write([]byte("securae sse-c key"))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+// encryptEnvelope writes `src` to `dst` encrypted with a new data key.
+func encryptEnvelope(dst io.Writer, src io.Reader, encryptionKeyB64Encoded string) error {
+	masterKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return err
+	}
+	defer masterKey.Destroy()
+	masterGCM, err := newGCM(masterKey.Bytes())
+	if err != nil {
+		return err
+	}
+
+	random := newSecureBuffer(32 + 12 + 8)
+	defer random.Destroy()
+	if _, err := rand.Read(random.Bytes()); err != nil {
+		return err
+	}
+	dataKey, wrapNonce, noncePrefix := random.Bytes()[:32], random.Bytes()[32:44], random.Bytes()[44:]
+	fingerprint := md5.Sum(masterKey.Bytes())
+
+	header := append([]byte(envelopeMagic), fingerprint[:]...)
+	header = append(header, wrapNonce...)
+	header = masterGCM.Seal(header, wrapNonce, dataKey, []byte(envelopeMagic))
+	header = append(header, noncePrefix...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(src, envelopeChunkSize)
+	chunk := make([]byte, envelopeChunkSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := []byte{0}
+		if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+			final[0] = 1
+		}
+		if _, err := dst.Write(gcm.Seal(nil, chunkNonce(noncePrefix, counter), chunk[:n], final)); err != nil {
+			return err
+		}
+		if final[0] == 1 {
+			return nil
+		}
+		if counter == ^uint32(0) {
+			return fmt.Errorf("the file is too large to be encrypted")
+		}
+	}
+}
+
+// openEnvelope checks the header of an envelope and returns the cipher of
+// its data key, along with the prefix of its chunk nonces.
+func openEnvelope(header []byte, encryptionKeyB64Encoded string) (cipher.AEAD, []byte, error) {
+	masterKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer masterKey.Destroy()
+
+	if len(header) != envelopeHeaderSize || !bytes.HasPrefix(header, []byte(envelopeMagic)) {
+		return nil, nil, fmt.Errorf("the file was not uploaded with client-side encryption")
+	}
+	fingerprint := md5.Sum(masterKey.Bytes())
+	if !bytes.Equal(header[8:24], fingerprint[:]) {
+		return nil, nil, fmt.Errorf("the file was encrypted with the key %s, not with %s", base64.StdEncoding.EncodeToString(header[8:24]), base64.StdEncoding.EncodeToString(fingerprint[:]))
+	}
+
+	masterGCM, err := newGCM(masterKey.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey := newSecureBuffer(32)
+	defer dataKey.Destroy()
+	if _, err := masterGCM.Open(dataKey.Bytes()[:0], header[24:36], header[36:84], []byte(envelopeMagic)); err != nil {
+		return nil, nil, fmt.Errorf("the data key of the file could not be decrypted")
+	}
+	gcm, err := newGCM(dataKey.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, header[84:], nil
+}
+
+// decryptEnvelope writes the plaintext of the envelope read from `src` to
+// `dst`. Nothing unauthenticated is written, each chunk is verified first.
+func decryptEnvelope(dst io.Writer, src io.Reader, encryptionKeyB64Encoded string) error {
+	header := make([]byte, envelopeHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return fmt.Errorf("the file was not uploaded with client-side encryption")
+	}
+	gcm, noncePrefix, err := openEnvelope(header, encryptionKeyB64Encoded)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(src, envelopeChunkSize+gcm.Overhead())
+	chunk := make([]byte, envelopeChunkSize+gcm.Overhead())
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return fmt.Errorf("the encrypted file is truncated")
+			}
+			return err
+		}
+		final := []byte{0}
+		if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+			final[0] = 1
+		}
+		plaintext, err := gcm.Open(chunk[:0], chunkNonce(noncePrefix, counter), chunk[:n], final)
+		if err != nil {
+			return fmt.Errorf("the encrypted file is corrupted or was modified (chunk %d)", counter)
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		if final[0] == 1 {
+			return nil
+		}
+	}
+}
+
+// decryptEnvelopeRange writes `length` bytes of the plaintext, from
+// `offset`, of an envelope of `size` bytes. Only the header and the chunks
+// holding these bytes are read, with `fetch` which returns the bytes of the
+// envelope from `start` to `end` included.
+func decryptEnvelopeRange(dst io.Writer, fetch func(start, end int64) (io.ReadCloser, error), size int64, offset int64, length int64, encryptionKeyB64Encoded string) error {
+	if length == 0 {
+		return nil
+	}
+	headerReader, err := fetch(0, int64(envelopeHeaderSize)-1)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, envelopeHeaderSize)
+	_, err = io.ReadFull(headerReader, header)
+	headerReader.Close()
+	if err != nil {
+		return fmt.Errorf("the file was not uploaded with client-side encryption")
+	}
+	gcm, noncePrefix, err := openEnvelope(header, encryptionKeyB64Encoded)
+	if err != nil {
+		return err
+	}
+
+	sealedSize := int64(envelopeChunkSize + gcm.Overhead())
+	chunks := (size - int64(envelopeHeaderSize) + sealedSize - 1) / sealedSize
+	first, last := offset/envelopeChunkSize, (offset+length-1)/envelopeChunkSize
+	if last >= chunks {
+		return fmt.Errorf("the range is beyond the end of the encrypted file")
+	}
+	start := int64(envelopeHeaderSize) + first*sealedSize
+	end := min(start+(last-first+1)*sealedSize, size) - 1
+	src, err := fetch(start, end)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	chunk := make([]byte, sealedSize)
+	for counter := first; counter <= last; counter++ {
+		n, err := io.ReadFull(src, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("the encrypted file is truncated")
+		}
+		final := []byte{0}
+		if counter == chunks-1 {
+			final[0] = 1
+		}
+		plaintext, err := gcm.Open(chunk[:0], chunkNonce(noncePrefix, uint32(counter)), chunk[:n], final)
+		if err != nil {
+			return fmt.Errorf("the encrypted file is corrupted or was modified (chunk %d)", counter)
+		}
+		chunkOffset := counter * envelopeChunkSize
+		from := max(offset-chunkOffset, 0)
+		to := min(offset+length-chunkOffset, int64(len(plaintext)))
+		if from > to {
+			return fmt.Errorf("the range is beyond the end of the encrypted file")
+		}
+		if _, err := dst.Write(plaintext[from:to]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
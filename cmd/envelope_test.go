@@ -0,0 +1,138 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, envelopeChunkSize, 3*envelopeChunkSize + 7} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		encrypted := new(bytes.Buffer)
+		if err := encryptEnvelope(encrypted, bytes.NewReader(plaintext), testEncryptionKey); err != nil {
+			t.Fatal(err)
+		}
+		decrypted := new(bytes.Buffer)
+		if err := decryptEnvelope(decrypted, bytes.NewReader(encrypted.Bytes()), testEncryptionKey); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("size %d: the decrypted data doesn't match the original", size)
+		}
+	}
+}
+
+func TestEnvelopeRejectsModifiedData(t *testing.T) {
+	plaintext := make([]byte, 2*envelopeChunkSize+10)
+	encrypted := new(bytes.Buffer)
+	if err := encryptEnvelope(encrypted, bytes.NewReader(plaintext), testEncryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	data := encrypted.Bytes()
+
+	if err := decryptEnvelope(new(bytes.Buffer), bytes.NewReader(data), testKeyringKey); err == nil {
+		t.Errorf("A wrong key should be rejected")
+	}
+
+	modified := bytes.Clone(data)
+	modified[envelopeHeaderSize+100] ^= 1
+	if err := decryptEnvelope(new(bytes.Buffer), bytes.NewReader(modified), testEncryptionKey); err == nil {
+		t.Errorf("A modified chunk should be rejected")
+	}
+
+	truncated := data[:envelopeHeaderSize+envelopeChunkSize+16]
+	if err := decryptEnvelope(new(bytes.Buffer), bytes.NewReader(truncated), testEncryptionKey); err == nil {
+		t.Errorf("A truncated file should be rejected")
+	}
+}
+
+func TestUploadAndDownloadWithClientSideEncryption(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "db.sql")
+	if err := os.WriteFile(filename, []byte("secret dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+
+	object := storage.get("db.sql")
+	if bytes.Contains(object.Data, []byte("secret dump")) {
+		t.Errorf("The storage provider should not receive the plaintext")
+	}
+	if keyMD5, _ := hashEncryptionKey(testEncryptionKey); object.KeyMD5 == keyMD5 {
+		t.Errorf("The storage provider should not receive the master key")
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	RootCmd.SetArgs([]string{"--config", configFile, "download", "db.sql", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if content, _ := os.ReadFile("db.sql"); string(content) != "secret dump" {
+		t.Errorf("Result was incorrect, got: %q, want: %q.", content, "secret dump")
+	}
+}
+
+func TestDownloadAfterClientSideEncryptionToggle(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	dir := t.TempDir()
+	for _, name := range []string{"before.sql", "after.sql"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("dump "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	configFile := storage.writeConfig(t, testKeyConfig)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filepath.Join(dir, "before.sql"), "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	configFile = storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filepath.Join(dir, "after.sql"), "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if encryption := storage.get("after.sql").Metadata.Get(metadataEncryption); encryption != encryptionEnvelope {
+		t.Errorf("The encryption mode should be stored with the file, got %q", encryption)
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	for _, clientSide := range []string{"true", "false"} {
+		configFile = storage.writeConfig(t, testKeyConfig+"client-side-encryption: "+clientSide+"\n")
+		os.Chdir(t.TempDir())
+		for _, name := range []string{"before.sql", "after.sql"} {
+			RootCmd.SetArgs([]string{"--config", configFile, "download", name, "--backup-id", testBackupId})
+			if err := RootCmd.Execute(); err != nil {
+				t.Fatalf("client-side-encryption: %s, %s: %v\n%s", clientSide, name, err, actual)
+			}
+			if content, _ := os.ReadFile(name); string(content) != "dump "+name {
+				t.Errorf("client-side-encryption: %s, got: %q, want: %q.", clientSide, content, "dump "+name)
+			}
+		}
+	}
+}
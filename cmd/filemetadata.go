@@ -0,0 +1,178 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The mode, owner and modification time of the uploaded files are stored in
+// the object metadata, with their extended attributes when --xattrs is used,
+// so download --preserve can restore them. Like the rest of the object
+// metadata, they are not encrypted nor authenticated: anyone with write
+// access to the bucket can change them. So the owner, the setuid and setgid
+// bits and the extended attributes outside the user namespace, such as
+// security.* and trusted.*, are only restored with --preserve-privileged.
+
+const flagXattrs = "xattrs"
+const flagPreserve = "preserve"
+const flagPreservePrivileged = "preserve-privileged"
+
+const metadataMode = "X-Amz-Meta-Securae-Mode"
+const metadataUid = "X-Amz-Meta-Securae-Uid"
+const metadataGid = "X-Amz-Meta-Securae-Gid"
+const metadataModTime = "X-Amz-Meta-Securae-Mtime"
+const metadataXattrs = "X-Amz-Meta-Securae-Xattrs"
+
+// maxXattrsMetadata is the size limit of the encoded extended attributes, as
+// all the metadata of an object must fit in 2 KB.
+const maxXattrsMetadata = 1536
+
+// fileMetadata returns the object metadata recording the mode, owner,
+// modification time and, with `withXattrs`, the extended attributes of the
+// file.
+func fileMetadata(file *os.File, info os.FileInfo, withXattrs bool) (map[string]string, error) {
+	metadata := map[string]string{
+		metadataMode:    strconv.FormatUint(uint64(posixMode(info.Mode())), 8),
+		metadataModTime: info.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		metadata[metadataUid] = strconv.Itoa(uid)
+		metadata[metadataGid] = strconv.Itoa(gid)
+	}
+	if !withXattrs {
+		return metadata, nil
+	}
+	xattrs, err := readXattrs(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the extended attributes: %w", err)
+	}
+	if len(xattrs) == 0 {
+		return metadata, nil
+	}
+	// The names and values are not always ASCII, as metadata must be.
+	data, err := json.Marshal(xattrs)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if len(encoded) > maxXattrsMetadata {
+		return nil, fmt.Errorf("The extended attributes of the file are too large to be stored with it (%d bytes encoded, %d maximum).", len(encoded), maxXattrsMetadata)
+	}
+	metadata[metadataXattrs] = encoded
+	return metadata, nil
+}
+
+// applyFileMetadata restores the metadata recorded by fileMetadata. Unless
+// `privileged` is set, the owner, the setuid and setgid bits and the extended
+// attributes outside the user namespace are left out, and it reports whether
+// some were. The owner is only restored when running as root.
+func applyFileMetadata(filename string, headers http.Header, privileged bool) (bool, error) {
+	skipped := false
+	// The extended attributes are written first, a read-only mode would
+	// prevent it, and the owner before the mode, as changing it clears
+	// the setuid and setgid bits.
+	if encoded := headers.Get(metadataXattrs); encoded != "" {
+		var xattrs map[string][]byte
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			err = json.Unmarshal(data, &xattrs)
+		}
+		if err != nil {
+			return false, fmt.Errorf("The extended attributes stored with the file are invalid.")
+		}
+		names := make([]string, 0, len(xattrs))
+		for name := range xattrs {
+			if !privileged && !strings.HasPrefix(name, "user.") {
+				skipped = true
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := writeXattr(filename, name, xattrs[name]); err != nil {
+				return false, fmt.Errorf("failed to restore the extended attribute %s: %w", name, err)
+			}
+		}
+	}
+	if uid, gid := headers.Get(metadataUid), headers.Get(metadataGid); uid != "" && gid != "" && os.Geteuid() == 0 {
+		uid, err := strconv.Atoi(uid)
+		if err != nil {
+			return false, fmt.Errorf("The owner stored with the file is invalid.")
+		}
+		gid, err := strconv.Atoi(gid)
+		if err != nil {
+			return false, fmt.Errorf("The owner stored with the file is invalid.")
+		}
+		if !privileged {
+			skipped = true
+		} else if err := os.Lchown(filename, uid, gid); err != nil {
+			return false, err
+		}
+	}
+	if mode := headers.Get(metadataMode); mode != "" {
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || parsed > 07777 {
+			return false, fmt.Errorf("The mode stored with the file is invalid.")
+		}
+		if !privileged && parsed&06000 != 0 {
+			parsed &^= 06000
+			skipped = true
+		}
+		if err := os.Chmod(filename, fileMode(uint32(parsed))); err != nil {
+			return false, err
+		}
+	}
+	if modTime := headers.Get(metadataModTime); modTime != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, modTime)
+		if err != nil {
+			return false, fmt.Errorf("The modification time stored with the file is invalid.")
+		}
+		if err := os.Chtimes(filename, parsed, parsed); err != nil {
+			return false, err
+		}
+	}
+	return skipped, nil
+}
+
+// posixMode converts the permissions of a file to the octal POSIX mode, such
+// as 4755 for a setuid executable.
+func posixMode(mode fs.FileMode) uint32 {
+	posix := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		posix |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		posix |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		posix |= 01000
+	}
+	return posix
+}
+
+// fileMode is the reverse of posixMode.
+func fileMode(posix uint32) fs.FileMode {
+	mode := fs.FileMode(posix & 0777)
+	if posix&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if posix&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if posix&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+/*
+Copyright 2024-2025 Securae Backup
+*/
+
+package cmd
+
+import "os"
+
+// fileOwner is only implemented on Unix, elsewhere the owner is not recorded.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
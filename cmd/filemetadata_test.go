@@ -0,0 +1,122 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPosixMode(t *testing.T) {
+	for _, posix := range []uint32{0600, 0755, 04755, 02750, 01777} {
+		if got := posixMode(fileMode(posix)); got != posix {
+			t.Errorf("The mode %o should be converted back, got %o", posix, got)
+		}
+	}
+	if got := posixMode(fs.ModeDir | fs.ModeSetuid | 0700); got != 04700 {
+		t.Errorf("The mode should only keep the permissions, got %o", got)
+	}
+}
+
+func TestDownloadPreserve(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the extended attributes are tested on Linux")
+	}
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "server.key")
+	if err := os.WriteFile(filename, []byte("private key"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)
+	os.Chtimes(filename, modTime, modTime)
+	// Not all the file systems of the temporary directory support them.
+	withXattrs := writeXattr(filename, "user.securae.test", []byte{0, 1, 2}) == nil
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer uploadCmd.Flags().Set(flagXattrs, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--xattrs", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if mode := storage.get("server.key").Metadata.Get(metadataMode); mode != "400" {
+		t.Errorf("The mode should be stored with the file, got %q", mode)
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	defer downloadCmd.Flags().Set(flagPreserve, "false")
+	actual.Reset()
+	RootCmd.SetArgs([]string{"--config", configFile, "download", "server.key", "--preserve", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "Restoring file metadata... OK") {
+		t.Errorf("The metadata should be restored:\n%s", actual)
+	}
+	info, err := os.Stat("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0400 {
+		t.Errorf("The mode should be restored, got %v", info.Mode())
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("The modification time should be restored, got %v", info.ModTime())
+	}
+	if withXattrs {
+		file, _ := os.Open("server.key")
+		defer file.Close()
+		xattrs, err := readXattrs(file)
+		if err != nil || !bytes.Equal(xattrs["user.securae.test"], []byte{0, 1, 2}) {
+			t.Errorf("The extended attribute should be restored, got %v (%v)", xattrs, err)
+		}
+	}
+}
+
+func TestApplyFileMetadataWithoutPrivileges(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the setuid bit is tested on Unix")
+	}
+	filename := filepath.Join(t.TempDir(), "run.sh")
+	os.WriteFile(filename, nil, 0600)
+	headers := http.Header{}
+	headers.Set(metadataMode, "4755")
+	headers.Set(metadataXattrs, base64.StdEncoding.EncodeToString([]byte(`{"trusted.securae.test":"AA=="}`)))
+
+	skipped, err := applyFileMetadata(filename, headers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !skipped {
+		t.Errorf("The setuid bit and the trusted extended attribute should be reported as skipped")
+	}
+	info, _ := os.Stat(filename)
+	if info.Mode()&fs.ModeSetuid != 0 || info.Mode().Perm() != 0755 {
+		t.Errorf("Only the permissions should be restored, got %v", info.Mode())
+	}
+
+	headers.Del(metadataXattrs)
+	if skipped, err := applyFileMetadata(filename, headers, true); err != nil || skipped {
+		t.Fatalf("The setuid bit should be restored when trusted, got %v (%v)", skipped, err)
+	}
+	info, _ = os.Stat(filename)
+	if info.Mode()&fs.ModeSetuid == 0 {
+		t.Errorf("The setuid bit should be restored, got %v", info.Mode())
+	}
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+/*
+Copyright 2024-2025 Securae Backup
+*/
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user and group IDs of a file.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Filenames can be obfuscated before they are sent to the API, so the names
+// of the files don't show up in the dashboard. The encryption is
+// deterministic, like AES-SIV: the IV is an HMAC of the name, so the same
+// name always gives the same object and files can still be downloaded by
+// name. It only reveals that two files have the same name.
+
+const configObfuscateFilenames = "obfuscate-filenames"
+const obfuscatedPrefix = "enc."
+
+func obfuscateFilenames() bool {
+	return viper.GetBool(configObfuscateFilenames)
+}
+
+// filenameKey returns the master key used to obfuscate filenames, or an
+// empty string when they are sent in clear.
+func filenameKey() (string, error) {
+	if !obfuscateFilenames() {
+		return "", nil
+	}
+	encryptionKeyB64Encoded, err := getEncryptionKey()
+	if err != nil {
+		return "", fmt.Errorf("The encryption key is needed to obfuscate filenames: %w", err)
+	}
+	if err := validateEncryptionKey(encryptionKeyB64Encoded); err != nil {
+		return "", err
+	}
+	return encryptionKeyB64Encoded, nil
+}
+
+// deriveFilenameKeys derives from the master key one key for the IV and one
+// for the encryption. The first 32 bytes are the HMAC key, the last 32 the
+// AES key.
+//
+// The names are hidden from the API and the dashboard, not from the storage
+// provider: without client-side encryption, the master key itself is sent in
+// the SSE-C headers. The X-Amz-Meta-Securae-* headers, e.g. the mode or the
+// extended attributes of the file, are stored in the clear in any case.
+func deriveFilenameKeys(encryptionKeyB64Encoded string) (*secureBuffer, error) {
+	masterKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	defer masterKey.Destroy()
+	keys := newSecureBuffer(64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey.Bytes(), nil, []byte("securae filenames")), keys.Bytes()); err != nil {
+		keys.Destroy()
+		return nil, err
+	}
+	return keys, nil
+}
+
+// encryptFilename returns the name sent to the API. Without a key, the name
+// is returned as is.
+func encryptFilename(name string, encryptionKeyB64Encoded string) (string, error) {
+	if encryptionKeyB64Encoded == "" {
+		return name, nil
+	}
+	keys, err := deriveFilenameKeys(encryptionKeyB64Encoded)
+	if err != nil {
+		return "", err
+	}
+	defer keys.Destroy()
+	macKey, encKey := keys.Bytes()[:32], keys.Bytes()[32:]
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:aes.BlockSize]
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := make([]byte, len(name))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, []byte(name))
+	return obfuscatedPrefix + base64.RawURLEncoding.EncodeToString(append(iv, ciphertext...)), nil
+}
+
+// decryptFilename returns the original name of an obfuscated one. Names that
+// were not obfuscated, or were obfuscated with another key, are returned as
+// is.
+func decryptFilename(name string, encryptionKeyB64Encoded string) string {
+	if encryptionKeyB64Encoded == "" || !strings.HasPrefix(name, obfuscatedPrefix) {
+		return name
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(name, obfuscatedPrefix))
+	if err != nil || len(data) < aes.BlockSize {
+		return name
+	}
+	keys, err := deriveFilenameKeys(encryptionKeyB64Encoded)
+	if err != nil {
+		return name
+	}
+	defer keys.Destroy()
+	macKey, encKey := keys.Bytes()[:32], keys.Bytes()[32:]
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return name
+	}
+	iv := data[:aes.BlockSize]
+	plaintext := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, data[aes.BlockSize:])
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(plaintext)
+	if !bytes.Equal(mac.Sum(nil)[:aes.BlockSize], iv) {
+		return name
+	}
+	return string(plaintext)
+}
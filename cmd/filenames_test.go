@@ -0,0 +1,93 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptFilename(t *testing.T) {
+	name := "customers-2025-03-01.sql.gz"
+	encrypted, err := encryptFilename(name, testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, "customers") || !strings.HasPrefix(encrypted, obfuscatedPrefix) {
+		t.Errorf("The name was not obfuscated: %s", encrypted)
+	}
+	if again, _ := encryptFilename(name, testEncryptionKey); again != encrypted {
+		t.Errorf("The obfuscated name should be deterministic, got: %s and %s", encrypted, again)
+	}
+	if decrypted := decryptFilename(encrypted, testEncryptionKey); decrypted != name {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", decrypted, name)
+	}
+	if decrypted := decryptFilename(encrypted, testKeyringKey); decrypted != encrypted {
+		t.Errorf("A name obfuscated with another key should be left as is, got: %s", decrypted)
+	}
+	if decrypted := decryptFilename(name, testEncryptionKey); decrypted != name {
+		t.Errorf("A name in clear should be left as is, got: %s", decrypted)
+	}
+}
+
+func TestUploadAndDownloadWithObfuscatedFilenames(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig+"obfuscate-filenames: true\n")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "customers.sql")
+	if err := os.WriteFile(filename, []byte("dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if storage.get("customers.sql") != nil {
+		t.Fatalf("The filename should not be sent in clear")
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	RootCmd.SetArgs([]string{"--config", configFile, "download", "customers.sql", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if content, err := os.ReadFile("customers.sql"); err != nil || string(content) != "dump" {
+		t.Errorf("The file should be saved with its original name: %v", err)
+	}
+}
+
+func TestObfuscatedFilenamesReadKeyOnce(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	configFile := storage.writeConfig(t, "encryption-key-command: echo run >> "+runs+"; echo "+testEncryptionKey+"\nobfuscate-filenames: true\n")
+	filename := filepath.Join(dir, "customers.sql")
+	if err := os.WriteFile(filename, []byte("dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if content, _ := os.ReadFile(runs); string(content) != "run\n" {
+		t.Errorf("The key command should be run once per command, got %q", content)
+	}
+}
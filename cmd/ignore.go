@@ -0,0 +1,270 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// The files of a directory can be excluded with .securaeignore files, which
+// follow the gitignore syntax: each file applies to its directory and the
+// ones below, the last matching pattern wins, a pattern starting with ! includes
+// the files excluded by a previous one, and the content of an excluded
+// directory is never read. The files given with --exclude-from apply to the
+// whole directory, before the .securaeignore files.
+
+const ignoreFilename = ".securaeignore"
+const flagExcludeFrom = "exclude-from"
+
+type ignorePattern struct {
+	// Directory of the file the pattern comes from, relative to the root.
+	base    string
+	negate  bool
+	dirOnly bool
+	regexp  *regexp.Regexp
+}
+
+type ignoreMatcher struct {
+	root     string
+	patterns []ignorePattern
+}
+
+var lsFilesCmd = &cobra.Command{
+	Use:   "ls-files [directory] [flags]",
+	Short: "List the files of a directory that would be backed up",
+	Long: `List the files of a directory that would be backed up by snapshot create, once
+the files excluded by the .securaeignore files and --exclude-from are removed.`,
+	Example: `securae ls-files ./app
+
+securae ls-files /var/www --exclude-from ~/www.ignore`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
+			return fmt.Errorf("Only one directory must be specified.")
+		}
+		return nil
+	},
+	GroupID: "backup",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		root := "."
+		if len(args) > 0 {
+			root = args[0]
+		}
+		excludeFrom, _ := cmd.Flags().GetStringArray(flagExcludeFrom)
+		matcher, err := newIgnoreMatcher(root, excludeFrom)
+		if err != nil {
+			return err
+		}
+		return matcher.walk(func(filename string, rel string, d fs.DirEntry) error {
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if archivable(info) {
+				cmd.Println(rel)
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lsFilesCmd)
+	lsFilesCmd.Flags().StringArray(flagExcludeFrom, nil, "Exclude the files matching the patterns of this file, in the .securaeignore format. It can be repeated.")
+}
+
+// newIgnoreMatcher reads the patterns of `excludeFrom` and of the
+// .securaeignore file at the root of the directory.
+func newIgnoreMatcher(root string, excludeFrom []string) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{root: root}
+	for _, filename := range excludeFrom {
+		if err := m.load(filename, "", false); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.load(filepath.Join(root, ignoreFilename), "", true); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load adds the patterns of an ignore file. Missing .securaeignore files are
+// skipped.
+func (m *ignoreMatcher) load(filename string, base string, optional bool) error {
+	file, err := os.Open(filename)
+	if optional && errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	patterns, err := parseIgnorePatterns(file, base)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	m.patterns = append(m.patterns, patterns...)
+	return nil
+}
+
+// ignored reports whether a path relative to the root is excluded.
+func (m *ignoreMatcher) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range m.patterns {
+		name := rel
+		if pattern.base != "" {
+			if !strings.HasPrefix(rel, pattern.base+"/") {
+				continue
+			}
+			name = strings.TrimPrefix(rel, pattern.base+"/")
+		}
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.regexp.MatchString(name) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+// walk calls `fn` for each file and directory under the root that is not
+// excluded, with its path relative to the root using forward slashes. The
+// directories are visited before their content.
+func (m *ignoreMatcher) walk(fn func(filename string, rel string, d fs.DirEntry) error) error {
+	return filepath.WalkDir(m.root, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filename == m.root {
+			return nil
+		}
+		rel, err := filepath.Rel(m.root, filename)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if m.ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if err := m.load(filepath.Join(filename, ignoreFilename), rel, true); err != nil {
+				return err
+			}
+		}
+		return fn(filename, rel, d)
+	})
+}
+
+// parseIgnorePatterns reads patterns in the gitignore format.
+func parseIgnorePatterns(r io.Reader, base string) ([]ignorePattern, error) {
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		// Trailing spaces are ignored, unless they are escaped.
+		for strings.HasSuffix(text, " ") && !strings.HasSuffix(text, "\\ ") {
+			text = text[:len(text)-1]
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pattern := ignorePattern{base: base}
+		if strings.HasPrefix(text, "!") {
+			pattern.negate = true
+			text = text[1:]
+		}
+		if strings.HasSuffix(text, "/") {
+			pattern.dirOnly = true
+			text = strings.TrimRight(text, "/")
+		}
+		// A pattern with a slash, other than a trailing one, is relative
+		// to the directory of its file. Otherwise it matches at any level.
+		anchored := strings.Contains(text, "/")
+		text = strings.TrimPrefix(text, "/")
+		if text == "" {
+			continue
+		}
+		expr, err := ignorePatternRegexp(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q", line, scanner.Text())
+		}
+		if !anchored {
+			expr = "(?:.*/)?" + expr
+		}
+		pattern.regexp, err = regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q", line, scanner.Text())
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+// ignorePatternRegexp converts a pattern to a regular expression: * and ?
+// don't match a slash, and ** matches any number of directories when it is a
+// whole path component.
+func ignorePatternRegexp(pattern string) (string, error) {
+	var expr strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**") && (i == 0 || pattern[i-1] == '/') && (i+2 == len(pattern) || pattern[i+2] == '/'):
+			switch {
+			case i+2 == len(pattern) && i == 0:
+				expr.WriteString(".*")
+			case i+2 == len(pattern):
+				// "a/**" matches everything inside a, but not a itself.
+				expr.WriteString(".+")
+			default:
+				// "**/" matches zero or more directories.
+				expr.WriteString("(?:.*/)?")
+				i += 2
+				continue
+			}
+			i++
+		case c == '*':
+			for i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+			}
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		case c == '[':
+			// A closing bracket right after the opening one is literal.
+			end := strings.IndexByte(pattern[min(i+2, len(pattern)):], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated character class")
+			}
+			end += min(i+2, len(pattern))
+			class := pattern[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i = end
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String(), nil
+}
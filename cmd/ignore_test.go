@@ -0,0 +1,131 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "app.log", false, true},
+		{"*.log", "var/log/app.log", false, true},
+		{"*.log", "app.log.1", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.txt", "doc/notes.txt", false, true},
+		{"doc/*.txt", "doc/api/notes.txt", false, false},
+		{"doc/*.txt", "src/doc/notes.txt", false, false},
+		{"tmp/", "tmp", true, true},
+		{"tmp/", "tmp", false, false},
+		{"tmp/", "src/tmp", true, true},
+		{"**/cache", "cache", true, true},
+		{"**/cache", "a/b/cache", true, true},
+		{"logs/**", "logs/a/b.log", false, true},
+		{"logs/**", "logs", true, false},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "a/xb", false, false},
+		{"file?.txt", "file1.txt", false, true},
+		{"file?.txt", "file/.txt", false, false},
+		{"file[0-9].txt", "file7.txt", false, true},
+		{"file[!0-9].txt", "file7.txt", false, false},
+		{"\\#notes", "#notes", false, true},
+		{"\\!important", "!important", false, true},
+		{"space\\ ", "space ", false, true},
+		{"# comment", "# comment", false, false},
+	}
+	for _, test := range tests {
+		patterns, err := parseIgnorePatterns(strings.NewReader(test.pattern+"\n"), "")
+		if err != nil {
+			t.Fatalf("%q: %v", test.pattern, err)
+		}
+		m := &ignoreMatcher{patterns: patterns}
+		if got := m.ignored(test.name, test.isDir); got != test.want {
+			t.Errorf("%q on %q (dir: %v) = %v, want %v", test.pattern, test.name, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestLsFiles(t *testing.T) {
+	viper.Reset()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "app")
+	files := map[string]string{
+		".securaeignore":        "*.log\n!keep.log\n/cache/\nnode_modules/\n",
+		"keep.log":              "",
+		"debug.log":             "",
+		"cache/data":            "",
+		"cache/keep.log":        "",
+		"src/main.go":           "",
+		"src/cache/data":        "",
+		"src/.securaeignore":    "*.tmp\n!/generated.go\n",
+		"src/generated.go":      "",
+		"src/build.tmp":         "",
+		"web/node_modules/x.js": "",
+		"web/app.js":            "",
+		"secrets/key.pem":       "",
+	}
+	for name, content := range files {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludeFile := filepath.Join(dir, "exclude")
+	os.WriteFile(excludeFile, []byte("secrets/\n"), 0600)
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer lsFilesCmd.Flags().Lookup(flagExcludeFrom).Value.(pflag.SliceValue).Replace(nil)
+	RootCmd.SetArgs([]string{"ls-files", root, "--exclude-from", excludeFile})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	want := ".securaeignore\nkeep.log\nsrc/.securaeignore\nsrc/cache/data\nsrc/generated.go\nsrc/main.go\nweb/app.js\n"
+	if actual.String() != want {
+		t.Errorf("Unexpected files:\n%s\nwant:\n%s", actual, want)
+	}
+}
+
+func TestLsFilesSkipsSockets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not files on Windows")
+	}
+	viper.Reset()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.go"), nil, 0600)
+	listener, err := net.Listen("unix", filepath.Join(root, "app.sock"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"ls-files", root})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if actual.String() != "main.go\n" {
+		t.Errorf("Only the files added to the snapshots should be listed, got:\n%s", actual)
+	}
+}
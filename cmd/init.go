@@ -4,84 +4,107 @@ Copyright 2024-2025 Securae Backup
 package cmd
 
 import (
+	"bufio"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"gopkg.in/yaml.v3"
 )
 
+const flagForce = "force"
+
 var initCmd = &cobra.Command{
-	Use:     "init [flags]",
-	Short:   "Initialize Securae's configuration",
-	Long:    `Validate your API token, generate an encryption key, and store all this information in a configuration file.`,
-	Example: `securae init --api-token xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx`,
+	Use:   "init [flags]",
+	Short: "Initialize Securae's configuration",
+	Long: `Validate your API token, generate an encryption key, and store all this information in a configuration file.
+
+An existing encryption key can be imported instead of generating a new one. The
+key is checked against the latest file of each backup in the account. Importing
+a key over a different one already configured requires --force.`,
+	Example: `securae init --api-token xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx
+
+# store the configuration in a named profile
+securae init --profile prod --api-token xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx
+
+# protect the new encryption key with a passphrase
+securae init --api-token xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx --keystore ~/.config/securae.key
+
+# use the encryption key of an existing installation
+securae init --api-token xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx --encryption-key-file /path/to/key`,
 	Args:    cobra.NoArgs,
 	GroupID: "setup",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("api.token", cmd.Flags().Lookup(flagApiToken))
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-
-		client := &http.Client{
-			Timeout: 5 * time.Second,
-		}
-
 		api := viper.GetString("api.url")
 		token := viper.GetString("api.token")
-		req, err := http.NewRequest("GET", api+"/users/me", nil)
-		if err != nil {
+		if err := verifyAPIToken(api, token); err != nil {
 			return err
 		}
-		req.Header.Set("Authorization", "Token "+token)
-		req.Header.Set("User-Agent", userAgent)
 
-		resp, err := client.Do(req)
+		// Only the settings managed by `init` are written, so values coming
+		// from environment variables (e.g. `SECURAE_BACKUP_ID`) are not
+		// saved. A `backup-id` stored by older versions is removed too.
+		configFileName := viper.ConfigFileUsed()
+		err := updateConfigFile(configFileName, func(content map[string]interface{}) error {
+			setConfigValue(content, profileConfigKey("api.url"), api)
+			setConfigValue(content, profileConfigKey("api.token"), token)
+			unsetConfigValue(content, flagBackupId)
+			return nil
+		})
 		if err != nil {
-			return errors.Join(err, fmt.Errorf("Please verify that %s is reachable from this device.", apiEndpoint))
-		} else {
-			defer resp.Body.Close()
+			return err
+		}
 
-			err = CheckCLIVersionHeaders(resp.Header, version)
-			if err != nil {
+		encryptionKeyB64Encoded, err := readImportedKey(cmd)
+		if err != nil {
+			return err
+		}
+		if encryptionKeyB64Encoded != "" {
+			if err := checkImportedKey(cmd, encryptionKeyB64Encoded); err != nil {
 				return err
 			}
-
-			if resp.StatusCode != http.StatusOK {
-				if resp.StatusCode == http.StatusUnauthorized {
-					return fmt.Errorf("There was an authentication issue, please check the API token in the configuration.")
-				} else {
-					return fmt.Errorf("The API service is unavailable. Please, try again in a few minutes.")
-				}
-			} else {
-				viper.WriteConfig()
+			if err := saveInitKey(cmd, encryptionKeyB64Encoded); err != nil {
+				return err
 			}
-
-			if viper.GetString("encryption-key-b64encoded") == "" {
+			fingerprint, _ := hashEncryptionKey(encryptionKeyB64Encoded)
+			cmd.Printf("The encryption key %s was imported.\n", fingerprint)
+		} else {
+			// A profile doesn't inherit the encryption key from the top level
+			// of the config file, each account gets its own key. Nothing is
+			// generated when the config already references a key elsewhere.
+			configuredKey := newKeyProvider(keySetting)
+			if configuredKey == nil {
 				key := make([]byte, 32)
 				_, err := rand.Read(key)
 				if err != nil {
 					return err
 				}
-				keyEncoded := base64.StdEncoding.EncodeToString(key)
-				viper.Set("encryption-key-b64encoded", keyEncoded)
-				viper.WriteConfig()
+				encryptionKeyB64Encoded = base64.StdEncoding.EncodeToString(key)
+				if err := saveInitKey(cmd, encryptionKeyB64Encoded); err != nil {
+					return err
+				}
 
 				cmd.Println("A new encryption key was generated:")
-				cmd.Println("\n" + keyEncoded + "\n")
+				cmd.Println("\n" + encryptionKeyB64Encoded + "\n")
 				cmd.Println("WARNING: Please save this encryption key in a safe place. You will need it to test your backups or to recover your files in case of disaster.")
+			} else if key, err := configuredKey.EncryptionKey(); err != nil {
+				cmd.Printf("WARNING: The encryption key from %s could not be checked against your backups: %s\n", configuredKey.Name(), err)
+			} else {
+				encryptionKeyB64Encoded = key
 			}
+		}
 
-			// Because using `AutomaticEnv()` the env var `SECURAE_BACKUP_ID` is
-			// saved to the config file but it's not needed so it must be removed.
-			configFileName := viper.ConfigFileUsed()
-			if err := removeYAMLKey(configFileName, flagBackupId); err != nil {
-				return err
-			}
+		if encryptionKeyB64Encoded != "" {
+			warnOnKeyMismatch(cmd, api, token, encryptionKeyB64Encoded)
 		}
 		return nil
 
@@ -91,32 +114,134 @@ var initCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(initCmd)
 	initCmd.Flags().StringP(flagApiToken, flagShortApiToken, "", "Your API token")
-	viper.BindPFlag("api.token", initCmd.Flags().Lookup(flagApiToken))
+	initCmd.Flags().String(flagKeystore, "", "Store the new encryption key in a passphrase-protected keystore file instead of the configuration file")
+	initCmd.Flags().String(flagEncryptionKeyFile, "", "Import an existing encryption key from this file instead of generating one")
+	initCmd.Flags().Bool(flagEncryptionKeyStdin, false, "Import an existing encryption key from the standard input instead of generating one")
+	initCmd.Flags().Bool(flagForce, false, "Replace a different encryption key already configured with the imported one")
+	initCmd.MarkFlagsMutuallyExclusive(flagEncryptionKeyFile, flagEncryptionKeyStdin)
 }
 
-func removeYAMLKey(filename string, key string) error {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return fmt.Errorf("error reading file: %w", err)
+// readImportedKey returns the key given with --encryption-key-file or
+// --encryption-key-stdin, or an empty string when none of them is used.
+func readImportedKey(cmd *cobra.Command) (string, error) {
+	var encryptionKeyB64Encoded string
+	if filename, _ := cmd.Flags().GetString(flagEncryptionKeyFile); filename != "" {
+		key, err := fileKeyProvider{filename: expandHome(filename)}.EncryptionKey()
+		if err != nil {
+			return "", err
+		}
+		encryptionKeyB64Encoded = key
+	} else if fromStdin, _ := cmd.Flags().GetBool(flagEncryptionKeyStdin); fromStdin {
+		line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("error reading encryption key: %w", err)
+		}
+		encryptionKeyB64Encoded = strings.TrimSpace(line)
+	} else {
+		return "", nil
+	}
+
+	if err := validateEncryptionKey(encryptionKeyB64Encoded); err != nil {
+		return "", err
 	}
+	return encryptionKeyB64Encoded, nil
+}
 
-	var yamlContent map[string]interface{}
-	if err := yaml.Unmarshal(data, &yamlContent); err != nil {
-		return fmt.Errorf("error parsing YAML: %w", err)
+// checkImportedKey refuses to replace a different key already configured,
+// the files uploaded with it could no longer be restored, unless --force is
+// used.
+func checkImportedKey(cmd *cobra.Command, encryptionKeyB64Encoded string) error {
+	if force, _ := cmd.Flags().GetBool(flagForce); force {
+		return nil
+	}
+	configuredKey := newKeyProvider(keySetting)
+	if configuredKey == nil {
+		return nil
 	}
+	key, err := configuredKey.EncryptionKey()
+	if err != nil {
+		return errors.Join(err, fmt.Errorf("The encryption key from %s could not be compared with the imported one, use --force to replace it.", configuredKey.Name()))
+	}
+	configured, _ := hashEncryptionKey(key)
+	imported, _ := hashEncryptionKey(encryptionKeyB64Encoded)
+	if configured != imported {
+		return fmt.Errorf("The encryption key %s from %s is already configured, use --force to replace it with %s.", configured, configuredKey.Name(), imported)
+	}
+	return nil
+}
 
-	if _, exists := yamlContent[key]; exists {
-		delete(yamlContent, key)
-	} else {
+// saveInitKey stores the key in the keystore given with --keystore, or in
+// the config file.
+func saveInitKey(cmd *cobra.Command, encryptionKeyB64Encoded string) error {
+	if keystoreFilename, _ := cmd.Flags().GetString(flagKeystore); keystoreFilename != "" {
+		return storeKeyInKeystore(keystoreFilename, encryptionKeyB64Encoded)
+	}
+	viper.Set("encryption-key-b64encoded", encryptionKeyB64Encoded)
+	return updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+		setConfigValue(content, profileConfigKey("encryption-key-b64encoded"), encryptionKeyB64Encoded)
 		return nil
+	})
+}
+
+// warnOnKeyMismatch checks the key against the latest file of each backup in
+// the account, using the metadata endpoint, so a wrong key is noticed now
+// instead of when restoring.
+func warnOnKeyMismatch(cmd *cobra.Command, api string, token string, encryptionKeyB64Encoded string) {
+	backups, err := fetchBackups(fmt.Sprintf("%s/backups", api), token)
+	if err != nil {
+		cmd.Printf("WARNING: The encryption key could not be checked against your backups: %s\n", err)
+		return
+	}
+
+	for _, backup := range backups {
+		if len(backup.Backupobjects) == 0 {
+			continue
+		}
+		metadataURL := fmt.Sprintf("%s/backups/%s/metadata/", api, backup.Id)
+		presignedURL, err := fetchPresignedURL(metadataURL, token, []byte(`{"include_checksum": true}`))
+		if err != nil {
+			cmd.Printf("WARNING: The encryption key could not be checked against backup %s: %s\n", backup.Name, err)
+			continue
+		}
+		if _, err := fetchChecksum(presignedURL, encryptionKeyB64Encoded); err != nil {
+			if strings.Contains(err.Error(), "does not match") {
+				cmd.Printf("WARNING: The encryption key doesn't match the one used to upload the latest file of backup %s (%s).\n", backup.Name, backup.Id)
+			} else {
+				cmd.Printf("WARNING: The encryption key could not be checked against backup %s: %s\n", backup.Name, err)
+			}
+		}
+	}
+}
+
+// verifyAPIToken checks that the API is reachable and accepts the token.
+func verifyAPIToken(api string, token string) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
 	}
-	updatedData, err := yaml.Marshal(yamlContent)
+
+	req, err := http.NewRequest("GET", api+"/users/me", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error encoding updated YAML: %w", err)
+		return errors.Join(err, fmt.Errorf("Please verify that %s is reachable from this device.", api))
 	}
+	defer resp.Body.Close()
 
-	if err := os.WriteFile(filename, updatedData, 0644); err != nil {
-		return fmt.Errorf("error writing updated file: %w", err)
+	err = CheckCLIVersionHeaders(resp.Header, version)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("There was an authentication issue, please check the API token in the configuration.")
+		}
+		return fmt.Errorf("The API service is unavailable. Please, try again in a few minutes.")
 	}
 	return nil
 }
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 
@@ -99,3 +100,90 @@ func TestInitCmdDontOverrideEncryptionKey(t *testing.T) {
 	}
 	defer os.Remove(f.Name())
 }
+
+func TestInitCmdImportsKeyAndWarnsOnMismatch(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql.gz", []byte("dump"), testKeyringKey)
+
+	viper.Reset()
+	viper.Set("api.url", storage.URL)
+	configFile := t.TempDir() + "/config.yaml"
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetIn(bytes.NewBufferString(testEncryptionKey + "\n"))
+	defer RootCmd.SetIn(nil)
+	defer initCmd.Flags().Set(flagEncryptionKeyStdin, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "init", "-t", "xxxxx", "--encryption-key-stdin"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(content, []byte(testEncryptionKey)) {
+		t.Errorf("The imported key should be stored in the config file:\n%s", content)
+	}
+	if !bytes.Contains(actual.Bytes(), []byte("WARNING: The encryption key doesn't match")) {
+		t.Errorf("A warning should be printed when the key doesn't match the backup:\n%s", actual)
+	}
+}
+
+func TestInitCmdRefusesToReplaceKey(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	configFile := storage.writeConfig(t, testKeyConfig)
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer RootCmd.SetIn(nil)
+	defer initCmd.Flags().Set(flagEncryptionKeyStdin, "false")
+	RootCmd.SetIn(bytes.NewBufferString(testKeyringKey + "\n"))
+	RootCmd.SetArgs([]string{"--config", configFile, "init", "-t", "xxxxx", "--encryption-key-stdin"})
+	if err := RootCmd.Execute(); err == nil {
+		t.Fatalf("A different configured key should not be replaced:\n%s", actual)
+	}
+	content, _ := os.ReadFile(configFile)
+	if !bytes.Contains(content, []byte(testEncryptionKey)) {
+		t.Errorf("The configured key should be kept:\n%s", content)
+	}
+
+	defer initCmd.Flags().Set(flagForce, "false")
+	RootCmd.SetIn(bytes.NewBufferString(testKeyringKey + "\n"))
+	RootCmd.SetArgs([]string{"--config", configFile, "init", "-t", "xxxxx", "--encryption-key-stdin", "--force"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	content, _ = os.ReadFile(configFile)
+	if !bytes.Contains(content, []byte(testKeyringKey)) {
+		t.Errorf("The key should be replaced with --force:\n%s", content)
+	}
+}
+
+func TestInitCmdWarnsOnMismatchWithKeyFile(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql.gz", []byte("dump"), testKeyringKey)
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(testEncryptionKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := storage.writeConfig(t, "encryption-key-file: "+keyFile+"\n")
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "init", "-t", "xxxxx"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !bytes.Contains(actual.Bytes(), []byte("WARNING: The encryption key doesn't match")) {
+		t.Errorf("The key from the file should be checked against the backup:\n%s", actual)
+	}
+}
@@ -0,0 +1,493 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// A backupJob is an upload declared in the `jobs` section of the
+// configuration file, and run with `securae run`. Its source is a file, the
+// files matching a glob pattern, or the standard output of a command.
+type backupJob struct {
+	Path          string   `mapstructure:"path"`
+	Glob          string   `mapstructure:"glob"`
+	Command       string   `mapstructure:"command"`
+	BackupId      string   `mapstructure:"backup-id"`
+	Name          string   `mapstructure:"name"`
+	Compress      string   `mapstructure:"compress"`
+	CompressLevel int      `mapstructure:"compress-level"`
+	KeepLast      int      `mapstructure:"keep-last"`
+	Hooks         jobHooks `mapstructure:"hooks"`
+}
+
+// The hooks are shell commands run before and after the upload. The after
+// hook is always run once the before hook succeeded, with SECURAE_JOB_STATUS
+// set to success or failure.
+type jobHooks struct {
+	Before string `mapstructure:"before"`
+	After  string `mapstructure:"after"`
+}
+
+// jobNameData holds the fields available in the name templates.
+type jobNameData struct {
+	Job       string
+	Name      string
+	Hostname  string
+	Date      string
+	Time      string
+	Timestamp string
+}
+
+type jobResult struct {
+	Job      string
+	Files    int
+	Size     int64
+	Duration time.Duration
+	// Names of the files of the job beyond its keep-last retention.
+	Expired []string
+	Err     error
+}
+
+var runCmd = &cobra.Command{
+	Use:   "run [job...] [flags]",
+	Short: "Run the backup jobs of the configuration file",
+	Long: `Run the backup jobs declared in the jobs section of the configuration file,
+and show a summary of their results.
+
+Each job uploads a file (path), the files matching a pattern (glob), or the
+standard output of a command (command), under a name built from a template,
+such as db-{{.Date}}.sql.gz. The template fields are .Job, .Name (the name of
+the file, or of the job for a command), .Hostname, .Date (2006-01-02), .Time
+(150405) and .Timestamp (20060102T150405Z), in UTC.
+
+A job can also set backup-id, compress, compress-level, keep-last and the
+hooks.before and hooks.after shell commands. The after hook runs even when
+the upload failed, with SECURAE_JOB_STATUS set to success or failure.
+
+With keep-last, the files of the backup matching the name template of the
+job, except the most recent ones, are listed after the summary. For a glob
+pattern, the most recent ones of each file are kept. securae doesn't delete
+them, as the API has no endpoint to delete files: they must be deleted from
+the web UI.`,
+	Example: `# in securae.yaml
+jobs:
+  database:
+    command: pg_dump app
+    name: db-{{.Date}}.sql.gz
+    compress: gzip
+    keep-last: 14
+    hooks:
+      after: curl -fsS https://hc-ping.com/xxxx
+  logs:
+    glob: /var/log/nginx/*.log
+    name: "{{.Hostname}}-{{.Date}}-{{.Name}}"
+    compress: zstd
+
+# run one job
+securae run database
+
+# run all the jobs
+securae run --all`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool(flagAll)
+		if all && len(args) > 0 {
+			return fmt.Errorf("Either job names or --all must be specified, not both.")
+		}
+		if !all && len(args) == 0 {
+			return fmt.Errorf("A job name or --all must be specified.")
+		}
+		return nil
+	},
+	GroupID: "backup",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(flagBackupId, cmd.Flags().Lookup(flagBackupId))
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobs, err := getJobs()
+		if err != nil {
+			return err
+		}
+		names := args
+		if all, _ := cmd.Flags().GetBool(flagAll); all {
+			if len(jobs) == 0 {
+				return fmt.Errorf("There are no jobs in %s.", viper.ConfigFileUsed())
+			}
+			names = nil
+			for name := range jobs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			if _, ok := jobs[name]; !ok {
+				return fmt.Errorf("Job %s not found in %s.", name, viper.ConfigFileUsed())
+			}
+		}
+
+		var results []jobResult
+		for _, name := range names {
+			cmd.Printf("Running job %s...\n", name)
+			results = append(results, runJob(cmd, name, jobs[name]))
+		}
+		cmd.Println()
+		showJobResults(cmd, results)
+
+		failed := 0
+		for _, result := range results {
+			if result.Err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d jobs failed.", failed, len(results))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(runCmd)
+	runCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) for the jobs without backup-id. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+	runCmd.Flags().Bool(flagAll, false, "Run all the jobs, in the order of their names")
+}
+
+func getJobs() (map[string]backupJob, error) {
+	var jobs map[string]backupJob
+	if err := viper.UnmarshalKey("jobs", &jobs); err != nil {
+		return nil, fmt.Errorf("error parsing the jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// validate checks the settings of the job, and returns its name template.
+func (job backupJob) validate() (*template.Template, error) {
+	sources := 0
+	for _, source := range []string{job.Path, job.Glob, job.Command} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("exactly one of path, glob and command must be set")
+	}
+	if job.Command != "" && job.Name == "" {
+		return nil, fmt.Errorf("name must be set for a command")
+	}
+	if job.BackupId != "" && !IsUUID(job.BackupId) {
+		return nil, fmt.Errorf("invalid backup-id format")
+	}
+	if err := validateCompression(job.Compress); err != nil {
+		return nil, err
+	}
+	if job.KeepLast < 0 {
+		return nil, fmt.Errorf("keep-last can't be negative")
+	}
+	name := job.Name
+	if name == "" {
+		name = "{{.Name}}"
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// runJob runs the hooks of the job and uploads its files. Errors are
+// reported in the result, so the other jobs are still run.
+func runJob(cmd *cobra.Command, name string, job backupJob) jobResult {
+	start := time.Now()
+	result := jobResult{Job: name}
+	result.Err = runJobUploads(cmd, name, job, &result)
+	result.Duration = time.Since(start)
+	if result.Err != nil {
+		cmd.Printf("[%s] Error: %s\n", name, result.Err)
+	}
+	return result
+}
+
+func runJobUploads(cmd *cobra.Command, name string, job backupJob, result *jobResult) (err error) {
+	tmpl, err := job.validate()
+	if err != nil {
+		return fmt.Errorf("invalid job: %w", err)
+	}
+	apiURL := viper.GetString("api.url")
+	apiToken := viper.GetString("api.token")
+	backupId := job.BackupId
+	if backupId == "" {
+		if backupId, err = getBackupId(); err != nil {
+			return err
+		}
+	}
+
+	if job.Hooks.Before != "" {
+		cmd.Printf("[%s] Running before hook... ", name)
+		if err := runJobHook(cmd, name, job.Hooks.Before, ""); err != nil {
+			cmd.Printf("Error\n")
+			return fmt.Errorf("before hook: %w", err)
+		}
+		cmd.Printf("OK\n")
+	}
+	if job.Hooks.After != "" {
+		defer func() {
+			status := "success"
+			if err != nil {
+				status = "failure"
+			}
+			cmd.Printf("[%s] Running after hook... ", name)
+			if hookErr := runJobHook(cmd, name, job.Hooks.After, status); hookErr != nil {
+				cmd.Printf("Error\n")
+				if err == nil {
+					err = fmt.Errorf("after hook: %w", hookErr)
+				}
+				return
+			}
+			cmd.Printf("OK\n")
+		}()
+	}
+
+	// The compression of the job replaces the one of the configuration
+	// during its uploads.
+	if job.Compress != "" {
+		defer viper.Set(flagCompress, viper.Get(flagCompress))
+		defer viper.Set(flagCompressLevel, viper.Get(flagCompressLevel))
+		viper.Set(flagCompress, job.Compress)
+		viper.Set(flagCompressLevel, job.CompressLevel)
+	}
+
+	filenames, err := jobSourceFiles(cmd, name, job)
+	if err != nil {
+		return err
+	}
+	if job.Command != "" {
+		defer os.Remove(filenames[0])
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
+	data := jobNameData{
+		Job:       name,
+		Hostname:  hostname,
+		Date:      now.Format("2006-01-02"),
+		Time:      now.Format("150405"),
+		Timestamp: now.Format("20060102T150405Z"),
+	}
+	remoteNames := make([]string, len(filenames))
+	seen := make(map[string]bool)
+	for i, filename := range filenames {
+		data.Name = filepath.Base(filename)
+		if job.Command != "" {
+			data.Name = name
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return fmt.Errorf("invalid name template: %w", err)
+		}
+		remoteNames[i] = filepath.Base(buf.String())
+		if seen[remoteNames[i]] {
+			return fmt.Errorf("several files are named %s, use {{.Name}} in the name template", remoteNames[i])
+		}
+		seen[remoteNames[i]] = true
+	}
+
+	var encryptionKeyB64Encoded string
+	if !ageEncryption() {
+		encryptionKeyB64Encoded, err = getUploadEncryptionKey(backupId)
+		if err != nil {
+			return err
+		}
+	}
+	for i, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if err := uploadWithRetries(cmd, apiURL, apiToken, backupId, encryptionKeyB64Encoded, filename, remoteNames[i]); err != nil {
+			return err
+		}
+		result.Files++
+		result.Size += info.Size()
+	}
+
+	if job.KeepLast > 0 {
+		backup, err := fetchBackupData(fmt.Sprintf("%s/backups/%s", apiURL, backupId), apiToken)
+		if err != nil {
+			return err
+		}
+		revealFilenames([]Backup{backup})
+		result.Expired = expiredJobFiles(backup, tmpl, data, job.Glob != "", job.KeepLast)
+	}
+	return nil
+}
+
+// jobSourceFiles returns the files to upload. The output of a command is
+// saved to a temporary file first, as the upload needs its size and checksum.
+func jobSourceFiles(cmd *cobra.Command, name string, job backupJob) ([]string, error) {
+	switch {
+	case job.Path != "":
+		return []string{expandHome(job.Path)}, nil
+	case job.Glob != "":
+		filenames, err := filepath.Glob(expandHome(job.Glob))
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %q", job.Glob)
+		}
+		if len(filenames) == 0 {
+			return nil, fmt.Errorf("no files match %s", job.Glob)
+		}
+		return filenames, nil
+	}
+
+	cmd.Printf("[%s] Running command... ", name)
+	output, err := createTempFile()
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+	command := shellCommand(job.Command)
+	command.Stdout = output
+	command.Stderr = cmd.ErrOrStderr()
+	command.Env = append(os.Environ(), "SECURAE_JOB="+name)
+	if err := command.Run(); err != nil {
+		cmd.Printf("Error\n")
+		os.Remove(output.Name())
+		return nil, fmt.Errorf("command: %w", err)
+	}
+	info, err := output.Stat()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Printf("OK (%s)\n", humanize.Bytes(uint64(info.Size())))
+	return []string{output.Name()}, nil
+}
+
+func runJobHook(cmd *cobra.Command, name string, hook string, status string) error {
+	command := shellCommand(hook)
+	command.Stdout = cmd.OutOrStdout()
+	command.Stderr = cmd.ErrOrStderr()
+	command.Env = append(os.Environ(), "SECURAE_JOB="+name)
+	if status != "" {
+		command.Env = append(command.Env, "SECURAE_JOB_STATUS="+status)
+	}
+	return command.Run()
+}
+
+// expiredJobFiles returns the files of the backup named by the job, except
+// the `keepLast` most recent ones. The date and time fields of the name
+// template match any date and time in their format. For a glob pattern, the
+// name of the file matches anything, and the files are kept for each name.
+func expiredJobFiles(backup Backup, tmpl *template.Template, data jobNameData, anyName bool, keepLast int) []string {
+	// Each field is replaced by a placeholder, then by its regular
+	// expression once the rest of the name is quoted. The name of the file
+	// is the only capturing group.
+	fields := map[string]string{
+		"\x00": `\d{4}-\d{2}-\d{2}`,
+		"\x01": `\d{6}`,
+		"\x02": `\d{8}T\d{6}Z`,
+	}
+	data.Date, data.Time, data.Timestamp = "\x00", "\x01", "\x02"
+	if anyName {
+		fields["\x03"] = `(.+)`
+		data.Name = "\x03"
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil
+	}
+	pattern := regexp.QuoteMeta(filepath.Base(buf.String()))
+	for placeholder, field := range fields {
+		pattern = strings.ReplaceAll(pattern, placeholder, field)
+	}
+	re, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		return nil
+	}
+
+	type jobFile struct {
+		name      string
+		createdAt string
+	}
+	var names []string
+	files := make(map[string][]jobFile)
+	for _, bo := range backup.Backupobjects {
+		match := re.FindStringSubmatch(bo.Name)
+		if match == nil {
+			continue
+		}
+		// The name of the file may appear several times in the template.
+		name := strings.Join(match[1:], "/")
+		if _, ok := files[name]; !ok {
+			names = append(names, name)
+		}
+		files[name] = append(files[name], jobFile{bo.Name, bo.CreatedAt})
+	}
+	var expired []string
+	for _, name := range names {
+		group := files[name]
+		if len(group) <= keepLast {
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			ti, _ := time.Parse(time.RFC3339Nano, group[i].createdAt)
+			tj, _ := time.Parse(time.RFC3339Nano, group[j].createdAt)
+			return ti.After(tj)
+		})
+		for _, file := range group[keepLast:] {
+			expired = append(expired, file.name)
+		}
+	}
+	return expired
+}
+
+func showJobResults(cmd *cobra.Command, results []jobResult) {
+	textOK := color.New(color.Bold, color.FgGreen).SprintFunc()
+	textFailed := color.New(color.Bold, color.FgRed).SprintFunc()
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "JOB\tSTATUS\tFILES\tSIZE\tDURATION\tDETAILS\n")
+	for _, result := range results {
+		status := textOK("OK")
+		detail := ""
+		if result.Err != nil {
+			status = textFailed("FAILED")
+			detail = result.Err.Error()
+		} else if len(result.Expired) > 0 {
+			detail = fmt.Sprintf("%d files beyond keep-last, not deleted", len(result.Expired))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", result.Job, status, result.Files, humanize.Bytes(uint64(result.Size)), result.Duration.Round(time.Second), detail)
+	}
+	w.Flush()
+
+	for _, result := range results {
+		if len(result.Expired) > 0 {
+			cmd.Printf("\nFiles of job %s beyond keep-last, to delete from the web UI (the API can't delete files):\n", result.Job)
+			for _, name := range result.Expired {
+				cmd.Printf("- %s\n", name)
+			}
+		}
+	}
+}
+
+// shellCommand returns a command running `command` with the shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
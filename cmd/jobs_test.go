@@ -0,0 +1,140 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestRunJobs(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db-2024-01-01.sql", []byte("old dump"), testEncryptionKey)
+	storage.put("db-2024-01-02.sql", []byte("old dump"), testEncryptionKey)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "access.log"), []byte("GET /"), 0600)
+	os.WriteFile(filepath.Join(dir, "error.log"), []byte("error"), 0600)
+	hookFile := filepath.Join(dir, "hook")
+	configFile := storage.writeConfig(t, testKeyConfig+"backup-id: "+testBackupId+`
+jobs:
+  database:
+    command: printf 'dump of $SECURAE_JOB'
+    name: db-{{.Date}}.sql
+    compress: gzip
+    keep-last: 2
+    hooks:
+      before: echo before > `+hookFile+`
+      after: echo $SECURAE_JOB_STATUS >> `+hookFile+`
+  logs:
+    glob: `+filepath.Join(dir, "*.log")+`
+    name: "{{.Job}}-{{.Name}}"
+  missing:
+    path: `+filepath.Join(dir, "missing.tar")+`
+`)
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer runCmd.Flags().Set(flagAll, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "run", "--all"})
+	err := RootCmd.Execute()
+	if err == nil || err.Error() != "1 of 3 jobs failed." {
+		t.Fatalf("The missing file should fail its job, got %v\n%s", err, actual)
+	}
+
+	dump := storage.get("db-" + time.Now().UTC().Format("2006-01-02") + ".sql")
+	if dump == nil {
+		t.Fatalf("The output of the command should be uploaded:\n%s", actual)
+	}
+	if dump.Metadata.Get(metadataCompression) != "gzip" {
+		t.Errorf("The output of the command should be compressed")
+	}
+	for _, name := range []string{"logs-access.log", "logs-error.log"} {
+		if storage.get(name) == nil {
+			t.Errorf("%s should be uploaded", name)
+		}
+	}
+	if hooks, _ := os.ReadFile(hookFile); string(hooks) != "before\nsuccess\n" {
+		t.Errorf("The hooks should be run around the upload, got %q", hooks)
+	}
+	if viper.GetString(flagCompress) != "" {
+		t.Errorf("The compression of a job should not be used after it")
+	}
+
+	for _, expected := range []string{"database  OK      1", "logs      OK      2", "missing   FAILED  0", "- db-2024-01-01.sql\n"} {
+		if !strings.Contains(actual.String(), expected) {
+			t.Errorf("The summary should contain %q:\n%s", expected, actual)
+		}
+	}
+	if strings.Contains(actual.String(), "- db-2024-01-02.sql") {
+		t.Errorf("The files within keep-last should not be listed:\n%s", actual)
+	}
+}
+
+func TestJobValidate(t *testing.T) {
+	tests := []struct {
+		job   backupJob
+		valid bool
+	}{
+		{backupJob{Path: "/etc/hosts"}, true},
+		{backupJob{Glob: "/var/log/*.log", Name: "{{.Hostname}}-{{.Name}}"}, true},
+		{backupJob{Command: "pg_dump app"}, false},
+		{backupJob{Path: "/etc/hosts", Glob: "/etc/*"}, false},
+		{backupJob{}, false},
+		{backupJob{Path: "/etc/hosts", Name: "{{.Date"}, false},
+		{backupJob{Path: "/etc/hosts", Compress: "brotli"}, false},
+		{backupJob{Path: "/etc/hosts", BackupId: "backup"}, false},
+	}
+	for _, test := range tests {
+		if _, err := test.job.validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, valid: %v", test.job, err, test.valid)
+		}
+	}
+}
+
+func TestExpiredJobFiles(t *testing.T) {
+	names := []string{
+		"db-2024-01-01.sql", "db-2024-01-02.sql", "db-2024-01-03.sql", "db-manual.sql",
+		"logs-2024-01-01-access.log", "logs-2024-01-01-error.log",
+		"logs-2024-01-02-access.log", "logs-2024-01-02-error.log",
+	}
+	var objects []map[string]string
+	for i, name := range names {
+		createdAt := time.Date(2024, 1, 1, 0, i, 0, 0, time.UTC).Format(time.RFC3339Nano)
+		objects = append(objects, map[string]string{"name": name, "created_at": createdAt})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"backupobjects": objects})
+	var backup Backup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		job      backupJob
+		expected []string
+	}{
+		{backupJob{Command: "pg_dump app", Name: "db-{{.Date}}.sql"}, []string{"db-2024-01-02.sql", "db-2024-01-01.sql"}},
+		{backupJob{Glob: "/var/log/*.log", Name: "{{.Job}}-{{.Date}}-{{.Name}}"}, []string{"logs-2024-01-01-access.log", "logs-2024-01-01-error.log"}},
+	}
+	for _, test := range tests {
+		tmpl, err := test.job.validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired := expiredJobFiles(backup, tmpl, jobNameData{Job: "logs"}, test.job.Glob != "", 1)
+		if !reflect.DeepEqual(expired, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.job.Name, test.expected, expired)
+		}
+	}
+}
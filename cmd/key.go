@@ -0,0 +1,84 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const flagKeystore = "keystore"
+
+var keyCmd = &cobra.Command{
+	Use:     "key",
+	Short:   "Manage the encryption key",
+	Args:    cobra.NoArgs,
+	GroupID: "setup",
+}
+
+var keyProtectCmd = &cobra.Command{
+	Use:   "protect [flags]",
+	Short: "Move the encryption key into a passphrase-protected keystore",
+	Long: `Move the encryption key into a keystore file protected by a passphrase, and
+replace it in the configuration file with a reference to the keystore.
+
+The passphrase is asked interactively, or read from the environment variable
+SECURAE_KEYSTORE_PASSPHRASE.`,
+	Example: `securae key protect --keystore ~/.config/securae.key`,
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename, _ := cmd.Flags().GetString(flagKeystore)
+
+		encryptionKeyB64Encoded, err := getEncryptionKey()
+		if err != nil {
+			return err
+		}
+		if err := validateEncryptionKey(encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+
+		if err := storeKeyInKeystore(filename, encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+		cmd.Printf("The encryption key was moved to %s.\n", filename)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(keyCmd)
+	keyCmd.AddCommand(keyProtectCmd)
+	keyProtectCmd.Flags().String(flagKeystore, "", "Path of the keystore file to create")
+	keyProtectCmd.MarkFlagRequired(flagKeystore)
+}
+
+// storeKeyInKeystore writes the key into a new keystore and makes the config
+// file point to it instead of holding the key itself.
+func storeKeyInKeystore(filename string, encryptionKeyB64Encoded string) error {
+	filename, err := filepath.Abs(expandHome(filename))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("The keystore %s already exists.", filename)
+	}
+
+	passphrase, err := readPassphrase(fmt.Sprintf("New passphrase for %s: ", filename), true)
+	if err != nil {
+		return err
+	}
+	if err := writeKeystore(filename, encryptionKeyB64Encoded, passphrase); err != nil {
+		return err
+	}
+
+	return updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+		setConfigValue(content, profileConfigKey("encryption-key-keystore"), filename)
+		unsetConfigValue(content, profileConfigKey("encryption-key-b64encoded"))
+		return nil
+	})
+}
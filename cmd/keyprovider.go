@@ -0,0 +1,189 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const flagEncryptionKeyFd = "encryption-key-fd"
+const flagEncryptionKeyFile = "encryption-key-file"
+const flagEncryptionKeyStdin = "encryption-key-stdin"
+
+// A keyProvider returns the base64 encoded encryption key from wherever it
+// is stored, so the config file only needs a reference to it.
+type keyProvider interface {
+	// Name describes where the key comes from, to be shown to the user.
+	Name() string
+	EncryptionKey() (string, error)
+}
+
+var encryptionKeyFd int
+
+// fdKeyProvider reads the key from an already open file descriptor, e.g.
+// `securae upload --encryption-key-fd 3 3< <(pass show securae)`.
+type fdKeyProvider struct {
+	fd int
+}
+
+// A file descriptor can only be read once, the key is kept for the lifetime
+// of the command.
+var fdEncryptionKey string
+
+func (p fdKeyProvider) Name() string {
+	return fmt.Sprintf("file descriptor %d", p.fd)
+}
+
+func (p fdKeyProvider) EncryptionKey() (string, error) {
+	if fdEncryptionKey != "" {
+		return fdEncryptionKey, nil
+	}
+	file := os.NewFile(uintptr(p.fd), p.Name())
+	if file == nil {
+		return "", fmt.Errorf("Invalid file descriptor %d.", p.fd)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("error reading encryption key from %s: %w", p.Name(), err)
+	}
+	fdEncryptionKey = strings.TrimSpace(string(data))
+	return fdEncryptionKey, nil
+}
+
+type inlineKeyProvider struct {
+	key string
+}
+
+func (p inlineKeyProvider) Name() string {
+	return "`encryption-key-b64encoded`"
+}
+
+func (p inlineKeyProvider) EncryptionKey() (string, error) {
+	return p.key, nil
+}
+
+type fileKeyProvider struct {
+	filename string
+}
+
+func (p fileKeyProvider) Name() string {
+	return fmt.Sprintf("key file %s", p.filename)
+}
+
+func (p fileKeyProvider) EncryptionKey() (string, error) {
+	data, err := os.ReadFile(p.filename)
+	if err != nil {
+		return "", fmt.Errorf("error reading encryption key: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// commandKeyProvider runs a command and uses its standard output as the key,
+// in the same way as git's credential helpers.
+type commandKeyProvider struct {
+	command string
+}
+
+func (p commandKeyProvider) Name() string {
+	return fmt.Sprintf("key command %q", p.command)
+}
+
+func (p commandKeyProvider) EncryptionKey() (string, error) {
+	cmd := shellCommand(p.command)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running %s: %w", p.Name(), err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// newKeyProvider returns the provider configured through `get`, checking in
+// order: --encryption-key-fd, `encryption-key-b64encoded`,
+// `encryption-key-keystore`, `encryption-key-file`, `encryption-key-command`
+// and `vault`. It returns nil when no key is configured.
+func newKeyProvider(get func(key string) string) keyProvider {
+	if encryptionKeyFd >= 0 {
+		return fdKeyProvider{fd: encryptionKeyFd}
+	}
+	if key := get("encryption-key-b64encoded"); key != "" {
+		return inlineKeyProvider{key: key}
+	}
+	if filename := get("encryption-key-keystore"); filename != "" {
+		return keystoreKeyProvider{filename: expandHome(filename)}
+	}
+	if filename := get("encryption-key-file"); filename != "" {
+		return fileKeyProvider{filename: expandHome(filename)}
+	}
+	if command := get("encryption-key-command"); command != "" {
+		return commandKeyProvider{command: command}
+	}
+	if get("vault.kv-path") != "" || get("vault.transit-key") != "" {
+		return newVaultKeyProvider(get)
+	}
+	return nil
+}
+
+func expandHome(filename string) string {
+	if filename == "~" || strings.HasPrefix(filename, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home + filename[1:]
+		}
+	}
+	return filename
+}
+
+// keySetting returns a setting of the encryption key. When a profile is in
+// use, only the settings of the profile are used: it doesn't inherit the key
+// from the top level of the config file, which would otherwise take
+// precedence over a keystore, key file, command or Vault set in the profile.
+// Environment variables still take precedence.
+func keySetting(key string) string {
+	profile := currentProfile()
+	if profile == "" {
+		return viper.GetString(key)
+	}
+	env := "SECURAE_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+	if value, ok := os.LookupEnv(env); ok {
+		return value
+	}
+	return viper.GetString("profiles." + profile + "." + key)
+}
+
+// The key read by getEncryptionKey is kept for the lifetime of the command,
+// as reading it again may prompt for a passphrase, run the key command or
+// call Vault. It is reset by initConfig.
+var cachedEncryptionKey struct {
+	provider string
+	key      string
+}
+
+func getEncryptionKey() (string, error) {
+	provider := newKeyProvider(keySetting)
+	if provider == nil {
+		return "", fmt.Errorf("An encryption key is mandatory.")
+	}
+	if _, inline := provider.(inlineKeyProvider); !inline && cachedEncryptionKey.provider == provider.Name() {
+		return cachedEncryptionKey.key, nil
+	}
+	encryptionKeyB64Encoded, err := provider.EncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	if encryptionKeyB64Encoded == "" {
+		return "", fmt.Errorf("The encryption key from %s is empty.", provider.Name())
+	}
+	cachedEncryptionKey.provider, cachedEncryptionKey.key = provider.Name(), encryptionKeyB64Encoded
+	return encryptionKeyB64Encoded, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const testEncryptionKey = "nMncUq8SsU7uz3cMucmFmgvUGXZ8LiBm8qx93hzrh6k="
+
+func TestNewKeyProviderOrder(t *testing.T) {
+	settings := map[string]string{
+		"encryption-key-file":    "/path/to/key",
+		"encryption-key-command": "pass show securae",
+	}
+	get := func(key string) string { return settings[key] }
+
+	if _, ok := newKeyProvider(get).(fileKeyProvider); !ok {
+		t.Errorf("The key file should take precedence over the key command")
+	}
+
+	settings["encryption-key-b64encoded"] = testEncryptionKey
+	if _, ok := newKeyProvider(get).(inlineKeyProvider); !ok {
+		t.Errorf("An inline key should take precedence over any reference")
+	}
+
+	if newKeyProvider(func(key string) string { return "" }) != nil {
+		t.Errorf("No provider should be returned when nothing is configured")
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	keyFile := t.TempDir() + "/key"
+	if err := os.WriteFile(keyFile, []byte(testEncryptionKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := fileKeyProvider{filename: keyFile}.EncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testEncryptionKey {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", key, testEncryptionKey)
+	}
+}
+
+func TestCommandKeyProvider(t *testing.T) {
+	key, err := commandKeyProvider{command: "echo " + testEncryptionKey}.EncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testEncryptionKey {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", key, testEncryptionKey)
+	}
+
+	if _, err := (commandKeyProvider{command: "exit 1"}).EncryptionKey(); err == nil {
+		t.Errorf("A failing command should return an error")
+	}
+}
+
+// Mock Vault server with a KV v2 secret and a transit key
+func mockVaultServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/securae":
+			w.Write([]byte(`{"data": {"data": {"key": "` + testEncryptionKey + `"}, "metadata": {}}}`))
+		case "/v1/transit/decrypt/securae":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["ciphertext"] != "vault:v1:wrapped" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"data": {"plaintext": "` + testEncryptionKey + `"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVaultKeyProvider(t *testing.T) {
+	server := mockVaultServer()
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		settings  map[string]string
+		expectErr bool
+	}{
+		{"KV v2", map[string]string{"vault.kv-path": "secret/data/securae"}, false},
+		{"Transit", map[string]string{"vault.transit-key": "securae", "vault.ciphertext": "vault:v1:wrapped"}, false},
+		{"Missing secret", map[string]string{"vault.kv-path": "secret/data/missing"}, true},
+		{"Wrong field", map[string]string{"vault.kv-path": "secret/data/securae", "vault.kv-field": "other"}, true},
+		{"Wrong token", map[string]string{"vault.kv-path": "secret/data/securae", "vault.token": "wrong"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := map[string]string{
+				"vault.address": server.URL,
+				"vault.token":   "vault-token",
+			}
+			for k, v := range test.settings {
+				settings[k] = v
+			}
+			provider := newKeyProvider(func(key string) string { return settings[key] })
+			key, err := provider.EncryptionKey()
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("Expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error but got: %q", err.Error())
+			}
+			if key != testEncryptionKey {
+				t.Errorf("Result was incorrect, got: %s, want: %s.", key, testEncryptionKey)
+			}
+		})
+	}
+}
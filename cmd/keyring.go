@@ -0,0 +1,373 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// A keyringEntry is an additional encryption key, e.g. one used before a
+// rotation or by another team. The fingerprint is the MD5 hash sent to the
+// storage provider, and it is checked to catch keys pasted with typos. The
+// key is either in the config file, or in a keystore file like the main key.
+type keyringEntry struct {
+	Label       string `mapstructure:"label" yaml:"label"`
+	Key         string `mapstructure:"key" yaml:"key"`
+	Keystore    string `mapstructure:"keystore" yaml:"keystore"`
+	Fingerprint string `mapstructure:"fingerprint" yaml:"fingerprint"`
+}
+
+var keyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the encryption keys",
+	Long: `List the encryption key and the keys in the keyring, with their fingerprints.
+
+When downloading or validating a file, the key it was uploaded with is found
+automatically among these keys.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if provider := newKeyProvider(keySetting); provider != nil {
+			fingerprint := "-"
+			if key, err := provider.EncryptionKey(); err == nil {
+				fingerprint, _ = hashEncryptionKey(key)
+			}
+			cmd.Printf("* %s (%s)\n", fingerprint, provider.Name())
+		}
+		keyring, err := getKeyring()
+		if err != nil {
+			return err
+		}
+		for _, entry := range keyring {
+			cmd.Printf("  %s (keyring: %s)\n", entry.Fingerprint, entry.Label)
+		}
+		for backupId, label := range viper.GetStringMapString("backup-keys") {
+			cmd.Printf("Uploads to %s use %s\n", backupId, label)
+		}
+		return nil
+	},
+}
+
+var keyAddCmd = &cobra.Command{
+	Use:   "add [label] [flags]",
+	Short: "Add an encryption key to the keyring",
+	Long: `Add an encryption key to the keyring. The base64 encoded key is read from the
+standard input, unless --generate is used.`,
+	Example: `# add the key used by another team
+echo "nMncUq8SsU7uz3cMucmFmgvUGXZ8LiBm8qx93hzrh6k=" | securae key add team-b
+
+# generate a new key
+securae key add archive --generate`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		label := args[0]
+		generate, _ := cmd.Flags().GetBool("generate")
+
+		var key string
+		if generate {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				return err
+			}
+			key = base64.StdEncoding.EncodeToString(b)
+		} else {
+			line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+			if err != nil && line == "" {
+				return fmt.Errorf("error reading encryption key: %w", err)
+			}
+			key = strings.TrimSpace(line)
+		}
+		if err := validateEncryptionKey(key); err != nil {
+			return err
+		}
+
+		if err := addToKeyring(label, key); err != nil {
+			return err
+		}
+
+		fingerprint, _ := hashEncryptionKey(key)
+		cmd.Printf("Key %s added to the keyring as %s.\n", fingerprint, label)
+		if generate {
+			cmd.Println("\n" + key + "\n")
+			cmd.Println("WARNING: Please save this encryption key in a safe place. You will need it to test your backups or to recover your files in case of disaster.")
+		}
+		return nil
+	},
+}
+
+var keyRemoveCmd = &cobra.Command{
+	Use:   "remove [label]",
+	Short: "Remove an encryption key from the keyring",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		label := args[0]
+		keyring, err := getKeyring()
+		if err != nil {
+			return err
+		}
+		var updated []keyringEntry
+		for _, entry := range keyring {
+			if entry.Label != label {
+				updated = append(updated, entry)
+			}
+		}
+		if len(updated) == len(keyring) {
+			return fmt.Errorf("There is no key labeled %s in the keyring.", label)
+		}
+		if err := saveKeyring(updated); err != nil {
+			return err
+		}
+		// Uploads using the removed key fall back to the main key.
+		return updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+			for backupId, backupLabel := range viper.GetStringMapString("backup-keys") {
+				if backupLabel == label {
+					unsetConfigValue(content, profileConfigKey("backup-keys."+backupId))
+				}
+			}
+			return nil
+		})
+	},
+}
+
+var keyUseCmd = &cobra.Command{
+	Use:   "use [label] [flags]",
+	Short: "Set the encryption key used to upload files to a backup",
+	Long: `Set the key from the keyring used to upload files to a backup. Without it,
+uploads use the main encryption key.`,
+	Example: `securae key use archive --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456`,
+	Args:    cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(flagBackupId, cmd.Flags().Lookup(flagBackupId))
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backupId, err := getBackupId()
+		if err != nil {
+			return err
+		}
+		if _, err := keyringKey(args[0]); err != nil {
+			return err
+		}
+		return updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+			setConfigValue(content, profileConfigKey("backup-keys."+backupId), args[0])
+			return nil
+		})
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keyListCmd)
+	keyCmd.AddCommand(keyAddCmd)
+	keyCmd.AddCommand(keyRemoveCmd)
+	keyCmd.AddCommand(keyUseCmd)
+	keyAddCmd.Flags().Bool("generate", false, "Generate a new random key")
+	keyUseCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) where your files will be stored. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+}
+
+func getKeyring() ([]keyringEntry, error) {
+	var keyring []keyringEntry
+	if err := viper.UnmarshalKey("keyring", &keyring); err != nil {
+		return nil, fmt.Errorf("error parsing the keyring: %w", err)
+	}
+	for i, entry := range keyring {
+		// The key of a keystore is only decrypted when it is used.
+		if entry.Keystore != "" {
+			if entry.Fingerprint == "" {
+				return nil, fmt.Errorf("The key labeled %s in the keyring has no fingerprint.", entry.Label)
+			}
+			continue
+		}
+		fingerprint, err := hashEncryptionKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key labeled %s in the keyring: %w", entry.Label, err)
+		}
+		if entry.Fingerprint != "" && entry.Fingerprint != fingerprint {
+			return nil, fmt.Errorf("The key labeled %s in the keyring doesn't match its fingerprint %s.", entry.Label, entry.Fingerprint)
+		}
+		keyring[i].Fingerprint = fingerprint
+	}
+	return keyring, nil
+}
+
+func saveKeyring(keyring []keyringEntry) error {
+	return updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+		if len(keyring) == 0 {
+			unsetConfigValue(content, profileConfigKey("keyring"))
+			return nil
+		}
+		var entries []interface{}
+		for _, entry := range keyring {
+			value := map[string]interface{}{
+				"label":       entry.Label,
+				"fingerprint": entry.Fingerprint,
+			}
+			if entry.Keystore != "" {
+				value["keystore"] = entry.Keystore
+			} else {
+				value["key"] = entry.Key
+			}
+			entries = append(entries, value)
+		}
+		setConfigValue(content, profileConfigKey("keyring"), entries)
+		return nil
+	})
+}
+
+func addToKeyring(label string, key string) error {
+	fingerprint, _ := hashEncryptionKey(key)
+	return appendToKeyring(keyringEntry{Label: label, Key: key, Fingerprint: fingerprint})
+}
+
+func appendToKeyring(added keyringEntry) error {
+	keyring, err := getKeyring()
+	if err != nil {
+		return err
+	}
+	for _, entry := range keyring {
+		if entry.Label == added.Label {
+			return fmt.Errorf("There is already a key labeled %s in the keyring.", added.Label)
+		}
+		if entry.Fingerprint == added.Fingerprint {
+			return fmt.Errorf("This key is already in the keyring as %s.", entry.Label)
+		}
+	}
+	return saveKeyring(append(keyring, added))
+}
+
+// encryptionKey returns the key of the entry, decrypting its keystore if
+// needed.
+func (entry keyringEntry) encryptionKey() (string, error) {
+	if entry.Keystore == "" {
+		return entry.Key, nil
+	}
+	filename := expandHome(entry.Keystore)
+	passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", filename), false)
+	if err != nil {
+		return "", err
+	}
+	key, err := readKeystore(filename, passphrase)
+	if err != nil {
+		return "", err
+	}
+	if fingerprint, _ := hashEncryptionKey(key); fingerprint != entry.Fingerprint {
+		return "", fmt.Errorf("The key labeled %s in the keyring doesn't match its fingerprint %s.", entry.Label, entry.Fingerprint)
+	}
+	return key, nil
+}
+
+func keyringKey(label string) (string, error) {
+	keyring, err := getKeyring()
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range keyring {
+		if entry.Label == label {
+			return entry.encryptionKey()
+		}
+	}
+	return "", fmt.Errorf("There is no key labeled %s in the keyring.", label)
+}
+
+// getUploadEncryptionKey returns the key set for the backup with `key use`,
+// or the main encryption key.
+func getUploadEncryptionKey(backupId string) (string, error) {
+	if label := viper.GetString("backup-keys." + backupId); label != "" {
+		return keyringKey(label)
+	}
+	return getEncryptionKey()
+}
+
+// encryptionKeyCandidates returns the main encryption key followed by the
+// keys in the keyring, without duplicates. When the main key can't be read,
+// e.g. an unreachable Vault, the keyring is still tried.
+func encryptionKeyCandidates() ([]string, error) {
+	var candidates []string
+	var providerErr error
+	seen := make(map[string]bool)
+
+	if newKeyProvider(keySetting) != nil {
+		key, err := getEncryptionKey()
+		if err == nil {
+			fingerprint, _ := hashEncryptionKey(key)
+			seen[fingerprint] = true
+			candidates = append(candidates, key)
+		}
+		providerErr = err
+	}
+
+	keyring, err := getKeyring()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range keyring {
+		if !seen[entry.Fingerprint] {
+			key, err := entry.encryptionKey()
+			if err != nil {
+				return nil, err
+			}
+			seen[entry.Fingerprint] = true
+			candidates = append(candidates, key)
+		}
+	}
+
+	if len(candidates) == 0 {
+		if providerErr != nil {
+			return nil, providerErr
+		}
+		return nil, fmt.Errorf("An encryption key is mandatory.")
+	}
+	return candidates, nil
+}
+
+// findEncryptionKey tries every known key against a presigned metadata URL,
+// and returns the one the file was uploaded with, along with the encryption
+// mode and the checksum of the file.
+func findEncryptionKey(presignedURL string) (string, string, string, error) {
+	candidates, err := encryptionKeyCandidates()
+	if err != nil {
+		return "", "", "", err
+	}
+	if len(candidates) == 1 {
+		headers, encryption, err := fetchEncryptedObjectMetadata(presignedURL, candidates[0])
+		return candidates[0], encryption, headers.Get("X-Amz-Checksum-Sha256"), err
+	}
+
+	var fingerprints []string
+	for _, key := range candidates {
+		headers, encryption, err := fetchEncryptedObjectMetadata(presignedURL, key)
+		if err == nil {
+			return key, encryption, headers.Get("X-Amz-Checksum-Sha256"), nil
+		}
+		if !strings.Contains(err.Error(), "does not match") {
+			return "", "", "", err
+		}
+		fingerprint, _ := hashEncryptionKey(key)
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return "", "", "", fmt.Errorf("None of the known encryption keys (%s) matches the one used to upload the file.", strings.Join(fingerprints, ", "))
+}
+
+// getDownloadEncryptionKey returns the key used to upload a file. With a
+// keyring, it is found by checking each key against the file metadata. It
+// is empty on a host with only the age settings.
+func getDownloadEncryptionKey(apiURL string, apiToken string, backupId string, postData []byte) (string, error) {
+	if ageOnly() {
+		return "", nil
+	}
+	if !viper.IsSet("keyring") {
+		return getEncryptionKey()
+	}
+	metadataURL := fmt.Sprintf("%s/backups/%s/metadata/", apiURL, backupId)
+	presignedURL, err := fetchPresignedURL(metadataURL, apiToken, postData)
+	if err != nil {
+		return "", err
+	}
+	encryptionKeyB64Encoded, _, _, err := findEncryptionKey(presignedURL)
+	return encryptionKeyB64Encoded, err
+}
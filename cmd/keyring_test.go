@@ -0,0 +1,72 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testKeyringKey = "5n2k6mFNtZmXnE8Yo1rV2oNnAcM3F0ElGiMg2nXlyq8="
+
+func TestValidateFindsKeyInKeyring(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql.gz", []byte("dump"), testKeyringKey)
+
+	configFile := storage.writeConfig(t, testKeyConfig+"keyring:\n  - label: old\n    key: "+testKeyringKey+"\n")
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "validate", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "Verifying file integrity... OK") {
+		t.Errorf("The file should be validated with the key from the keyring:\n%s", actual)
+	}
+}
+
+func TestGetKeyringChecksFingerprint(t *testing.T) {
+	viper.Reset()
+	viper.Set("keyring", []interface{}{
+		map[string]interface{}{"label": "old", "key": testKeyringKey, "fingerprint": "XDWErHXbj7CKDan2Qw4wjQ=="},
+	})
+	if _, err := getKeyring(); err == nil {
+		t.Errorf("A key that doesn't match its fingerprint should be rejected")
+	}
+
+	viper.Set("keyring", []interface{}{
+		map[string]interface{}{"label": "old", "key": testKeyringKey},
+	})
+	keyring, err := getKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := hashEncryptionKey(testKeyringKey)
+	if keyring[0].Fingerprint != want {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", keyring[0].Fingerprint, want)
+	}
+}
+
+func TestEncryptionKeyCandidatesWithoutMainKey(t *testing.T) {
+	viper.Reset()
+	viper.Set("encryption-key-command", "false")
+	viper.Set("keyring", []interface{}{
+		map[string]interface{}{"label": "old", "key": testKeyringKey},
+	})
+	candidates, err := encryptionKeyCandidates()
+	if err != nil || len(candidates) != 1 || candidates[0] != testKeyringKey {
+		t.Errorf("The keyring should be used when the main key can't be read, got %v (%v)", candidates, err)
+	}
+
+	viper.Set("keyring", nil)
+	if _, err := encryptionKeyCandidates(); err == nil || !strings.Contains(err.Error(), "false") {
+		t.Errorf("The error of the main key should be returned without a keyring, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var keySplitCmd = &cobra.Command{
+	Use:   "split [flags]",
+	Short: "Split the encryption key into shares",
+	Long: `Split the encryption key into shares using Shamir's secret sharing, so no
+single person holds the key. Any group of --threshold shares rebuilds it with
+"securae key combine", while fewer shares reveal nothing about the key.
+
+Each share carries the fingerprint of the key, so a wrong combination is
+detected before the key is used.`,
+	Example: `securae key split --shares 5 --threshold 3`,
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shares, _ := cmd.Flags().GetInt("shares")
+		threshold, _ := cmd.Flags().GetInt("threshold")
+		label, _ := cmd.Flags().GetString(flagLabel)
+
+		var encryptionKeyB64Encoded string
+		var err error
+		if label != "" {
+			encryptionKeyB64Encoded, err = keyringKey(label)
+		} else {
+			encryptionKeyB64Encoded, err = getEncryptionKey()
+		}
+		if err != nil {
+			return err
+		}
+		if err := validateEncryptionKey(encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+
+		keyShares, err := splitEncryptionKey(encryptionKeyB64Encoded, shares, threshold)
+		if err != nil {
+			return err
+		}
+		cmd.Printf("The key %s was split into %d shares, %d of them are needed to rebuild it.\n", keyShares[0].Fingerprint, shares, threshold)
+		for _, share := range keyShares {
+			cmd.Printf("\nShare %d of %d:\n%s\n", share.Index, shares, share)
+		}
+		cmd.Println("\nWARNING: Give each share to a different person. The shares are the only way to recover the key once it's removed from this device.")
+		return nil
+	},
+}
+
+var keyCombineCmd = &cobra.Command{
+	Use:   "combine [flags]",
+	Short: "Rebuild the encryption key from its shares",
+	Long: `Rebuild the encryption key from the shares created with "securae key split".
+
+The shares are read from the standard input, one per line; any other line is
+ignored. The key becomes the main encryption key when there is none
+configured, otherwise use --label to add it to the keyring.`,
+	Example: `# type or paste the shares, then press Ctrl+D
+securae key combine
+
+# combine shares from files
+cat share-1.txt share-4.txt share-5.txt | securae key combine --label recovered`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		label, _ := cmd.Flags().GetString(flagLabel)
+
+		var shares []keyShare
+		scanner := bufio.NewScanner(cmd.InOrStdin())
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if !strings.HasPrefix(line, sharePrefix+":") {
+				continue
+			}
+			share, err := parseKeyShare(line)
+			if err != nil {
+				return err
+			}
+			shares = append(shares, share)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading shares: %w", err)
+		}
+
+		encryptionKeyB64Encoded, err := combineEncryptionKey(shares)
+		if err != nil {
+			return err
+		}
+		return saveImportedKey(cmd, encryptionKeyB64Encoded, label)
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keySplitCmd)
+	keyCmd.AddCommand(keyCombineCmd)
+	keySplitCmd.Flags().Int("shares", 5, "Number of shares to create")
+	keySplitCmd.Flags().Int("threshold", 3, "Number of shares needed to rebuild the key")
+	keySplitCmd.Flags().String(flagLabel, "", "Split this key from the keyring instead of the main key")
+	keyCombineCmd.Flags().String(flagLabel, "", "Add the key to the keyring with this label")
+}
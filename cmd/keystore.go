@@ -0,0 +1,200 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+const keystoreVersion = 1
+const envKeystorePassphrase = "SECURAE_KEYSTORE_PASSPHRASE"
+
+// Argon2id parameters recommended by RFC 9106 for memory constrained
+// environments. They are stored in the keystore so they can be raised later
+// without breaking existing files.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// A keystore holds the encryption key wrapped with AES-256-GCM, using a key
+// derived from a passphrase with Argon2id.
+type keystore struct {
+	Version   int    `json:"version"`
+	KDF       string `json:"kdf"`
+	KDFParams struct {
+		Time    uint32 `json:"time"`
+		Memory  uint32 `json:"memory"`
+		Threads uint8  `json:"threads"`
+	} `json:"kdf_params"`
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+	// MD5 fingerprint of the key, the same one sent to the storage provider.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// keystoreKeyProvider reads the key from a passphrase-protected keystore.
+type keystoreKeyProvider struct {
+	filename string
+}
+
+func (p keystoreKeyProvider) Name() string {
+	return fmt.Sprintf("keystore %s", p.filename)
+}
+
+func (p keystoreKeyProvider) EncryptionKey() (string, error) {
+	passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", p.filename), false)
+	if err != nil {
+		return "", err
+	}
+	return readKeystore(p.filename, passphrase)
+}
+
+func deriveKeystoreKey(passphrase string, salt []byte, ks keystore) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, ks.KDFParams.Time, ks.KDFParams.Memory, ks.KDFParams.Threads, 32)
+}
+
+func writeKeystore(filename string, encryptionKeyB64Encoded string, passphrase string) error {
+	encryptionKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return err
+	}
+	defer encryptionKey.Destroy()
+
+	ks := keystore{Version: keystoreVersion, KDF: "argon2id"}
+	ks.KDFParams.Time = argon2Time
+	ks.KDFParams.Memory = argon2Memory
+	ks.KDFParams.Threads = argon2Threads
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	wrappingKey := deriveKeystoreKey(passphrase, salt, ks)
+	defer zeroBytes(wrappingKey)
+	gcm, err := newGCM(wrappingKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	ks.Salt = base64.StdEncoding.EncodeToString(salt)
+	ks.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	ks.Ciphertext = base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, encryptionKey.Bytes(), nil))
+	ks.Fingerprint, _ = hashEncryptionKey(encryptionKeyB64Encoded)
+
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The keystore can be the only copy of the key, e.g. when it is
+	// replaced by key rotate.
+	if err := writeFileAtomic(filename, data); err != nil {
+		return fmt.Errorf("error writing keystore: %w", err)
+	}
+	return nil
+}
+
+func readKeystore(filename string, passphrase string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("error reading keystore: %w", err)
+	}
+
+	var ks keystore
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return "", fmt.Errorf("error parsing keystore %s: %w", filename, err)
+	}
+	if ks.Version != keystoreVersion || ks.KDF != "argon2id" {
+		return "", fmt.Errorf("Unsupported keystore format in %s.", filename)
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(ks.Salt)
+	if err != nil {
+		return "", fmt.Errorf("error parsing keystore %s: %w", filename, err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(ks.Nonce)
+	if err != nil {
+		return "", fmt.Errorf("error parsing keystore %s: %w", filename, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(ks.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("error parsing keystore %s: %w", filename, err)
+	}
+
+	wrappingKey := deriveKeystoreKey(passphrase, salt, ks)
+	defer zeroBytes(wrappingKey)
+	gcm, err := newGCM(wrappingKey)
+	if err != nil {
+		return "", err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return "", fmt.Errorf("error parsing keystore %s: invalid nonce", filename)
+	}
+	encryptionKey := newSecureBuffer(len(ciphertext))
+	defer encryptionKey.Destroy()
+	plaintext, err := gcm.Open(encryptionKey.Bytes()[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("The passphrase for %s is not correct.", filename)
+	}
+	return base64.StdEncoding.EncodeToString(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readPassphrase returns the passphrase from SECURAE_KEYSTORE_PASSPHRASE or,
+// when running in a terminal, asks for it. With `confirm` it is asked twice.
+func readPassphrase(prompt string, confirm bool) (string, error) {
+	if passphrase, ok := os.LookupEnv(envKeystorePassphrase); ok {
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("A passphrase is required, set the environment variable %s.", envKeystorePassphrase)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("The passphrase can't be empty.")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		repeated, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(repeated) != string(passphrase) {
+			return "", fmt.Errorf("The passphrases don't match.")
+		}
+	}
+	return string(passphrase), nil
+}
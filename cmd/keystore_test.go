@@ -0,0 +1,98 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	filename := t.TempDir() + "/securae.key"
+	if err := writeKeystore(filename, testEncryptionKey, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Keystore permissions should be 0600, got: %o", fi.Mode().Perm())
+	}
+	data, _ := os.ReadFile(filename)
+	if strings.Contains(string(data), testEncryptionKey) {
+		t.Errorf("The keystore must not contain the plaintext key")
+	}
+
+	key, err := readKeystore(filename, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testEncryptionKey {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", key, testEncryptionKey)
+	}
+
+	if _, err := readKeystore(filename, "wrong horse"); err == nil {
+		t.Errorf("A wrong passphrase should be rejected")
+	}
+
+	// The keystore is replaced, as by key rotate, without leftovers.
+	newKey := "zZ8Zp9XQ7KxXHk8Vq3R1y8e1PzUzP1n6u3Qm0eV2s4E="
+	if err := writeKeystore(filename, newKey, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := readKeystore(filename, "correct horse"); key != newKey {
+		t.Errorf("The keystore should hold the new key, got: %s", key)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(filename)); len(entries) != 1 {
+		t.Errorf("The temporary file should be renamed over the keystore, got %d files", len(entries))
+	}
+}
+
+func TestInitCmdWithKeystore(t *testing.T) {
+	server := mockAPIServer()
+	defer server.Close()
+	t.Setenv(envKeystorePassphrase, "correct horse")
+
+	viper.Reset()
+	viper.Set("api.url", server.URL)
+
+	tmpDir := t.TempDir()
+	configFile := tmpDir + "/config.yaml"
+	keystoreFile := tmpDir + "/securae.key"
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "init", "-t", "xxxxx", "--keystore", keystoreFile})
+	defer initCmd.Flags().Set(flagKeystore, "")
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := readConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := getConfigValue(content, "encryption-key-b64encoded"); exists {
+		t.Errorf("The encryption key must not be stored in the config file")
+	}
+	if value, _ := getConfigValue(content, "encryption-key-keystore"); value != keystoreFile {
+		t.Errorf("Result was incorrect, got: %v, want: %s.", value, keystoreFile)
+	}
+
+	key, err := keystoreKeyProvider{filename: keystoreFile}.EncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateEncryptionKey(key); err != nil {
+		t.Errorf("Did not expect error but got: %q", err.Error())
+	}
+}
@@ -67,6 +67,7 @@ securae list`,
 			if err != nil {
 				return err
 			}
+			revealFilenames(data)
 			showBackups(data)
 		} else {
 			if !IsUUID(backupId) {
@@ -77,6 +78,7 @@ securae list`,
 			if err != nil {
 				return err
 			}
+			revealFilenames([]Backup{data})
 			showBackupData(data, true)
 		}
 		return nil
@@ -105,7 +107,15 @@ func showBackupData(backup Backup, showMissing bool) {
 	}
 	if len(backup.Backupobjects) > 0 {
 		fmt.Printf("\n%s\n-------\n", textTitle("Objects"))
+		var chunks int
+		var chunksSize uint64
 		for _, bo := range backup.Backupobjects {
+			// The chunks of chunked files are summarized after the files.
+			if strings.HasPrefix(bo.Name, chunkPrefix) {
+				chunks++
+				chunksSize += bo.Size
+				continue
+			}
 			uploadDate, _ := time.ParseInLocation(time.RFC3339Nano, bo.CreatedAt, time.Local)
 			if bo.Size > 0 {
 				fmt.Printf("%s (%s)\n", textBold(bo.Name), humanize.Bytes(bo.Size))
@@ -114,6 +124,9 @@ func showBackupData(backup Backup, showMissing bool) {
 			}
 			fmt.Printf("└─ Object ID: %s uploaded on %s in %s, %s\n", textUUID(bo.Id), uploadDate.Format(time.RFC822Z), bo.Bucket.City, strings.ToUpper(bo.Bucket.CountryCode))
 		}
+		if chunks > 0 {
+			fmt.Printf("%d chunks of chunked files (%s)\n", chunks, humanize.Bytes(chunksSize))
+		}
 	} else {
 		if showMissing {
 			fmt.Printf("\n%s\n-------\n", textTitle("Objects"))
@@ -124,6 +137,20 @@ func showBackupData(backup Backup, showMissing bool) {
 	}
 }
 
+// revealFilenames replaces the obfuscated filenames with the original ones.
+// Without the encryption key, the obfuscated names are shown.
+func revealFilenames(backups []Backup) {
+	nameKey, err := filenameKey()
+	if err != nil || nameKey == "" {
+		return
+	}
+	for _, backup := range backups {
+		for i, bo := range backup.Backupobjects {
+			backup.Backupobjects[i].Name = decryptFilename(bo.Name, nameKey)
+		}
+	}
+}
+
 func showBackups(backups []Backup) {
 	for _, backup := range backups {
 		showBackupData(backup, false)
@@ -0,0 +1,263 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Files can be uploaded with a manifest of the SHA-256 hashes of their
+// blocks, as stored by the storage provider, and the root of the Merkle tree
+// of these hashes. The root is also stored in the object metadata, so the
+// manifest can't be replaced, and validate --spot-check verifies a few
+// random blocks instead of downloading the whole file.
+//
+// The leaves are the hashes of the blocks prefixed with 0, the nodes the
+// hashes of their children prefixed with 1. A node without sibling is
+// promoted to the next level.
+
+const flagMerkle = "merkle"
+const flagSpotCheck = "spot-check"
+
+const merkleManifestVersion = 1
+const merkleBlockSize = 64 * 1024 * 1024
+const merkleManifestSuffix = ".merkle.json"
+const metadataMerkleRoot = "X-Amz-Meta-Securae-Merkle-Root"
+
+type merkleManifest struct {
+	Version   int      `json:"version"`
+	BlockSize int64    `json:"block_size"`
+	Size      int64    `json:"size"`
+	Root      string   `json:"root"`
+	Blocks    []string `json:"blocks"`
+}
+
+func merkleLeaf(block []byte) []byte {
+	sum := sha256.Sum256(append([]byte{0}, block...))
+	return sum[:]
+}
+
+// merkleRoot returns the root of the tree whose leaves are `leaves`.
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return merkleLeaf(nil)
+	}
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := append([]byte{1}, level[i]...)
+			sum := sha256.Sum256(append(node, level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// buildMerkleManifest hashes the blocks of `src`.
+func buildMerkleManifest(src io.Reader, blockSize int64) (merkleManifest, error) {
+	manifest := merkleManifest{Version: merkleManifestVersion, BlockSize: blockSize}
+	var leaves [][]byte
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(src, block)
+		if n > 0 || len(leaves) == 0 {
+			leaf := merkleLeaf(block[:n])
+			leaves = append(leaves, leaf)
+			manifest.Blocks = append(manifest.Blocks, base64.StdEncoding.EncodeToString(leaf))
+			manifest.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+	}
+	manifest.Root = base64.StdEncoding.EncodeToString(merkleRoot(leaves))
+	return manifest, nil
+}
+
+// verifyMerkleManifest checks the hashes of the manifest against the root
+// stored with the object.
+func verifyMerkleManifest(manifest merkleManifest, root string) error {
+	if manifest.Version != merkleManifestVersion {
+		return fmt.Errorf("The file uses the block manifest version %d, which is not supported by this version.", manifest.Version)
+	}
+	if manifest.BlockSize <= 0 || int64(len(manifest.Blocks)) != max((manifest.Size+manifest.BlockSize-1)/manifest.BlockSize, 1) {
+		return fmt.Errorf("The block manifest of the file is invalid.")
+	}
+	var leaves [][]byte
+	for _, block := range manifest.Blocks {
+		leaf, err := base64.StdEncoding.DecodeString(block)
+		if err != nil {
+			return fmt.Errorf("The block manifest of the file is invalid.")
+		}
+		leaves = append(leaves, leaf)
+	}
+	if computed := base64.StdEncoding.EncodeToString(merkleRoot(leaves)); computed != root || manifest.Root != root {
+		return fmt.Errorf("The block manifest doesn't match the Merkle root stored with the file.")
+	}
+	return nil
+}
+
+// uploadMerkleManifest hashes the blocks of the file to upload, and uploads
+// the manifest as the sidecar of `name`. It returns the Merkle root.
+func uploadMerkleManifest(apiURL string, apiToken string, backupId string, encryptionKeyB64Encoded string, name string, file *os.File) (string, error) {
+	if _, err := file.Seek(0, 0); err != nil {
+		return "", err
+	}
+	manifest, err := buildMerkleManifest(file, merkleBlockSize)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	prepared, err := prepareObject(encryptionKeyB64Encoded, "", 0, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(prepared.Name())
+	defer prepared.Close()
+	if err := uploadObject(apiURL, apiToken, backupId, encryptionKeyB64Encoded, name+merkleManifestSuffix, prepared, nil); err != nil {
+		return "", err
+	}
+	return manifest.Root, nil
+}
+
+// spotCheckBlocks downloads `count` random blocks of the object and checks
+// them against the manifest. It returns the number of bytes downloaded, and
+// the index of the first block that doesn't match, or -1.
+func spotCheckBlocks(url string, encryptionKeyB64Encoded string, manifest merkleManifest, count int) (int64, int, error) {
+	blocks := len(manifest.Blocks)
+	count = min(count, blocks)
+	// A random selection of distinct blocks: the first `count` of a
+	// shuffled list.
+	order := make([]int, blocks)
+	for i := range order {
+		order[i] = i
+	}
+	for i := 0; i < count; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(blocks-i)))
+		if err != nil {
+			return 0, -1, err
+		}
+		k := i + int(j.Int64())
+		order[i], order[k] = order[k], order[i]
+	}
+
+	var downloaded int64
+	for _, block := range order[:count] {
+		start := int64(block) * manifest.BlockSize
+		end := min(start+manifest.BlockSize, manifest.Size) - 1
+		var data []byte
+		if end >= start {
+			body, err := fetchObjectRange(url, encryptionKeyB64Encoded, start, end)
+			if err != nil {
+				return downloaded, -1, err
+			}
+			data, err = io.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return downloaded, -1, err
+			}
+			downloaded += int64(len(data))
+		}
+		expected, _ := base64.StdEncoding.DecodeString(manifest.Blocks[block])
+		if !bytes.Equal(merkleLeaf(data), expected) {
+			return downloaded, block, nil
+		}
+	}
+	return downloaded, -1, nil
+}
+
+func merkleEnabled() bool {
+	return viper.GetBool(flagMerkle)
+}
+
+// validateSpotCheck verifies `count` random blocks of the file instead of
+// downloading all of it.
+func validateSpotCheck(cmd *cobra.Command, apiURL string, apiToken string, backupId string, metadataURL string, encryptionKeyB64Encoded string, name string, count int) error {
+	headers, encryption, err := fetchEncryptedObjectMetadata(metadataURL, encryptionKeyB64Encoded)
+	if err != nil {
+		return err
+	}
+	root := headers.Get(metadataMerkleRoot)
+	if root == "" {
+		return fmt.Errorf("The file %s was uploaded without --merkle, it can't be spot-checked.", name)
+	}
+
+	cmd.Printf("[%s] Downloading block manifest... ", name)
+	manifestURL, _, err := presignedDownloadURL(apiURL, apiToken, backupId, name+merkleManifestSuffix)
+	if err != nil {
+		return err
+	}
+	manifestFile, err := createTempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(manifestFile.Name())
+	defer manifestFile.Close()
+	if _, err := restoreFile(manifestURL, encryptionKeyB64Encoded, manifestFile.Name(), false, nil); err != nil {
+		return err
+	}
+	var manifest merkleManifest
+	if err := json.NewDecoder(manifestFile).Decode(&manifest); err != nil {
+		return fmt.Errorf("error reading the block manifest: %w", err)
+	}
+	if err := verifyMerkleManifest(manifest, root); err != nil {
+		return err
+	}
+	cmd.Printf("OK\n")
+
+	downloadURL, _, err := presignedDownloadURL(apiURL, apiToken, backupId, name)
+	if err != nil {
+		return err
+	}
+	cmd.Printf("[%s] Spot-checking %d of %d blocks... ", name, min(count, len(manifest.Blocks)), len(manifest.Blocks))
+	sseKey := sseCustomerKey(encryptionKeyB64Encoded, encryption)
+	size, err := fetchObjectSize(downloadURL, sseKey)
+	if err != nil {
+		return err
+	}
+	if size != manifest.Size {
+		cmd.Printf("Error (the file has %d bytes instead of %d)\n", size, manifest.Size)
+		return nil
+	}
+	downloaded, mismatch, err := spotCheckBlocks(downloadURL, sseKey, manifest, count)
+	if err != nil {
+		return err
+	}
+	if mismatch >= 0 {
+		cmd.Printf("Error (block %d doesn't match)\n", mismatch)
+	} else {
+		cmd.Printf("OK (%s downloaded)\n", humanize.Bytes(uint64(downloaded)))
+	}
+	return nil
+}
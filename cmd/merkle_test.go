@@ -0,0 +1,82 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMerkleManifest(t *testing.T) {
+	for _, size := range []int{0, 1000, 4096, 5000, 7 * 1024} {
+		manifest, err := buildMerkleManifest(bytes.NewReader(randomData(size, 8)), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Size != int64(size) {
+			t.Errorf("The manifest should have the size of the data, got %d instead of %d", manifest.Size, size)
+		}
+		if err := verifyMerkleManifest(manifest, manifest.Root); err != nil {
+			t.Errorf("The manifest of %d bytes should be valid: %v", size, err)
+		}
+	}
+
+	manifest, _ := buildMerkleManifest(bytes.NewReader(randomData(5000, 8)), 1024)
+	root := manifest.Root
+	manifest.Blocks[0], manifest.Blocks[1] = manifest.Blocks[1], manifest.Blocks[0]
+	if err := verifyMerkleManifest(manifest, root); err == nil {
+		t.Errorf("Reordered blocks should not match the root")
+	}
+	manifest.Blocks = manifest.Blocks[:4]
+	if err := verifyMerkleManifest(manifest, root); err == nil {
+		t.Errorf("A truncated manifest should be rejected")
+	}
+}
+
+func TestValidateSpotCheck(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "vm.img")
+	if err := os.WriteFile(filename, randomData(100*1024, 9), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer uploadCmd.Flags().Set(flagMerkle, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--merkle", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	names := storage.backup().Backupobjects
+	if names[len(names)-1].Name != "vm.img" {
+		t.Errorf("The file should be uploaded after its block manifest")
+	}
+
+	actual.Reset()
+	defer validateCmd.Flags().Set(flagSpotCheck, "0")
+	RootCmd.SetArgs([]string{"--config", configFile, "validate", "vm.img", "--spot-check", "2", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "Spot-checking 1 of 1 blocks... OK") {
+		t.Errorf("The block should be verified:\n%s", actual)
+	}
+
+	storage.get("vm.img").Data[50000] ^= 1
+	actual.Reset()
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "Error (block 0 doesn't match)") {
+		t.Errorf("The modified block should be detected:\n%s", actual)
+	}
+}
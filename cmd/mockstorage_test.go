@@ -0,0 +1,216 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const testBackupId = "abcd1234-ab12-4b12-ab12-abcdef123456"
+
+// testKeyConfig is the config line of the test encryption key.
+const testKeyConfig = "encryption-key-b64encoded: " + testEncryptionKey + "\n"
+
+type mockObject struct {
+	Data     []byte
+	KeyMD5   string
+	Checksum string
+	Metadata http.Header
+}
+
+// mockUpload is a version of an object. Like the API, the mock lists every
+// upload, and an object uploaded again under the same name keeps its
+// previous versions.
+type mockUpload struct {
+	Name   string
+	Object *mockObject
+}
+
+// mockStorage is a stand-in for both the Securae API and the storage
+// provider behind the presigned URLs. Objects are kept in memory, with the
+// MD5 of the SSE-C key they were uploaded with. The presigned URLs give
+// access to the latest version of each object.
+type mockStorage struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects map[string]*mockObject
+	uploads []mockUpload
+	// onPut, if set, is called after each upload.
+	onPut func(name string)
+}
+
+func newMockStorage() *mockStorage {
+	m := &mockStorage{objects: make(map[string]*mockObject)}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.handle))
+	return m
+}
+
+// writeConfig resets viper and writes a config file using the mock as the
+// API, followed by the YAML lines of `config`. It returns the path of the
+// file.
+func (m *mockStorage) writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	viper.Reset()
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(filename, []byte("api:\n  url: "+m.URL+"\n"+config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// put stores an object directly, as if it had been uploaded with `key`.
+func (m *mockStorage) put(name string, data []byte, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keyMD5, _ := hashEncryptionKey(key)
+	checksum := sha256.Sum256(data)
+	m.objects[name] = &mockObject{Data: data, KeyMD5: keyMD5, Checksum: base64.StdEncoding.EncodeToString(checksum[:]), Metadata: http.Header{}}
+	m.uploads = append(m.uploads, mockUpload{Name: name, Object: m.objects[name]})
+}
+
+func (m *mockStorage) get(name string) *mockObject {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.objects[name]
+}
+
+func (m *mockStorage) handle(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case path == "/users/me":
+		w.Write([]byte(`{}`))
+	case path == "/backups":
+		json.NewEncoder(w).Encode([]Backup{m.backup()})
+	case path == "/backups/"+testBackupId:
+		json.NewEncoder(w).Encode(m.backup())
+	case strings.HasPrefix(path, "/backups/"+testBackupId+"/"):
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		name, _ := body["filename"].(string)
+		if name == "" && len(m.uploads) > 0 {
+			name = m.uploads[len(m.uploads)-1].Name
+		}
+		if _, exists := m.objects[name]; !exists && !strings.HasSuffix(path, "/preupload/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"url": m.URL + "/storage/" + name})
+	case strings.HasPrefix(path, "/storage/"):
+		m.handleObject(w, r, strings.TrimPrefix(path, "/storage/"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (m *mockStorage) backup() Backup {
+	backup := Backup{Id: testBackupId, Name: "test"}
+	for i, upload := range m.uploads {
+		bo := struct {
+			Id     string `json:"id"`
+			Name   string `json:"name"`
+			Bucket struct {
+				Region      string `json:"region"`
+				CountryCode string `json:"country_code"`
+				City        string `json:"city"`
+			} `json:"bucket"`
+			Size      uint64 `json:"size"`
+			CreatedAt string `json:"created_at"`
+		}{Id: fmt.Sprintf("%s-%d", upload.Name, i), Name: upload.Name, Size: uint64(len(upload.Object.Data)), CreatedAt: time.Now().Format(time.RFC3339Nano)}
+		backup.Backupobjects = append(backup.Backupobjects, bo)
+	}
+	return backup
+}
+
+func (m *mockStorage) handleObject(w http.ResponseWriter, r *http.Request, name string) {
+	keyMD5 := r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-MD5")
+
+	if r.Method == http.MethodPut {
+		data, _ := io.ReadAll(r.Body)
+		checksum := sha256.Sum256(data)
+		checksumB64 := base64.StdEncoding.EncodeToString(checksum[:])
+		if expected := r.Header.Get("X-Amz-Checksum-SHA256"); expected != "" && expected != checksumB64 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		metadata := http.Header{}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				metadata[k] = v
+			}
+		}
+		m.objects[name] = &mockObject{Data: data, KeyMD5: keyMD5, Checksum: checksumB64, Metadata: metadata}
+		m.uploads = append(m.uploads, mockUpload{Name: name, Object: m.objects[name]})
+		if m.onPut != nil {
+			m.onPut(name)
+		}
+		return
+	}
+
+	object, exists := m.objects[name]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Like S3, a request without the SSE-C headers for an object encrypted
+	// with them, or the reverse, is invalid, while a wrong key is denied.
+	if object.KeyMD5 != keyMD5 && (object.KeyMD5 == "" || keyMD5 == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("<Error><Code>InvalidRequest</Code></Error>"))
+		return
+	}
+	if object.KeyMD5 != keyMD5 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("The calculated MD5 hash of the key did not match the hash that was provided. You must provide the correct secret key."))
+		return
+	}
+	for k, v := range object.Metadata {
+		w.Header()[k] = v
+	}
+	if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" {
+		w.Header().Set("X-Amz-Checksum-Sha256", object.Checksum)
+	}
+
+	data := object.Data
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var start, end int
+		fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
+		if start >= len(data) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method != http.MethodHead {
+			w.Write(data[start : end+1])
+		}
+		return
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
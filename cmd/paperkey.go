@@ -0,0 +1,294 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tyler-smith/go-bip39"
+	"rsc.io/qr"
+)
+
+const flagFormat = "format"
+const flagLabel = "label"
+const flagFingerprint = "fingerprint"
+
+var keyExportCmd = &cobra.Command{
+	Use:   "export [flags]",
+	Short: "Export the encryption key in a format easy to write down",
+	Long: `Export the encryption key to keep a copy on paper.
+
+Formats:
+  base64    the key as stored in the configuration file
+  mnemonic  24 words from the BIP39 word list, the last one includes a checksum
+  qr        a QR code of the base64 key
+  sheet     a printable sheet with the fingerprint, the words and the QR code`,
+	Example: `securae key export --format mnemonic
+
+# print a recovery sheet
+securae key export --format sheet | lpr`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString(flagFormat)
+		label, _ := cmd.Flags().GetString(flagLabel)
+
+		var encryptionKeyB64Encoded string
+		var err error
+		if label != "" {
+			encryptionKeyB64Encoded, err = keyringKey(label)
+		} else {
+			encryptionKeyB64Encoded, err = getEncryptionKey()
+		}
+		if err != nil {
+			return err
+		}
+		if err := validateEncryptionKey(encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+
+		switch format {
+		case "base64":
+			cmd.Println(encryptionKeyB64Encoded)
+		case "mnemonic":
+			words, err := keyToMnemonic(encryptionKeyB64Encoded)
+			if err != nil {
+				return err
+			}
+			cmd.Print(formatMnemonic(words))
+		case "qr":
+			code, err := renderQRCode(encryptionKeyB64Encoded, true)
+			if err != nil {
+				return err
+			}
+			cmd.Print(code)
+		case "sheet":
+			sheet, err := recoverySheet(encryptionKeyB64Encoded, label)
+			if err != nil {
+				return err
+			}
+			cmd.Print(sheet)
+		default:
+			return fmt.Errorf("Unknown format %q, use one of: base64, mnemonic, qr, sheet.", format)
+		}
+		return nil
+	},
+}
+
+var keyImportCmd = &cobra.Command{
+	Use:   "import [flags]",
+	Short: "Import an encryption key exported with `key export`",
+	Long: `Import an encryption key read from the standard input, as 24 words or in base64.
+
+Words can be separated by spaces or new lines, numbers are ignored, and each
+word can be shortened to its first 4 letters. The key is checked against
+--fingerprint before it's saved.
+
+The key becomes the main encryption key when there is none configured,
+otherwise use --label to add it to the keyring.`,
+	Example: `securae key import --format mnemonic --fingerprint XDWErHXbj7CKDan2Qw4wjQ==`,
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString(flagFormat)
+		label, _ := cmd.Flags().GetString(flagLabel)
+		expectedFingerprint, _ := cmd.Flags().GetString(flagFingerprint)
+
+		input, err := io.ReadAll(cmd.InOrStdin())
+		if err != nil {
+			return fmt.Errorf("error reading encryption key: %w", err)
+		}
+
+		var encryptionKeyB64Encoded string
+		switch format {
+		case "base64":
+			encryptionKeyB64Encoded = strings.TrimSpace(string(input))
+		case "mnemonic":
+			encryptionKeyB64Encoded, err = mnemonicToKey(string(input))
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unknown format %q, use one of: base64, mnemonic.", format)
+		}
+		if err := validateEncryptionKey(encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+
+		fingerprint, _ := hashEncryptionKey(encryptionKeyB64Encoded)
+		if expectedFingerprint != "" && expectedFingerprint != fingerprint {
+			return fmt.Errorf("The imported key has the fingerprint %s instead of %s. Please, check the words or characters you typed.", fingerprint, expectedFingerprint)
+		}
+
+		return saveImportedKey(cmd, encryptionKeyB64Encoded, label)
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keyExportCmd)
+	keyCmd.AddCommand(keyImportCmd)
+	keyExportCmd.Flags().String(flagFormat, "mnemonic", "Output format: base64, mnemonic, qr or sheet")
+	keyExportCmd.Flags().String(flagLabel, "", "Export this key from the keyring instead of the main key")
+	keyImportCmd.Flags().String(flagFormat, "mnemonic", "Input format: base64 or mnemonic")
+	keyImportCmd.Flags().String(flagLabel, "", "Add the key to the keyring with this label")
+	keyImportCmd.Flags().String(flagFingerprint, "", "Expected MD5 fingerprint of the key, as shown by `key export` and `key list`")
+}
+
+// saveImportedKey stores a recovered key as the main encryption key, or in
+// the keyring when a label is given.
+func saveImportedKey(cmd *cobra.Command, encryptionKeyB64Encoded string, label string) error {
+	fingerprint, _ := hashEncryptionKey(encryptionKeyB64Encoded)
+	if label != "" {
+		if err := addToKeyring(label, encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+		cmd.Printf("Key %s added to the keyring as %s.\n", fingerprint, label)
+		return nil
+	}
+
+	if newKeyProvider(keySetting) != nil {
+		return fmt.Errorf("An encryption key is already configured, use --label to add this one to the keyring.")
+	}
+	err := updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+		setConfigValue(content, profileConfigKey("encryption-key-b64encoded"), encryptionKeyB64Encoded)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cmd.Printf("Key %s imported.\n", fingerprint)
+	return nil
+}
+
+func keyToMnemonic(encryptionKeyB64Encoded string) ([]string, error) {
+	encryptionKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	defer encryptionKey.Destroy()
+	mnemonic, err := bip39.NewMnemonic(encryptionKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(mnemonic), nil
+}
+
+func mnemonicToKey(input string) (string, error) {
+	var words []string
+	for i, token := range strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		word, ok := expandMnemonicWord(token)
+		if !ok {
+			// The word itself is not shown, it is part of the key.
+			return "", fmt.Errorf("The word number %d is not in the BIP39 word list.", i+1)
+		}
+		words = append(words, word)
+	}
+	if len(words) != 24 {
+		return "", fmt.Errorf("The key must have 24 words, %d were found.", len(words))
+	}
+
+	encryptionKey, err := bip39.EntropyFromMnemonic(strings.Join(words, " "))
+	if err != nil {
+		return "", fmt.Errorf("The words don't form a valid key, please check them: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(encryptionKey), nil
+}
+
+// expandMnemonicWord accepts a word from the BIP39 list or its first 4
+// letters, which are enough to identify it.
+func expandMnemonicWord(token string) (string, bool) {
+	if _, ok := bip39.GetWordIndex(token); ok {
+		return token, true
+	}
+	if len(token) >= 4 {
+		for _, word := range bip39.GetWordList() {
+			if strings.HasPrefix(word, token) {
+				return word, true
+			}
+		}
+	}
+	return "", false
+}
+
+func formatMnemonic(words []string) string {
+	var sb strings.Builder
+	for i, word := range words {
+		if (i+1)%4 == 0 || i == len(words)-1 {
+			sb.WriteString(fmt.Sprintf("%2d. %s\n", i+1, word))
+		} else {
+			sb.WriteString(fmt.Sprintf("%2d. %-10s  ", i+1, word))
+		}
+	}
+	return sb.String()
+}
+
+// renderQRCode draws a QR code with Unicode blocks, two rows per line. For
+// terminals with a dark background the colors must be inverted.
+func renderQRCode(text string, inverted bool) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+
+	const quietZone = 2
+	black := func(x, y int) bool {
+		return code.Black(x-quietZone, y-quietZone) != inverted
+	}
+	size := code.Size + 2*quietZone
+	var sb strings.Builder
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			top, bottom := black(x, y), black(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+func recoverySheet(encryptionKeyB64Encoded string, label string) (string, error) {
+	words, err := keyToMnemonic(encryptionKeyB64Encoded)
+	if err != nil {
+		return "", err
+	}
+	code, err := renderQRCode(encryptionKeyB64Encoded, false)
+	if err != nil {
+		return "", err
+	}
+	fingerprint, _ := hashEncryptionKey(encryptionKeyB64Encoded)
+
+	var sb strings.Builder
+	sb.WriteString("SECURAE BACKUP - ENCRYPTION KEY RECOVERY SHEET\n")
+	sb.WriteString("==============================================\n\n")
+	if label != "" {
+		sb.WriteString(fmt.Sprintf("Label:       %s\n", label))
+	}
+	sb.WriteString(fmt.Sprintf("Fingerprint: %s\n", fingerprint))
+	sb.WriteString(fmt.Sprintf("Printed on:  %s\n\n", time.Now().Format(time.RFC822Z)))
+	sb.WriteString("Words:\n\n")
+	sb.WriteString(formatMnemonic(words))
+	sb.WriteString("\nBase64:\n\n")
+	sb.WriteString(encryptionKeyB64Encoded + "\n\n")
+	sb.WriteString(code)
+	sb.WriteString("\nTo restore this key, type the words into:\n")
+	sb.WriteString(fmt.Sprintf("  securae key import --format mnemonic --fingerprint %s\n", fingerprint))
+	sb.WriteString("\nKeep this sheet in a safe place, anyone holding it can decrypt your backups.\n")
+	return sb.String(), nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMnemonicRoundTrip(t *testing.T) {
+	words, err := keyToMnemonic(testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 24 {
+		t.Fatalf("Result was incorrect, got: %d words, want: 24.", len(words))
+	}
+
+	// Numbered output from `key export`, as typed back by the user.
+	key, err := mnemonicToKey(formatMnemonic(words))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testEncryptionKey {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", key, testEncryptionKey)
+	}
+}
+
+func TestMnemonicToKeyAbbreviated(t *testing.T) {
+	words, _ := keyToMnemonic(testEncryptionKey)
+	var abbreviated []string
+	for _, word := range words {
+		if len(word) > 4 {
+			word = word[:4]
+		}
+		abbreviated = append(abbreviated, strings.ToUpper(word))
+	}
+
+	key, err := mnemonicToKey(strings.Join(abbreviated, " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testEncryptionKey {
+		t.Errorf("Result was incorrect, got: %s, want: %s.", key, testEncryptionKey)
+	}
+}
+
+func TestMnemonicToKeyChecksum(t *testing.T) {
+	words, _ := keyToMnemonic(testEncryptionKey)
+	words[0], words[1] = words[1], words[0]
+
+	if _, err := mnemonicToKey(strings.Join(words, " ")); err == nil {
+		t.Errorf("Swapped words should be detected by the checksum")
+	}
+	if _, err := mnemonicToKey(strings.Join(words[:23], " ")); err == nil {
+		t.Errorf("A missing word should be detected")
+	}
+}
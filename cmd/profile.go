@@ -0,0 +1,203 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage configuration profiles",
+	Long: `Manage the profiles stored in the configuration file.
+
+A profile groups an API token, an API URL and an encryption key under a name,
+so several accounts can share one configuration file. The profile to use is
+selected with --profile, the environment variable SECURAE_PROFILE, or the one
+set as default with "securae profile use".`,
+	Example: `# create a profile
+securae init --profile prod --api-token xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx
+
+# use it by default
+securae profile use prod
+
+# use another profile only for one command
+securae list --profile staging`,
+	Args:    cobra.NoArgs,
+	GroupID: "setup",
+}
+
+var profileListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the profiles in the configuration file",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names := profileNames()
+		if len(names) == 0 {
+			cmd.Println("There are no profiles in the configuration file.")
+			return nil
+		}
+		current := currentProfile()
+		for _, name := range names {
+			if name == current {
+				cmd.Printf("* %s\n", name)
+			} else {
+				cmd.Printf("  %s\n", name)
+			}
+		}
+		return nil
+	},
+}
+
+var profileUseCmd = &cobra.Command{
+	Use:     "use [profile]",
+	Short:   "Set the default profile",
+	Example: `securae profile use prod`,
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if !profileExists(name) {
+			return fmt.Errorf("Profile %s not found in %s.", name, viper.ConfigFileUsed())
+		}
+		err := updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+			setConfigValue(content, flagProfile, name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		cmd.Printf("Default profile set to %s.\n", name)
+		return nil
+	},
+}
+
+var profileShowCmd = &cobra.Command{
+	Use:   "show [profile]",
+	Short: "Show the settings of a profile",
+	Long: `Show the settings of a profile. Secrets are never displayed.
+
+If there is no profile argument, this command shows the profile in use.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := currentProfile()
+		if len(args) > 0 {
+			name = args[0]
+			if !profileExists(name) {
+				return fmt.Errorf("Profile %s not found in %s.", name, viper.ConfigFileUsed())
+			}
+		}
+
+		prefix := ""
+		if name != currentProfile() {
+			prefix = "profiles." + name + "."
+		}
+		apiURL := viper.GetString(prefix + "api.url")
+		if apiURL == "" {
+			apiURL = apiEndpoint
+		}
+		fingerprint, err := hashEncryptionKey(viper.GetString(prefix + "encryption-key-b64encoded"))
+		if err != nil {
+			fingerprint = "-"
+		}
+
+		if name == "" {
+			name = "(none)"
+		}
+		cmd.Printf("Profile: %s\n", name)
+		cmd.Printf("API URL: %s\n", apiURL)
+		cmd.Printf("API token: %s\n", redactSecret(viper.GetString(prefix+"api.token")))
+		cmd.Printf("Encryption key fingerprint (MD5): %s\n", fingerprint)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(profileCmd)
+	profileCmd.AddCommand(profileListCmd)
+	profileCmd.AddCommand(profileUseCmd)
+	profileCmd.AddCommand(profileShowCmd)
+}
+
+// currentProfile returns the profile selected by flag, environment variable
+// or config file, in that order. An empty string means no profile is used.
+func currentProfile() string {
+	return strings.ToLower(viper.GetString(flagProfile))
+}
+
+func profileNames() []string {
+	var names []string
+	for name := range viper.GetStringMap("profiles") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func profileExists(name string) bool {
+	_, ok := viper.GetStringMap("profiles")[strings.ToLower(name)]
+	return ok
+}
+
+func isValidProfileName(name string) bool {
+	re := regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	return re.MatchString(name)
+}
+
+// profileConfigKey returns where a setting must be written in the config
+// file, which is under `profiles.<name>` when a profile is in use.
+func profileConfigKey(key string) string {
+	if profile := currentProfile(); profile != "" {
+		return "profiles." + profile + "." + key
+	}
+	return key
+}
+
+// applyProfile merges the settings of the current profile on top of the
+// ones defined at the top level of the config file. Flags and environment
+// variables still take precedence over both.
+func applyProfile() error {
+	profile := currentProfile()
+	if profile == "" {
+		return nil
+	}
+	if !isValidProfileName(profile) {
+		return fmt.Errorf("Invalid profile name %q, only letters, digits, `-` and `_` are allowed.", profile)
+	}
+	settings := viper.GetStringMap("profiles." + profile)
+	if len(settings) == 0 {
+		// The profile doesn't exist yet, it can be created by `init`.
+		return nil
+	}
+	return viper.MergeConfigMap(settings)
+}
+
+// requireProfile returns an error when the selected profile is not in the
+// config file, so a typo in its name doesn't run the command with the
+// settings of the top level. Only init creates profiles.
+func requireProfile(cmd *cobra.Command, args []string) error {
+	profile := currentProfile()
+	if profile == "" || profileExists(profile) || cmd == initCmd {
+		return nil
+	}
+	if cmd.Name() == "help" || (cmd.HasParent() && cmd.Parent().Name() == "completion") {
+		return nil
+	}
+	return fmt.Errorf("Profile %s not found in %s, create it with \"securae init --profile %s\".", profile, viper.ConfigFileUsed(), profile)
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return "-"
+	}
+	if len(secret) <= 8 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:4] + strings.Repeat("*", len(secret)-4)
+}
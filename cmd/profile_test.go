@@ -0,0 +1,160 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestInitCmdWritesIntoProfile(t *testing.T) {
+	server := mockAPIServer()
+	defer server.Close()
+
+	viper.Reset()
+	viper.Set("api.url", server.URL)
+	defer resetProfileFlag()
+
+	tmpDir := t.TempDir()
+	configFile := tmpDir + "/config.yaml"
+	topLevelKey := "encryption-key-b64encoded: nMncUq8SsU7uz3cMucmFmgvUGXZ8LiBm8qx93hzrh6k=\n"
+	if err := os.WriteFile(configFile, []byte(topLevelKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "--profile", "prod", "init", "-t", "xxxxx"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := readConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := getConfigValue(content, "profiles.prod.api.token"); token != "xxxxx" {
+		t.Errorf("API token not stored in the profile, got: %v", token)
+	}
+	key, _ := getConfigValue(content, "profiles.prod.encryption-key-b64encoded")
+	if key == nil || key == "nMncUq8SsU7uz3cMucmFmgvUGXZ8LiBm8qx93hzrh6k=" {
+		t.Errorf("A new encryption key should have been generated for the profile, got: %v", key)
+	}
+	if _, exists := getConfigValue(content, "api.token"); exists {
+		t.Errorf("API token should not be stored at the top level")
+	}
+}
+
+func resetProfileFlag() {
+	flag := RootCmd.PersistentFlags().Lookup(flagProfile)
+	flag.Value.Set("")
+	flag.Changed = false
+}
+
+func TestProfileUse(t *testing.T) {
+	viper.Reset()
+
+	tmpDir := t.TempDir()
+	configFile := tmpDir + "/config.yaml"
+	config := "profiles:\n  prod:\n    api:\n      token: prod-token\n  staging:\n    api:\n      token: staging-token\n"
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "profile", "use", "staging"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Reset()
+	RootCmd.SetArgs([]string{"--config", configFile, "profile", "list"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("api.token"); got != "staging-token" {
+		t.Errorf("Settings from the default profile were not applied, got: %s", got)
+	}
+
+	RootCmd.SetArgs([]string{"--config", configFile, "profile", "use", "missing"})
+	if err := RootCmd.Execute(); err == nil {
+		t.Errorf("Using a missing profile should fail")
+	}
+}
+
+func TestConfigValueHelpers(t *testing.T) {
+	content := map[string]interface{}{}
+	setConfigValue(content, "profiles.prod.api.token", "xxxxx")
+
+	if value, ok := getConfigValue(content, "profiles.prod.api.token"); !ok || value != "xxxxx" {
+		t.Errorf("Result was incorrect, got: %v, want: xxxxx.", value)
+	}
+	if !unsetConfigValue(content, "profiles.prod.api.token") {
+		t.Errorf("An existing key should be removed")
+	}
+	if len(content) != 0 {
+		t.Errorf("Empty parent maps should be removed, got: %v", content)
+	}
+	if unsetConfigValue(content, "api.token") {
+		t.Errorf("Removing a missing key should return false")
+	}
+}
+
+func TestProfileKeyNotInherited(t *testing.T) {
+	viper.Reset()
+	defer resetProfileFlag()
+
+	tmpDir := t.TempDir()
+	keyFile := tmpDir + "/prod.key"
+	prodKey := "zZ8Zp9XQ7KxXHk8Vq3R1y8e1PzUzP1n6u3Qm0eV2s4E="
+	if err := os.WriteFile(keyFile, []byte(prodKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := tmpDir + "/config.yaml"
+	config := "encryption-key-b64encoded: " + testEncryptionKey + "\nprofiles:\n  prod:\n    encryption-key-file: " + keyFile + "\n"
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "--profile", "prod", "key", "list"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if key, err := getEncryptionKey(); err != nil || key != prodKey {
+		t.Errorf("The key of the profile should be used, got %q (%v)", key, err)
+	}
+	if !bytes.Contains(actual.Bytes(), []byte("key file "+keyFile)) {
+		t.Errorf("The key file of the profile should be listed:\n%s", actual)
+	}
+}
+
+func TestMissingProfile(t *testing.T) {
+	viper.Reset()
+	defer resetProfileFlag()
+
+	configFile := t.TempDir() + "/config.yaml"
+	config := "api:\n  token: default-token\nprofiles:\n  prod:\n    api:\n      token: prod-token\n"
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "--profile", "prdo", "list"})
+	err := RootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "Profile prdo not found") {
+		t.Errorf("A missing profile should fail instead of using the top level settings, got %v\n%s", err, actual)
+	}
+}
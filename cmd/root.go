@@ -28,6 +28,7 @@ const flagApiToken = "api-token"
 const flagShortApiToken = "t"
 const flagBackupId = "backup-id"
 const flagShortBackupId = "b"
+const flagProfile = "profile"
 
 var cfgFile string
 
@@ -40,6 +41,7 @@ var RootCmd = &cobra.Command{
 }
 
 func Execute() {
+	removeTempFilesOnSignal()
 	if err := RootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
@@ -47,7 +49,11 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	cobra.OnFinalize(removeTempFiles)
+	RootCmd.PersistentPreRunE = requireProfile
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.config/securae.yaml)")
+	RootCmd.PersistentFlags().IntVar(&encryptionKeyFd, flagEncryptionKeyFd, -1, "Read the encryption key from this file descriptor instead of the configuration.")
+	RootCmd.PersistentFlags().String(flagProfile, "", "Profile from the config file to use. It can also be specified using the environment variable SECURAE_PROFILE.")
 
 	RootCmd.AddGroup(&cobra.Group{ID: "backup", Title: "Backup Commands:"})
 	RootCmd.AddGroup(&cobra.Group{ID: "setup", Title: "Setup Commands:"})
@@ -71,6 +77,7 @@ func initConfig() {
 		viper.SetConfigFile(cfgFile)
 	}
 
+	viper.BindPFlag(flagProfile, RootCmd.PersistentFlags().Lookup(flagProfile))
 	viper.SetEnvPrefix("securae")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(`-`, `_`))
 	viper.AutomaticEnv()
@@ -82,6 +89,11 @@ func initConfig() {
 			log.Fatal(err)
 		}
 	}
+
+	if err := applyProfile(); err != nil {
+		log.Fatal(err)
+	}
+	cachedEncryptionKey.provider, cachedEncryptionKey.key = "", ""
 }
 
 func getBackupId() (string, error) {
@@ -95,14 +107,6 @@ func getBackupId() (string, error) {
 	return backupId, nil
 }
 
-func getEncryptionKey() (string, error) {
-	encryptionKeyB64Encoded := viper.GetString("encryption-key-b64encoded")
-	if encryptionKeyB64Encoded == "" {
-		return "", fmt.Errorf("An encryption key is mandatory.")
-	}
-	return encryptionKeyB64Encoded, nil
-}
-
 func fetchPresignedURL(url string, token string, data []byte) (string, error) {
 	tr := &http.Transport{
 		TLSHandshakeTimeout:   5 * time.Second,
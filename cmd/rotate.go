@@ -0,0 +1,550 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const flagKeepOldKey = "keep-old-key"
+
+// errClientSideEncrypted is returned for the files uploaded with client-side
+// encryption, whose data keys are wrapped with the current key. They are
+// left as they are, and read with the old key from the keyring.
+var errClientSideEncrypted = errors.New("uploaded with client-side encryption")
+
+// errAgeEncrypted is returned for the files encrypted with age, which don't
+// use the encryption key.
+var errAgeEncrypted = errors.New("encrypted with age")
+
+// errOtherKey is returned for the files uploaded with neither the current
+// key nor the new one, e.g. with a key of the keyring. They are left as they
+// are.
+var errOtherKey = errors.New("uploaded with another key")
+
+// rotationState keeps track of a key rotation so it can be resumed. It holds
+// the new key, which is only written to the configuration once every object
+// has been migrated.
+type rotationState struct {
+	OldKeyFingerprint string              `json:"old_key_fingerprint"`
+	NewKey            string              `json:"new_key"`
+	Migrated          map[string][]string `json:"migrated"`
+}
+
+var keyRotateCmd = &cobra.Command{
+	Use:   "rotate [flags]",
+	Short: "Re-encrypt all the files with a new encryption key",
+	Long: `Generate a new encryption key and re-encrypt the files with it. Each file is
+downloaded with the current key and uploaded again with the new one, without
+being written to disk.
+
+Without a backup ID, the files of every backup in the account are migrated.
+The progress is saved, so the command can be run again to resume an
+interrupted rotation. The new key replaces the current one in the
+configuration only when all the files have been migrated. The old key is
+discarded, as it may have leaked, unless --keep-old-key is used: it is then
+added to the keyring, in a keystore when the current key is in one.
+
+The files uploaded with client-side encryption are not re-encrypted, they
+are still read with the old key, which must be kept. Neither are the backups set to a key of the
+keyring with "securae key use", nor the files uploaded with another key.
+
+Only the latest version of each file is re-encrypted, the previous one is
+left under the old key. A backup holding several versions of a file can't be
+rotated, delete the older versions from the web interface first.`,
+	Example: `# rotate the key of every backup
+securae key rotate
+
+# rotate the key of a single backup
+securae key rotate --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456`,
+	Args: cobra.NoArgs,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(flagBackupId, cmd.Flags().Lookup(flagBackupId))
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		apiURL := viper.GetString("api.url")
+		apiToken := viper.GetString("api.token")
+
+		if ageOnly() {
+			return fmt.Errorf("The files encrypted with age don't use the encryption key, there is nothing to rotate.")
+		}
+		oldKey, err := getEncryptionKey()
+		if err != nil {
+			return err
+		}
+		if err := validateEncryptionKey(oldKey); err != nil {
+			return err
+		}
+
+		var backups []Backup
+		if viper.GetString(flagBackupId) != "" {
+			backupId, err := getBackupId()
+			if err != nil {
+				return err
+			}
+			backup, err := fetchBackupData(fmt.Sprintf("%s/backups/%s", apiURL, backupId), apiToken)
+			if err != nil {
+				return err
+			}
+			backups = []Backup{backup}
+		} else {
+			backups, err = fetchBackups(fmt.Sprintf("%s/backups", apiURL), apiToken)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The backups set to a key of the keyring with `key use` don't
+		// use the current key.
+		var rotated []Backup
+		for _, backup := range backups {
+			if label := viper.GetString("backup-keys." + backup.Id); label != "" {
+				cmd.Printf("[%s] Skipped (uses the key %s of the keyring)\n", backup.Name, label)
+				continue
+			}
+			rotated = append(rotated, backup)
+		}
+		backups = rotated
+
+		// The IDs of the chunks are derived from the key, they would no
+		// longer match the chunks after the rotation.
+		for _, backup := range backups {
+			for _, bo := range backup.Backupobjects {
+				if strings.HasPrefix(bo.Name, chunkPrefix) {
+					return fmt.Errorf("The backup %s contains chunked files, which can't be rotated yet: the IDs of their chunks are derived from the current key.", backup.Name)
+				}
+			}
+		}
+
+		statePath := rotationStatePath()
+		// Only the latest version of a file is migrated, the older ones
+		// would stay readable with the old key. Once started, the rotation
+		// itself leaves the previous version of each file behind.
+		if _, err := os.Stat(statePath); errors.Is(err, fs.ErrNotExist) {
+			for _, backup := range backups {
+				if names := versionedObjectNames(backup); len(names) > 0 {
+					return fmt.Errorf("The backup %s contains several versions of %s. Only the latest one can be re-encrypted: delete the older versions from the web interface before rotating the key.", backup.Name, strings.Join(names, ", "))
+				}
+			}
+		}
+		state, err := loadRotationState(statePath, oldKey)
+		if err != nil {
+			return err
+		}
+		newKeyFingerprint, _ := hashEncryptionKey(state.NewKey)
+		cmd.Printf("Rotating encryption key to %s (fingerprint)\n", newKeyFingerprint)
+
+		pending, kept, otherKey := 0, 0, 0
+		for _, backup := range backups {
+			names, replicating := backupObjectNames(backup)
+			for i, name := range names {
+				if state.isMigrated(backup.Id, name) {
+					continue
+				}
+				cmd.Printf("[%s] [%d/%d] Re-encrypting %s... ", backup.Name, i+1, len(names), name)
+				if replicating[name] {
+					cmd.Printf("Skipped (replicating)\n")
+					pending++
+					continue
+				}
+				err := rotateObject(apiURL, apiToken, backup.Id, name, oldKey, state.NewKey)
+				if errors.Is(err, errClientSideEncrypted) {
+					cmd.Printf("Skipped (client-side encryption)\n")
+					kept++
+					continue
+				}
+				if errors.Is(err, errAgeEncrypted) {
+					cmd.Printf("Skipped (age)\n")
+					continue
+				}
+				if errors.Is(err, errOtherKey) {
+					cmd.Printf("Skipped (another key)\n")
+					otherKey++
+					continue
+				}
+				if err != nil {
+					cmd.Printf("Error\n")
+					return errors.Join(err, fmt.Errorf("Run the command again to resume the rotation."))
+				}
+				cmd.Printf("OK\n")
+
+				state.Migrated[backup.Id] = append(state.Migrated[backup.Id], name)
+				if err := saveRotationState(statePath, state); err != nil {
+					return err
+				}
+			}
+		}
+
+		if pending > 0 {
+			return fmt.Errorf("%d files could not be migrated yet. Run the command again in a few minutes to resume the rotation.", pending)
+		}
+
+		keepOldKey, _ := cmd.Flags().GetBool(flagKeepOldKey)
+		if kept > 0 && !keepOldKey {
+			return fmt.Errorf("%d files uploaded with client-side encryption are still read with the old key. Run the command again with --%s to keep it in the keyring.", kept, flagKeepOldKey)
+		}
+		if err := saveRotatedKey(cmd, oldKey, state.NewKey, keepOldKey); err != nil {
+			return err
+		}
+		if kept > 0 {
+			cmd.Printf("%d files uploaded with client-side encryption were not re-encrypted, they are still read with the old key.\n", kept)
+		}
+		if otherKey > 0 {
+			cmd.Printf("%d files uploaded with another key were not re-encrypted, they are still read with their key from the keyring.\n", otherKey)
+		}
+		os.Remove(statePath)
+		return nil
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keyRotateCmd)
+	keyRotateCmd.Flags().Bool(flagKeepOldKey, false, "Keep the old key in the keyring, stored like the current one, to read the files that were not re-encrypted")
+	keyRotateCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) whose files will be migrated. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+}
+
+func rotationStatePath() string {
+	filename := "securae-rotation.json"
+	if profile := currentProfile(); profile != "" {
+		filename = fmt.Sprintf("securae-rotation-%s.json", profile)
+	}
+	return filepath.Join(filepath.Dir(viper.ConfigFileUsed()), filename)
+}
+
+// loadRotationState resumes the rotation in progress, or starts a new one
+// with a freshly generated key.
+func loadRotationState(filename string, oldKey string) (rotationState, error) {
+	oldKeyFingerprint, _ := hashEncryptionKey(oldKey)
+
+	var state rotationState
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return state, fmt.Errorf("error parsing %s: %w", filename, err)
+		}
+		if state.OldKeyFingerprint != oldKeyFingerprint {
+			return state, fmt.Errorf("A rotation from another encryption key is in progress, see %s.", filename)
+		}
+		if state.Migrated == nil {
+			state.Migrated = make(map[string][]string)
+		}
+		return state, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return state, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return state, err
+	}
+	state = rotationState{
+		OldKeyFingerprint: oldKeyFingerprint,
+		NewKey:            base64.StdEncoding.EncodeToString(key),
+		Migrated:          make(map[string][]string),
+	}
+	// The state must be on disk before any object is encrypted with the new
+	// key.
+	return state, saveRotationState(filename, state)
+}
+
+// saveRotationState writes the state atomically: until the rotation is
+// complete, it holds the only copy of the new key, the one of the migrated
+// files.
+func saveRotationState(filename string, state rotationState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filename, data); err != nil {
+		return fmt.Errorf("error saving rotation progress: %w", err)
+	}
+	return nil
+}
+
+func (state rotationState) isMigrated(backupId string, name string) bool {
+	for _, migrated := range state.Migrated[backupId] {
+		if migrated == name {
+			return true
+		}
+	}
+	return false
+}
+
+// backupObjectNames returns the names of the files in a backup, and which
+// ones are still being replicated. Downloads are made by name, so each name
+// is only listed once.
+func backupObjectNames(backup Backup) ([]string, map[string]bool) {
+	var names []string
+	seen := make(map[string]bool)
+	replicating := make(map[string]bool)
+	for _, bo := range backup.Backupobjects {
+		if !seen[bo.Name] {
+			seen[bo.Name] = true
+			names = append(names, bo.Name)
+		}
+		if bo.Size == 0 {
+			replicating[bo.Name] = true
+		}
+	}
+	return names, replicating
+}
+
+// versionedObjectNames returns the names of the files uploaded several times
+// in a backup.
+func versionedObjectNames(backup Backup) []string {
+	var names []string
+	versions := make(map[string]int)
+	for _, bo := range backup.Backupobjects {
+		versions[bo.Name]++
+		if versions[bo.Name] == 2 {
+			names = append(names, bo.Name)
+		}
+	}
+	return names
+}
+
+func rotateObject(apiURL string, apiToken string, backupId string, name string, oldKey string, newKey string) error {
+	postData, err := json.Marshal(map[string]interface{}{"filename": name, "include_checksum": true})
+	if err != nil {
+		return err
+	}
+
+	metadataURL := fmt.Sprintf("%s/backups/%s/metadata/", apiURL, backupId)
+	presignedURL, err := fetchPresignedURL(metadataURL, apiToken, postData)
+	if err != nil {
+		return err
+	}
+	headers, encryption, err := fetchEncryptedObjectMetadata(presignedURL, oldKey)
+	if err != nil {
+		// It may have been migrated by an interrupted run, just before
+		// saving the progress.
+		_, errNewKey := fetchChecksum(presignedURL, newKey)
+		if errNewKey == nil {
+			return nil
+		}
+		if strings.Contains(err.Error(), "does not match") && strings.Contains(errNewKey.Error(), "does not match") {
+			return errOtherKey
+		}
+		return err
+	}
+	switch encryption {
+	case encryptionEnvelope:
+		return errClientSideEncrypted
+	case encryptionAge:
+		return errAgeEncrypted
+	}
+	checksum := headers.Get("X-Amz-Checksum-Sha256")
+
+	preDownloadURL := fmt.Sprintf("%s/backups/%s/predownload/", apiURL, backupId)
+	downloadURL, err := fetchPresignedURL(preDownloadURL, apiToken, postData)
+	if err != nil {
+		return err
+	}
+
+	size, err := fetchObjectSize(downloadURL, oldKey)
+	if err != nil {
+		return err
+	}
+
+	preUploadData, err := json.Marshal(map[string]interface{}{"filename": name, "size": size, "checksum": checksum})
+	if err != nil {
+		return err
+	}
+	preUploadURL := fmt.Sprintf("%s/backups/%s/preupload/", apiURL, backupId)
+	uploadURL, err := fetchPresignedURL(preUploadURL, apiToken, preUploadData)
+	if err != nil {
+		return err
+	}
+
+	return reencryptObject(downloadURL, uploadURL, oldKey, newKey, size, checksum)
+}
+
+// fetchObjectSize gets the size of an object using a download URL, reading
+// only the first byte.
+func fetchObjectSize(url string, encryptionKeyB64Encoded string) (int64, error) {
+	tr := &http.Transport{
+		TLSHandshakeTimeout:   5 * time.Second,
+		IdleConnTimeout:       5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+	}
+	client := &http.Client{Transport: tr}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	setEncryptionHeaders(req.Header, encryptionKeyB64Encoded)
+	req.Header.Set("Range", "bytes=0-0")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start, end, size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+			return 0, fmt.Errorf("invalid Content-Range header: %q", resp.Header.Get("Content-Range"))
+		}
+		return size, nil
+	case http.StatusRequestedRangeNotSatisfiable, http.StatusOK:
+		// Empty object, or a server ignoring the range.
+		return resp.ContentLength, nil
+	default:
+		return 0, fmt.Errorf("status code: %s", resp.Status)
+	}
+}
+
+// reencryptObject streams an object from a download URL, decrypted with the
+// old key, to an upload URL where it is encrypted with the new key. The
+// checksum lets the storage provider verify the uploaded content.
+func reencryptObject(downloadURL string, uploadURL string, oldKey string, newKey string, size int64, checksum string) error {
+	tr := &http.Transport{
+		TLSHandshakeTimeout:   5 * time.Second,
+		IdleConnTimeout:       5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+	}
+	client := &http.Client{Transport: tr}
+
+	req, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	setEncryptionHeaders(req.Header, oldKey)
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error downloading file: %s", resp.Status)
+	}
+
+	request, err := http.NewRequest(http.MethodPut, uploadURL, resp.Body)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "multipart/form-data")
+	setEncryptionHeaders(request.Header, newKey)
+	if checksum != "" {
+		request.Header.Set("X-Amz-Checksum-SHA256", checksum)
+	}
+	request.Header.Set("User-Agent", userAgent)
+	// Keep the metadata, e.g. the compression codec.
+	for k, v := range resp.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			request.Header[k] = v
+		}
+	}
+
+	uploadResp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer uploadResp.Body.Close()
+
+	if uploadResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error uploading file: %s", uploadResp.Status)
+	}
+	return nil
+}
+
+// saveRotatedKey stores the new key where the current one was found. Keys
+// coming from external sources can't be updated by the CLI. With
+// `keepOldKey`, the old key is added to the keyring, stored like the current
+// one: in the config file, or in a keystore next to the current one.
+func saveRotatedKey(cmd *cobra.Command, oldKey string, newKey string, keepOldKey bool) error {
+	keyring, err := getKeyring()
+	if err != nil {
+		return err
+	}
+	oldKeyFingerprint, _ := hashEncryptionKey(oldKey)
+	label := ""
+	for _, entry := range keyring {
+		if entry.Fingerprint == oldKeyFingerprint {
+			label = entry.Label
+		}
+	}
+	keep := keepOldKey && label == ""
+	if keep {
+		label = "rotated-" + time.Now().UTC().Format("20060102-150405")
+	}
+
+	switch provider := newKeyProvider(keySetting).(type) {
+	case keystoreKeyProvider:
+		passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", provider.filename), false)
+		if err != nil {
+			return err
+		}
+		if _, err := readKeystore(provider.filename, passphrase); err != nil {
+			return err
+		}
+		if keep {
+			ext := filepath.Ext(provider.filename)
+			filename := strings.TrimSuffix(provider.filename, ext) + "-" + label + ext
+			if err := writeKeystore(filename, oldKey, passphrase); err != nil {
+				return err
+			}
+			if err := appendToKeyring(keyringEntry{Label: label, Keystore: filename, Fingerprint: oldKeyFingerprint}); err != nil {
+				return err
+			}
+		}
+		if err := writeKeystore(provider.filename, newKey, passphrase); err != nil {
+			return err
+		}
+	case inlineKeyProvider:
+		if keep {
+			if err := addToKeyring(label, oldKey); err != nil {
+				return err
+			}
+		}
+		err := updateConfigFile(viper.ConfigFileUsed(), func(content map[string]interface{}) error {
+			setConfigValue(content, profileConfigKey("encryption-key-b64encoded"), newKey)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if os.Getenv("SECURAE_ENCRYPTION_KEY_B64ENCODED") != "" {
+			cmd.Println("WARNING: The environment variable SECURAE_ENCRYPTION_KEY_B64ENCODED still holds the old key, update it.")
+		}
+	default:
+		cmd.Printf("WARNING: The key from %s must be replaced with the new one.\n", provider.Name())
+		if keep {
+			cmd.Printf("The old key can't be stored in %s by the CLI, keep it there under another name if you still need it.\n", provider.Name())
+			label = ""
+		}
+	}
+
+	cmd.Println("All the files were migrated to the new encryption key:")
+	cmd.Println("\n" + newKey + "\n")
+	cmd.Println("WARNING: Please save this encryption key in a safe place. You will need it to test your backups or to recover your files in case of disaster.")
+	if label == "" {
+		cmd.Println("The old key was not kept. The previous versions of the files are still encrypted with it and can no longer be read: delete them from the web interface.")
+	} else {
+		cmd.Printf("The old key is in the keyring as %s. The previous versions of the files are still encrypted with it: delete them from the web interface, then remove the key with \"securae key remove %s\".\n", label, label)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestKeyRotate(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db-1.sql.gz", []byte("first dump"), testEncryptionKey)
+	storage.put("db-2.sql.gz", []byte("second dump"), testEncryptionKey)
+
+	configFile := storage.writeConfig(t, testKeyConfig)
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "key", "rotate", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+
+	content, err := readConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, _ := getConfigValue(content, "encryption-key-b64encoded")
+	if newKey == testEncryptionKey {
+		t.Fatalf("The encryption key in the config file was not replaced")
+	}
+	newKeyMD5, _ := hashEncryptionKey(newKey.(string))
+	for _, name := range []string{"db-1.sql.gz", "db-2.sql.gz"} {
+		if object := storage.get(name); object.KeyMD5 != newKeyMD5 {
+			t.Errorf("%s was not re-encrypted with the new key", name)
+		}
+	}
+	if string(storage.get("db-2.sql.gz").Data) != "second dump" {
+		t.Errorf("Content was modified by the rotation")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(configFile), "securae-rotation.json")); err == nil {
+		t.Errorf("The rotation state should be removed once finished")
+	}
+	if keyring, exists := getConfigValue(content, "keyring"); exists {
+		t.Errorf("The old key should only be kept with --keep-old-key, got %v", keyring)
+	}
+}
+
+func TestKeyRotateKeepOldKeyInKeystore(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql.gz", []byte("dump"), testEncryptionKey)
+	t.Setenv(envKeystorePassphrase, "correct horse")
+
+	keystoreFile := filepath.Join(t.TempDir(), "securae.key")
+	if err := writeKeystore(keystoreFile, testEncryptionKey, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	configFile := storage.writeConfig(t, "encryption-key-keystore: "+keystoreFile+"\n")
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer keyRotateCmd.Flags().Set(flagKeepOldKey, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "key", "rotate", "--keep-old-key"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+
+	config, _ := os.ReadFile(configFile)
+	if strings.Contains(string(config), testEncryptionKey) {
+		t.Errorf("The old key should not be written in clear to the config file:\n%s", config)
+	}
+	viper.Reset()
+	viper.SetConfigFile(configFile)
+	viper.ReadInConfig()
+	keyring, err := getKeyring()
+	if err != nil || len(keyring) != 1 || keyring[0].Keystore == "" {
+		t.Fatalf("The old key should be kept in a keystore, got %v (%v)", keyring, err)
+	}
+	if key, err := keyring[0].encryptionKey(); err != nil || key != testEncryptionKey {
+		t.Errorf("The keystore of the keyring should hold the old key, got %v", err)
+	}
+}
+
+func TestKeyRotateSeveralVersions(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql.gz", []byte("first dump"), testEncryptionKey)
+	storage.put("db.sql.gz", []byte("second dump"), testEncryptionKey)
+
+	configFile := storage.writeConfig(t, testKeyConfig)
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "key", "rotate", "--backup-id", testBackupId})
+	err := RootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "several versions of db.sql.gz") {
+		t.Fatalf("A file with several versions should not be rotated, got %v\n%s", err, actual)
+	}
+	keyMD5, _ := hashEncryptionKey(testEncryptionKey)
+	if object := storage.get("db.sql.gz"); object.KeyMD5 != keyMD5 {
+		t.Errorf("The file should not be re-encrypted")
+	}
+}
+
+func TestLoadRotationStateFromAnotherKey(t *testing.T) {
+	statePath := t.TempDir() + "/securae-rotation.json"
+	state, err := loadRotationState(statePath, testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := loadRotationState(statePath, testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.NewKey != state.NewKey {
+		t.Errorf("A resumed rotation must keep the same new key")
+	}
+	state.Migrated[testBackupId] = []string{"db.sql"}
+	if err := saveRotationState(statePath, state); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(statePath)); len(entries) != 1 {
+		t.Errorf("The state should be replaced by a renamed temporary file, got %d files", len(entries))
+	}
+
+	if _, err := loadRotationState(statePath, state.NewKey); err == nil {
+		t.Errorf("Resuming a rotation with another key should fail")
+	}
+}
+
+func TestKeyRotateSkipsOtherKeys(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql.gz", []byte("dump"), testEncryptionKey)
+	storage.put("old.sql.gz", []byte("old dump"), testKeyringKey)
+
+	configFile := storage.writeConfig(t, testKeyConfig+"keyring:\n  - label: old\n    key: "+testKeyringKey+"\n")
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "key", "rotate"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("The files uploaded with another key should not stop the rotation: %v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "Re-encrypting old.sql.gz... Skipped (another key)") {
+		t.Errorf("The file uploaded with another key should be reported:\n%s", actual)
+	}
+	keyMD5, _ := hashEncryptionKey(testKeyringKey)
+	if object := storage.get("old.sql.gz"); object.KeyMD5 != keyMD5 {
+		t.Errorf("The file uploaded with another key should be left as it is")
+	}
+
+	// A backup set to a key of the keyring is left out.
+	storage = newMockStorage()
+	defer storage.Close()
+	storage.put("new.sql.gz", []byte("new dump"), testKeyringKey)
+	configFile = storage.writeConfig(t, testKeyConfig+"keyring:\n  - label: old\n    key: "+testKeyringKey+"\nbackup-keys:\n  "+testBackupId+": old\n")
+	actual.Reset()
+	RootCmd.SetArgs([]string{"--config", configFile, "key", "rotate"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "[test] Skipped (uses the key old of the keyring)") || strings.Contains(actual.String(), "Re-encrypting") {
+		t.Errorf("The backup set to a key of the keyring should be skipped:\n%s", actual)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// A secureBuffer holds key material in memory locked with mlock, so it is
+// never written to swap, and zeroed when it is destroyed. Locking is best
+// effort: it may fail when RLIMIT_MEMLOCK is too low, the buffer is still
+// zeroed.
+//
+// The base64 key is still a Go string, which can't be zeroed: in the
+// configuration, in the SSE-C headers, and as returned by every key provider.
+// Reading it from a file, a file descriptor or a command leaves copies of it
+// in memory until they are garbage collected. Only the raw key bytes, and the
+// keys derived from them, live in these buffers.
+type secureBuffer struct {
+	// data is a prefix of memory, the region that is locked.
+	data   []byte
+	memory []byte
+	locked bool
+}
+
+func newSecureBuffer(size int) *secureBuffer {
+	memory := make([]byte, size)
+	return &secureBuffer{data: memory, memory: memory, locked: lockMemory(memory) == nil}
+}
+
+func (b *secureBuffer) Bytes() []byte {
+	return b.data
+}
+
+// Destroy zeroes and unlocks the buffer. It can't be used afterwards.
+func (b *secureBuffer) Destroy() {
+	if b == nil || b.memory == nil {
+		return
+	}
+	zeroBytes(b.memory)
+	if b.locked {
+		unlockMemory(b.memory)
+	}
+	b.data, b.memory = nil, nil
+}
+
+func zeroBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// decodeKey decodes a base64 key into a secure buffer. The error never
+// includes the key.
+func decodeKey(encryptionKeyB64Encoded string) (*secureBuffer, error) {
+	b := newSecureBuffer(base64.StdEncoding.DecodedLen(len(encryptionKeyB64Encoded)))
+	n, err := base64.StdEncoding.Decode(b.data, []byte(encryptionKeyB64Encoded))
+	if err != nil {
+		b.Destroy()
+		return nil, fmt.Errorf("error decoding base64 key: %v", err)
+	}
+	b.data = b.data[:n]
+	return b, nil
+}
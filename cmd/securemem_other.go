@@ -0,0 +1,15 @@
+//go:build !unix
+
+/*
+Copyright 2024-2025 Securae Backup
+*/
+
+package cmd
+
+import "errors"
+
+func lockMemory(data []byte) error {
+	return errors.New("memory locking is not supported on this platform")
+}
+
+func unlockMemory(data []byte) {}
@@ -0,0 +1,113 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSecureBufferDestroy(t *testing.T) {
+	key, err := decodeKey(testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := key.Bytes()
+	if base64.StdEncoding.EncodeToString(memory) != testEncryptionKey {
+		t.Fatalf("The key was not decoded")
+	}
+	key.Destroy()
+	if !bytes.Equal(memory, make([]byte, len(memory))) {
+		t.Errorf("The key should be zeroed once destroyed")
+	}
+	if key.Bytes() != nil {
+		t.Errorf("A destroyed buffer should not be usable")
+	}
+}
+
+// assertNoKey fails when the error includes the key, in base64 or as words.
+func assertNoKey(t *testing.T, name string, err error) {
+	t.Helper()
+	if err == nil {
+		t.Errorf("%s: an error was expected", name)
+		return
+	}
+	secrets := []string{testEncryptionKey, testEncryptionKey[:16]}
+	words, _ := keyToMnemonic(testEncryptionKey)
+	secrets = append(secrets, words...)
+	for _, secret := range secrets {
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("%s: the error includes key material %q: %s", name, secret, err)
+		}
+	}
+}
+
+func TestKeyNeverInErrors(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+	storage.put("db.sql.gz", []byte("dump"), testKeyringKey)
+
+	viper.Reset()
+	presignedURL := storage.URL + "/storage/db.sql.gz"
+	_, err := fetchChecksum(presignedURL, testEncryptionKey)
+	assertNoKey(t, "fetchChecksum", err)
+	err = downloadFile(presignedURL, testEncryptionKey, filepath.Join(t.TempDir(), "db.sql.gz"))
+	assertNoKey(t, "downloadFile", err)
+
+	assertNoKey(t, "validateEncryptionKey", validateEncryptionKey(testEncryptionKey[:40]))
+	assertNoKey(t, "validateEncryptionKey", validateEncryptionKey(testEncryptionKey+"!"))
+
+	encrypted := new(bytes.Buffer)
+	if err := encryptEnvelope(encrypted, strings.NewReader("dump"), testKeyringKey); err != nil {
+		t.Fatal(err)
+	}
+	assertNoKey(t, "decryptEnvelope", decryptEnvelope(new(bytes.Buffer), encrypted, testEncryptionKey))
+
+	keystoreFile := filepath.Join(t.TempDir(), "securae.key")
+	if err := writeKeystore(keystoreFile, testEncryptionKey, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readKeystore(keystoreFile, "wrong horse")
+	assertNoKey(t, "readKeystore", err)
+
+	words, _ := keyToMnemonic(testEncryptionKey)
+	words[5] = words[5] + "x"
+	_, err = mnemonicToKey(strings.Join(words, " "))
+	assertNoKey(t, "mnemonicToKey", err)
+	words[5] = "zzzz"
+	_, err = mnemonicToKey(strings.Join(words, " "))
+	assertNoKey(t, "mnemonicToKey", err)
+}
+
+func TestCreateTempFile(t *testing.T) {
+	viper.Reset()
+	parent := t.TempDir()
+	viper.Set(configTempDir, parent)
+
+	file, err := createTempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if filepath.Dir(filepath.Dir(file.Name())) != parent {
+		t.Errorf("The file should be created in a directory under %s, got: %s", parent, file.Name())
+	}
+	if fi, _ := os.Stat(file.Name()); fi.Mode().Perm() != 0600 {
+		t.Errorf("Temporary file permissions should be 0600, got: %o", fi.Mode().Perm())
+	}
+	if fi, _ := os.Stat(filepath.Dir(file.Name())); fi.Mode().Perm() != 0700 {
+		t.Errorf("Temporary directory permissions should be 0700, got: %o", fi.Mode().Perm())
+	}
+
+	removeTempFiles()
+	if _, err := os.Stat(filepath.Dir(file.Name())); !os.IsNotExist(err) {
+		t.Errorf("The temporary directory should be removed")
+	}
+}
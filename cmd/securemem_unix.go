@@ -0,0 +1,22 @@
+//go:build unix
+
+/*
+Copyright 2024-2025 Securae Backup
+*/
+
+package cmd
+
+import "golang.org/x/sys/unix"
+
+func lockMemory(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return unix.Mlock(data)
+}
+
+func unlockMemory(data []byte) {
+	if len(data) > 0 {
+		unix.Munlock(data)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Shamir's secret sharing over GF(2^8), byte by byte, using the same field
+// as AES (x^8 + x^4 + x^3 + x + 1).
+
+const sharePrefix = "SECURAE-SHARE"
+
+var gfExp [510]byte
+var gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+		x = gfMulSlow(x, 3)
+	}
+}
+
+func gfMulSlow(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// A keyShare is one of the parts of a split key. It carries the fingerprint
+// of the whole key, so a wrong combination is detected.
+type keyShare struct {
+	Index       int
+	Threshold   int
+	Fingerprint string
+	Data        []byte
+}
+
+func splitSecret(secret []byte, shares int, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > shares || shares > 255 {
+		return nil, fmt.Errorf("The threshold must be between 2 and the number of shares, which can't be more than 255.")
+	}
+
+	result := make([][]byte, shares)
+	for i := range result {
+		result[i] = make([]byte, len(secret))
+	}
+	coefficients := make([]byte, threshold)
+	for b, value := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = value
+		for i := 0; i < shares; i++ {
+			// Horner's method at x = i + 1
+			x := byte(i + 1)
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			result[i][b] = y
+		}
+	}
+	return result, nil
+}
+
+// combineSecret interpolates the shares at x = 0. `xs` are the share indexes.
+func combineSecret(xs []byte, shares [][]byte) []byte {
+	secret := make([]byte, len(shares[0]))
+	for b := range secret {
+		var value byte
+		for i, xi := range xs {
+			// Lagrange basis polynomial at 0
+			basis := byte(1)
+			for j, xj := range xs {
+				if i != j {
+					basis = gfMul(basis, gfDiv(xj, xj^xi))
+				}
+			}
+			value ^= gfMul(shares[i][b], basis)
+		}
+		secret[b] = value
+	}
+	return secret
+}
+
+func splitEncryptionKey(encryptionKeyB64Encoded string, shares int, threshold int) ([]keyShare, error) {
+	encryptionKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	defer encryptionKey.Destroy()
+	fingerprint, _ := hashEncryptionKey(encryptionKeyB64Encoded)
+
+	parts, err := splitSecret(encryptionKey.Bytes(), shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+	var result []keyShare
+	for i, part := range parts {
+		result = append(result, keyShare{Index: i + 1, Threshold: threshold, Fingerprint: fingerprint, Data: part})
+	}
+	return result, nil
+}
+
+func combineEncryptionKey(shares []keyShare) (string, error) {
+	if len(shares) == 0 {
+		return "", fmt.Errorf("No shares were found.")
+	}
+	threshold := shares[0].Threshold
+	fingerprint := shares[0].Fingerprint
+	if threshold < 2 || threshold > 255 {
+		return "", fmt.Errorf("The threshold %d of the shares is not valid, it must be between 2 and 255.", threshold)
+	}
+
+	var xs []byte
+	var parts [][]byte
+	seen := make(map[int]bool)
+	for _, share := range shares {
+		if share.Fingerprint != fingerprint || share.Threshold != threshold {
+			return "", fmt.Errorf("The shares belong to different keys.")
+		}
+		if len(share.Data) != len(shares[0].Data) {
+			return "", fmt.Errorf("The shares don't have the same length, one of them is not valid.")
+		}
+		if seen[share.Index] {
+			continue
+		}
+		seen[share.Index] = true
+		xs = append(xs, byte(share.Index))
+		parts = append(parts, share.Data)
+	}
+	if len(xs) < threshold {
+		return "", fmt.Errorf("%d different shares are needed to rebuild the key, only %d were given.", threshold, len(xs))
+	}
+
+	encryptionKeyB64Encoded := base64.StdEncoding.EncodeToString(combineSecret(xs, parts))
+	if combined, _ := hashEncryptionKey(encryptionKeyB64Encoded); combined != fingerprint {
+		return "", fmt.Errorf("The rebuilt key doesn't match the fingerprint %s of the shares.", fingerprint)
+	}
+	return encryptionKeyB64Encoded, nil
+}
+
+// String encodes a share on a single line, ending with a checksum to detect
+// typing mistakes in the share itself.
+func (share keyShare) String() string {
+	body := fmt.Sprintf("%s:%d/%d:%s:%s", sharePrefix, share.Index, share.Threshold, share.Fingerprint, base64.StdEncoding.EncodeToString(share.Data))
+	return body + ":" + shareChecksum(body)
+}
+
+func shareChecksum(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:4])
+}
+
+func parseKeyShare(line string) (keyShare, error) {
+	var share keyShare
+	line = strings.TrimSpace(line)
+	separator := strings.LastIndex(line, ":")
+	if separator < 0 || shareChecksum(line[:separator]) != line[separator+1:] {
+		return share, fmt.Errorf("The share %q is not valid, please check it for typing mistakes.", line)
+	}
+
+	fields := strings.Split(line[:separator], ":")
+	if len(fields) != 4 || fields[0] != sharePrefix {
+		return share, fmt.Errorf("The share %q is not valid.", line)
+	}
+	index, threshold, found := strings.Cut(fields[1], "/")
+	if !found {
+		return share, fmt.Errorf("The share %q is not valid.", line)
+	}
+	var err error
+	if share.Index, err = strconv.Atoi(index); err != nil || share.Index < 1 || share.Index > 255 {
+		return share, fmt.Errorf("The share %q is not valid.", line)
+	}
+	if share.Threshold, err = strconv.Atoi(threshold); err != nil {
+		return share, fmt.Errorf("The share %q is not valid.", line)
+	}
+	share.Fingerprint = fields[2]
+	if share.Data, err = base64.StdEncoding.DecodeString(fields[3]); err != nil {
+		return share, fmt.Errorf("The share %q is not valid.", line)
+	}
+	return share, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitAndCombineEncryptionKey(t *testing.T) {
+	shares, err := splitEncryptionKey(testEncryptionKey, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	combinations := [][]int{{0, 1, 2}, {0, 2, 4}, {4, 3, 1}, {0, 1, 2, 3, 4}}
+	for _, combination := range combinations {
+		var subset []keyShare
+		for _, i := range combination {
+			parsed, err := parseKeyShare(shares[i].String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			subset = append(subset, parsed)
+		}
+		key, err := combineEncryptionKey(subset)
+		if err != nil {
+			t.Fatalf("Shares %v: %v", combination, err)
+		}
+		if key != testEncryptionKey {
+			t.Errorf("Shares %v: got: %s, want: %s.", combination, key, testEncryptionKey)
+		}
+	}
+
+	if _, err := combineEncryptionKey(shares[:2]); err == nil {
+		t.Errorf("Combining fewer shares than the threshold should fail")
+	}
+}
+
+func TestCombineEncryptionKeyDetectsWrongShares(t *testing.T) {
+	shares, _ := splitEncryptionKey(testEncryptionKey, 3, 2)
+	otherShares, _ := splitEncryptionKey(testKeyringKey, 3, 2)
+
+	if _, err := combineEncryptionKey([]keyShare{shares[0], otherShares[1]}); err == nil {
+		t.Errorf("Shares from different keys should be rejected")
+	}
+
+	// A share with the right fingerprint but corrupted data
+	corrupted := shares[1]
+	corrupted.Data = append([]byte{}, shares[1].Data...)
+	corrupted.Data[0] ^= 0xff
+	if _, err := combineEncryptionKey([]keyShare{shares[0], corrupted}); err == nil {
+		t.Errorf("A corrupted share should be detected by the fingerprint")
+	}
+
+	short := shares[1]
+	short.Data = shares[1].Data[:1]
+	if _, err := combineEncryptionKey([]keyShare{shares[0], short}); err == nil {
+		t.Errorf("A truncated share should be rejected")
+	}
+	if _, err := combineEncryptionKey([]keyShare{shares[1], shares[0]}); err != nil {
+		t.Errorf("The order of the shares should not matter, got %v", err)
+	}
+
+	single := shares[0]
+	single.Threshold = 1
+	if _, err := combineEncryptionKey([]keyShare{single}); err == nil {
+		t.Errorf("A share with a threshold of 1 should be rejected")
+	}
+}
+
+func TestParseKeyShareChecksum(t *testing.T) {
+	shares, _ := splitEncryptionKey(testEncryptionKey, 3, 2)
+	line := shares[0].String()
+	typo := strings.Replace(line, ":1/2:", ":2/2:", 1)
+	if _, err := parseKeyShare(typo); err == nil {
+		t.Errorf("A typing mistake in a share should be detected")
+	}
+}
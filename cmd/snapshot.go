@@ -0,0 +1,710 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A snapshot is a directory uploaded as a tar archive, with a manifest
+// listing the paths, modes, owners, modification times and SHA-256 hashes of
+// its files. The manifest is signed with a key derived from the master key,
+// and the files are verified against it when they are restored, so they keep
+// the metadata of the manifest and not the one of the archive.
+
+const flagInclude = "include"
+const flagName = "name"
+
+const snapshotManifestVersion = 1
+const snapshotArchiveSuffix = ".tar"
+const snapshotManifestSuffix = ".manifest.json"
+
+type snapshotEntry struct {
+	Path    string      `json:"path"`
+	Type    string      `json:"type"`
+	Mode    fs.FileMode `json:"mode"`
+	Uid     int         `json:"uid"`
+	Gid     int         `json:"gid"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	Sha256  string      `json:"sha256,omitempty"`
+	Link    string      `json:"link,omitempty"`
+}
+
+type snapshotManifest struct {
+	Version   int             `json:"version"`
+	Id        string          `json:"id"`
+	Source    string          `json:"source"`
+	CreatedAt time.Time       `json:"created_at"`
+	Files     []snapshotEntry `json:"files"`
+	Signature string          `json:"signature"`
+}
+
+var snapshotCmd = &cobra.Command{
+	Use:     "snapshot",
+	Short:   "Back up and restore directories",
+	Args:    cobra.NoArgs,
+	GroupID: "backup",
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create [directory] [flags]",
+	Short: "Upload a snapshot of a directory",
+	Long: `Upload a directory as a tar archive, along with a signed manifest of its files.
+
+The files matching the patterns of the .securaeignore files of the directory,
+which use the .gitignore format, are excluded. Use ls-files to list the files
+that will be uploaded.
+
+The snapshot ID is the name of the snapshot followed by its creation date, and
+the snapshot is stored as two files in the backup: <id>.tar and
+<id>.manifest.json.`,
+	Example: `securae snapshot create ./app --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
+# compress the archive with zstd
+securae snapshot create /var/www --name www --compress zstd --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+			return fmt.Errorf("A directory must be specified.")
+		}
+		return nil
+	},
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(flagBackupId, cmd.Flags().Lookup(flagBackupId))
+		viper.BindPFlag(flagCompress, cmd.Flags().Lookup(flagCompress))
+		viper.BindPFlag(flagCompressLevel, cmd.Flags().Lookup(flagCompressLevel))
+		viper.BindPFlag(flagMerkle, cmd.Flags().Lookup(flagMerkle))
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		apiURL := viper.GetString("api.url")
+		apiToken := viper.GetString("api.token")
+
+		backupId, err := getBackupId()
+		if err != nil {
+			return err
+		}
+		if ageEncryption() {
+			return errSnapshotAge
+		}
+		encryptionKeyB64Encoded, err := getUploadEncryptionKey(backupId)
+		if err != nil {
+			return err
+		}
+		codec := viper.GetString(flagCompress)
+		if err := validateCompression(codec); err != nil {
+			return err
+		}
+
+		source, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(source); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory.", args[0])
+		}
+		name, _ := cmd.Flags().GetString(flagName)
+		if name == "" {
+			name = filepath.Base(source)
+		}
+		manifest := snapshotManifest{
+			Version:   snapshotManifestVersion,
+			Source:    source,
+			CreatedAt: time.Now().UTC().Truncate(time.Second),
+		}
+		manifest.Id = fmt.Sprintf("%s-%s", name, manifest.CreatedAt.Format("20060102T150405Z"))
+		excludeFrom, _ := cmd.Flags().GetStringArray(flagExcludeFrom)
+		matcher, err := newIgnoreMatcher(source, excludeFrom)
+		if err != nil {
+			return err
+		}
+
+		var index *tarIndex
+		if withIndex, _ := cmd.Flags().GetBool(flagTarIndex); withIndex {
+			if codec != "" {
+				return fmt.Errorf("--tar-index can't be used with compressed archives, they can't be read at random positions.")
+			}
+			index = &tarIndex{}
+		}
+
+		cmd.Printf("[%s] Creating archive... ", manifest.Id)
+		streamed := sha256.New()
+		archive, err := prepareObject(encryptionKeyB64Encoded, codec, viper.GetInt(flagCompressLevel), func(w io.Writer) error {
+			var err error
+			manifest.Files, err = writeSnapshotArchive(io.MultiWriter(w, streamed), matcher, index)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		defer os.Remove(archive.Name())
+		defer archive.Close()
+		cmd.Printf("OK (%d files)\n", len(manifest.Files))
+
+		archiveChecksum := base64.StdEncoding.EncodeToString(streamed.Sum(nil))
+		sourceMAC, err := sourceChecksumMAC(encryptionKeyB64Encoded, archiveChecksum)
+		if err != nil {
+			return err
+		}
+		metadata := map[string]string{metadataSourceMAC: sourceMAC}
+		if codec != "" {
+			metadata[metadataCompression] = codec
+		}
+		// The sidecars are uploaded first, so the archive is the latest file
+		// of the backup.
+		if index != nil {
+			index.ArchiveChecksum = archiveChecksum
+			cmd.Printf("[%s] Uploading index... ", manifest.Id)
+			if err := uploadTarIndex(apiURL, apiToken, backupId, encryptionKeyB64Encoded, manifest.Id+snapshotArchiveSuffix, *index); err != nil {
+				return err
+			}
+			cmd.Printf("OK\n")
+		}
+
+		if err := signSnapshotManifest(&manifest, encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		manifestFile, err := prepareObject(encryptionKeyB64Encoded, "", 0, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		defer os.Remove(manifestFile.Name())
+		defer manifestFile.Close()
+		cmd.Printf("[%s] Uploading manifest... ", manifest.Id)
+		if err := uploadObject(apiURL, apiToken, backupId, encryptionKeyB64Encoded, manifest.Id+snapshotManifestSuffix, manifestFile, nil); err != nil {
+			return err
+		}
+		cmd.Printf("OK\n")
+
+		if merkleEnabled() {
+			cmd.Printf("[%s] Uploading block manifest... ", manifest.Id)
+			root, err := uploadMerkleManifest(apiURL, apiToken, backupId, encryptionKeyB64Encoded, manifest.Id+snapshotArchiveSuffix, archive)
+			if err != nil {
+				return err
+			}
+			metadata[metadataMerkleRoot] = root
+			cmd.Printf("OK\n")
+		}
+		cmd.Printf("[%s] Uploading archive... ", manifest.Id)
+		if err := uploadObject(apiURL, apiToken, backupId, encryptionKeyB64Encoded, manifest.Id+snapshotArchiveSuffix, archive, metadata); err != nil {
+			return err
+		}
+		cmd.Printf("OK\n")
+
+		cmd.Printf("Snapshot %s created.\n", manifest.Id)
+		return nil
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore [snapshot ID] [directory] [flags]",
+	Short: "Restore the files of a snapshot",
+	Long: `Restore the files of a snapshot into a directory, by default the current one.
+
+The files are verified against the signed manifest of the snapshot, and get
+back their mode and modification time. Their owner is restored when the
+command is run as root.
+
+With --include, only the files matching one of the patterns are restored. In
+the patterns, * matches any part of a name, and ** any number of directories.`,
+	Example: `securae snapshot restore app-20250301T120000Z /srv/app --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
+# only restore the configuration
+securae snapshot restore app-20250301T120000Z --include 'config/**' --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := cobra.RangeArgs(1, 2)(cmd, args); err != nil {
+			return fmt.Errorf("A snapshot ID and optionally a directory must be specified.")
+		}
+		return nil
+	},
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(flagBackupId, cmd.Flags().Lookup(flagBackupId))
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		apiURL := viper.GetString("api.url")
+		apiToken := viper.GetString("api.token")
+
+		backupId, err := getBackupId()
+		if err != nil {
+			return err
+		}
+		snapshotId := args[0]
+		target := "."
+		if len(args) > 1 {
+			target = args[1]
+		}
+		includes, _ := cmd.Flags().GetStringArray(flagInclude)
+		for _, pattern := range includes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+
+		manifestURL, postData, err := presignedDownloadURL(apiURL, apiToken, backupId, snapshotId+snapshotManifestSuffix)
+		if err != nil {
+			return err
+		}
+		encryptionKeyB64Encoded, err := getDownloadEncryptionKey(apiURL, apiToken, backupId, postData)
+		if err != nil {
+			return err
+		}
+		if encryptionKeyB64Encoded == "" {
+			return errSnapshotAge
+		}
+		chunks := func() (*chunkStore, error) {
+			return newChunkStore(apiURL, apiToken, backupId, encryptionKeyB64Encoded)
+		}
+
+		cmd.Printf("[%s] Downloading manifest... ", snapshotId)
+		manifestFile, err := createTempFile()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(manifestFile.Name())
+		defer manifestFile.Close()
+		if _, err := restoreFile(manifestURL, encryptionKeyB64Encoded, manifestFile.Name(), false, chunks); err != nil {
+			return err
+		}
+		var manifest snapshotManifest
+		if err := json.NewDecoder(manifestFile).Decode(&manifest); err != nil {
+			return fmt.Errorf("error reading the manifest of the snapshot: %w", err)
+		}
+		if err := verifySnapshotManifest(manifest, encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+		cmd.Printf("OK\n")
+
+		archiveURL, _, err := presignedDownloadURL(apiURL, apiToken, backupId, snapshotId+snapshotArchiveSuffix)
+		if err != nil {
+			return err
+		}
+		cmd.Printf("[%s] Downloading archive... ", snapshotId)
+		archive, err := createTempFile()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(archive.Name())
+		defer archive.Close()
+		if _, err := restoreFile(archiveURL, encryptionKeyB64Encoded, archive.Name(), false, chunks); err != nil {
+			return err
+		}
+		cmd.Printf("OK\n")
+
+		cmd.Printf("[%s] Restoring files... ", snapshotId)
+		restored, err := restoreSnapshotArchive(archive, manifest, target, includes)
+		if err != nil {
+			cmd.Printf("Error\n")
+			return err
+		}
+		cmd.Printf("OK\n")
+		cmd.Printf("%d files restored into %s.\n", restored, target)
+		return nil
+	},
+}
+
+var errSnapshotAge = errors.New("Snapshots need the encryption key to sign their manifest, they can't be used with age encryption.")
+
+func init() {
+	RootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotCreateCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotCreateCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) where the snapshot will be stored. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+	snapshotCreateCmd.Flags().String(flagName, "", "Name of the snapshot (default: the name of the directory)")
+	snapshotCreateCmd.Flags().String(flagCompress, "", "Compress the archive before uploading it: gzip or zstd")
+	snapshotCreateCmd.Flags().StringArray(flagExcludeFrom, nil, "Exclude the files matching the patterns of this file, in the .securaeignore format. It can be repeated.")
+	snapshotCreateCmd.Flags().Bool(flagMerkle, false, "Upload a manifest of the hashes of the blocks of the archive, to verify it with validate --spot-check")
+	snapshotCreateCmd.Flags().Bool(flagTarIndex, false, "Upload an index of the files of the archive, to extract them with the extract command")
+	snapshotCreateCmd.Flags().Int(flagCompressLevel, 0, "Compression level, from 1 (fastest) to 9 for gzip or 22 for zstd (default: the codec's default)")
+	snapshotRestoreCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) where the snapshot is stored. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+	snapshotRestoreCmd.Flags().StringArray(flagInclude, nil, "Only restore the files matching this pattern, relative to the snapshot root. It can be repeated.")
+}
+
+// prepareObject writes the data produced by `write` to a temporary file,
+// compressed with `codec` and encrypted for the upload.
+func prepareObject(encryptionKeyB64Encoded string, codec string, level int, write func(io.Writer) error) (*os.File, error) {
+	prepared, err := createTempFile()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+	var src io.Reader = pr
+	if codec != "" {
+		compressed, err := compressReader(pr, codec, level)
+		if err != nil {
+			prepared.Close()
+			os.Remove(prepared.Name())
+			return nil, err
+		}
+		defer compressed.Close()
+		src = compressed
+	}
+	if err := encryptForUpload(prepared, src, encryptionKeyB64Encoded); err != nil {
+		prepared.Close()
+		os.Remove(prepared.Name())
+		return nil, err
+	}
+	return prepared, nil
+}
+
+// presignedDownloadURL returns the URL to download a file of the backup by
+// name, and the request data used to get it.
+func presignedDownloadURL(apiURL string, apiToken string, backupId string, name string) (string, []byte, error) {
+	nameKey, err := filenameKey()
+	if err != nil {
+		return "", nil, err
+	}
+	remoteFilename, err := encryptFilename(name, nameKey)
+	if err != nil {
+		return "", nil, err
+	}
+	postData, err := json.Marshal(map[string]interface{}{"filename": remoteFilename, "include_checksum": true})
+	if err != nil {
+		return "", nil, err
+	}
+	presignedURL, err := fetchPresignedURL(fmt.Sprintf("%s/backups/%s/predownload/", apiURL, backupId), apiToken, postData)
+	return presignedURL, postData, err
+}
+
+// archivable reports whether a file is added to the snapshot archives: only
+// regular files, directories and symbolic links are, not the named pipes,
+// sockets and devices.
+func archivable(info fs.FileInfo) bool {
+	return info.Mode().IsRegular() || info.IsDir() || info.Mode()&fs.ModeSymlink != 0
+}
+
+// writeSnapshotArchive writes the tar archive of the directory and returns
+// the entries of its manifest. Only regular files, directories and symbolic
+// links are archived, except the ones excluded by the matcher. The offsets of
+// the files are added to `index`, if any.
+func writeSnapshotArchive(w io.Writer, matcher *ignoreMatcher, index *tarIndex) ([]snapshotEntry, error) {
+	var entries []snapshotEntry
+	// The tar writer writes each header as soon as it is added, so the count
+	// is the offset of the file that follows.
+	counter := &countingWriter{writer: w}
+	tw := tar.NewWriter(counter)
+	err := matcher.walk(func(filename string, rel string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !archivable(info) {
+			return nil
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(filename); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		header.Format = tar.FormatPAX
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		entry := snapshotEntry{
+			Path:    rel,
+			Mode:    info.Mode(),
+			Uid:     header.Uid,
+			Gid:     header.Gid,
+			ModTime: info.ModTime().UTC(),
+			Link:    link,
+		}
+		switch {
+		case info.IsDir():
+			entry.Type = "dir"
+		case link != "":
+			entry.Type = "symlink"
+		default:
+			entry.Type = "file"
+			entry.Size = info.Size()
+			offset := counter.count
+			entry.Sha256, err = archiveFile(tw, filename, info.Size())
+			if err != nil {
+				return err
+			}
+			if index != nil {
+				index.Entries = append(index.Entries, tarIndexEntry{
+					Name:    entry.Path,
+					Offset:  offset,
+					Size:    entry.Size,
+					Mode:    entry.Mode,
+					ModTime: entry.ModTime,
+					Sha256:  entry.Sha256,
+				})
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, tw.Close()
+}
+
+// archiveFile copies the content of a file into the archive, and returns its
+// checksum. The size in the tar header can't change, so a file whose size
+// changed since it was listed can't be archived.
+func archiveFile(tw *tar.Writer, filename string, size int64) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, hasher), file, size); err != nil {
+		if err == io.EOF {
+			return "", fmt.Errorf("%s: %w", filename, errFileChanged)
+		}
+		return "", err
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != size {
+		return "", fmt.Errorf("%s: %w", filename, errFileChanged)
+	}
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func snapshotSignature(manifest snapshotManifest, encryptionKeyB64Encoded string) (string, error) {
+	masterKey, err := decodeKey(encryptionKeyB64Encoded)
+	if err != nil {
+		return "", err
+	}
+	defer masterKey.Destroy()
+	signingKey := newSecureBuffer(32)
+	defer signingKey.Destroy()
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey.Bytes(), nil, []byte("securae snapshot manifest")), signingKey.Bytes()); err != nil {
+		return "", err
+	}
+
+	manifest.Signature = ""
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, signingKey.Bytes())
+	mac.Write(data)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func signSnapshotManifest(manifest *snapshotManifest, encryptionKeyB64Encoded string) error {
+	signature, err := snapshotSignature(*manifest, encryptionKeyB64Encoded)
+	if err != nil {
+		return err
+	}
+	manifest.Signature = signature
+	return nil
+}
+
+func verifySnapshotManifest(manifest snapshotManifest, encryptionKeyB64Encoded string) error {
+	if manifest.Version != snapshotManifestVersion {
+		return fmt.Errorf("The snapshot uses the manifest version %d, which is not supported by this version.", manifest.Version)
+	}
+	signature, err := snapshotSignature(manifest, encryptionKeyB64Encoded)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(manifest.Signature)) {
+		return fmt.Errorf("The signature of the manifest is invalid, the snapshot was modified or signed with another key.")
+	}
+	return nil
+}
+
+// matchSnapshotPath reports whether the path of a file matches the pattern,
+// where ** matches any number of directories. A pattern matching a directory
+// also matches its content.
+func matchSnapshotPath(pattern string, name string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	nameParts := strings.Split(name, "/")
+	var match func(p, n int) bool
+	match = func(p, n int) bool {
+		if p == len(patternParts) {
+			return true
+		}
+		if patternParts[p] == "**" {
+			for i := n; i <= len(nameParts); i++ {
+				if match(p+1, i) {
+					return true
+				}
+			}
+			return false
+		}
+		if n == len(nameParts) {
+			return false
+		}
+		if ok, _ := path.Match(patternParts[p], nameParts[n]); !ok {
+			return false
+		}
+		return match(p+1, n+1)
+	}
+	return match(0, 0)
+}
+
+// restoreSnapshotArchive extracts the files of the archive that match one of
+// the patterns, or all of them without any pattern. It returns the number of
+// files restored.
+func restoreSnapshotArchive(archive io.Reader, manifest snapshotManifest, target string, includes []string) (int, error) {
+	entries := make(map[string]snapshotEntry)
+	for _, entry := range manifest.Files {
+		entries[entry.Path] = entry
+	}
+	included := func(name string) bool {
+		if len(includes) == 0 {
+			return true
+		}
+		for _, pattern := range includes {
+			if matchSnapshotPath(pattern, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The directories get their modification time and mode once their
+	// content is restored, and the symbolic links are only created at the
+	// end, so no file is written through them.
+	var dirs, links []snapshotEntry
+	restored := 0
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("error reading the archive: %w", err)
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		entry, ok := entries[name]
+		if !ok {
+			return restored, fmt.Errorf("The archive contains %s, which is not in the manifest.", name)
+		}
+		delete(entries, name)
+		if !included(name) {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return restored, fmt.Errorf("The archive contains an invalid path: %s", name)
+		}
+		filename := filepath.Join(target, filepath.FromSlash(name))
+
+		switch entry.Type {
+		case "dir":
+			if err := os.MkdirAll(filename, 0700); err != nil {
+				return restored, err
+			}
+			dirs = append(dirs, entry)
+		case "symlink":
+			links = append(links, entry)
+		case "file":
+			if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+				return restored, err
+			}
+			if err := extractSnapshotFile(tr, filename, entry); err != nil {
+				return restored, err
+			}
+			if err := applySnapshotMetadata(filename, entry); err != nil {
+				return restored, err
+			}
+			restored++
+		}
+	}
+	for name := range entries {
+		if included(name) {
+			return restored, fmt.Errorf("The file %s of the manifest is missing from the archive.", name)
+		}
+	}
+
+	for _, entry := range links {
+		filename := filepath.Join(target, filepath.FromSlash(entry.Path))
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			return restored, err
+		}
+		os.Remove(filename)
+		if err := os.Symlink(entry.Link, filename); err != nil {
+			return restored, err
+		}
+		if os.Geteuid() == 0 {
+			os.Lchown(filename, entry.Uid, entry.Gid)
+		}
+		restored++
+	}
+	// Children before their parents.
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Path > dirs[j].Path })
+	for _, entry := range dirs {
+		if err := applySnapshotMetadata(filepath.Join(target, filepath.FromSlash(entry.Path)), entry); err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
+
+func extractSnapshotFile(src io.Reader, filename string, entry snapshotEntry) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hasher), src); err != nil {
+		return err
+	}
+	if checksum := base64.StdEncoding.EncodeToString(hasher.Sum(nil)); checksum != entry.Sha256 {
+		file.Close()
+		os.Remove(filename)
+		return fmt.Errorf("The file %s doesn't match its hash in the manifest.", entry.Path)
+	}
+	return file.Close()
+}
+
+// applySnapshotMetadata restores the mode, the modification time and, as
+// root, the owner of a file.
+func applySnapshotMetadata(filename string, entry snapshotEntry) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(filename, entry.Uid, entry.Gid); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(filename, entry.Mode.Perm()|entry.Mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(filename, entry.ModTime, entry.ModTime)
+}
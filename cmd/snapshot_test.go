@@ -0,0 +1,129 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func TestMatchSnapshotPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"config/**", "config", true},
+		{"config/**", "config/app.yaml", true},
+		{"config/**", "config/nginx/site.conf", true},
+		{"config/**", "data/config/app.yaml", false},
+		{"config", "config/app.yaml", true},
+		{"**/*.yaml", "app.yaml", true},
+		{"**/*.yaml", "config/nginx/site.yaml", true},
+		{"**/*.yaml", "config/app.yml", false},
+		{"config/*.yaml", "config/app.yaml", true},
+		{"config/*.yaml", "config/nginx/site.yaml", false},
+		{"config/**/site.conf", "config/site.conf", true},
+		{"config/**/site.conf", "config/nginx/sites/site.conf", true},
+	}
+	for _, test := range tests {
+		if got := matchSnapshotPath(test.pattern, test.name); got != test.want {
+			t.Errorf("matchSnapshotPath(%q, %q) = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+func TestSnapshotManifestSignature(t *testing.T) {
+	manifest := snapshotManifest{Version: snapshotManifestVersion, Id: "app", Files: []snapshotEntry{{Path: "app.yaml", Type: "file", Mode: 0600}}}
+	if err := signSnapshotManifest(&manifest, testEncryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySnapshotManifest(manifest, testEncryptionKey); err != nil {
+		t.Errorf("The signature should be valid: %v", err)
+	}
+	if err := verifySnapshotManifest(manifest, testKeyringKey); err == nil {
+		t.Errorf("The signature should be invalid with another key")
+	}
+	manifest.Files[0].Mode = 0644
+	if err := verifySnapshotManifest(manifest, testEncryptionKey); err == nil {
+		t.Errorf("The signature should be invalid once the manifest is modified")
+	}
+}
+
+func TestSnapshotCreateAndRestore(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	dir := t.TempDir()
+	source := filepath.Join(dir, "app")
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour).Truncate(time.Second)
+	files := map[string]string{
+		"config/app.yaml":        "debug: false\n",
+		"config/nginx/site.conf": "server {}\n",
+		"data/users.db":          "users",
+	}
+	for name, content := range files {
+		filename := filepath.Join(source, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		if err := os.WriteFile(filename, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filename, lastWeek, lastWeek)
+	}
+	os.Chmod(filepath.Join(source, "config", "app.yaml"), 0600)
+	os.Symlink("app.yaml", filepath.Join(source, "config", "current.yaml"))
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "snapshot", "create", source, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	match := regexp.MustCompile(`Snapshot (\S+) created.`).FindStringSubmatch(actual.String())
+	if match == nil {
+		t.Fatalf("The snapshot ID should be shown:\n%s", actual)
+	}
+	snapshotId := match[1]
+	if storage.get(snapshotId+".tar") == nil || storage.get(snapshotId+".manifest.json") == nil {
+		t.Fatalf("The archive and the manifest should be uploaded")
+	}
+
+	target := filepath.Join(dir, "restored")
+	actual.Reset()
+	defer snapshotRestoreCmd.Flags().Lookup(flagInclude).Value.(pflag.SliceValue).Replace(nil)
+	RootCmd.SetArgs([]string{"--config", configFile, "snapshot", "restore", snapshotId, target, "--include", "config/**", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	for _, name := range []string{"config/app.yaml", "config/nginx/site.conf"} {
+		content, err := os.ReadFile(filepath.Join(target, filepath.FromSlash(name)))
+		if err != nil || string(content) != files[name] {
+			t.Errorf("%s should be restored, got %q (%v)", name, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(target, "data")); err == nil {
+		t.Errorf("The files that are not included should not be restored")
+	}
+	info, err := os.Stat(filepath.Join(target, "config", "app.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("The mode should be restored, got %v", info.Mode())
+	}
+	if !info.ModTime().Equal(lastWeek) {
+		t.Errorf("The modification time should be restored, got %v instead of %v", info.ModTime(), lastWeek)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "config", "current.yaml")); err != nil || link != "app.yaml" {
+		t.Errorf("The symbolic link should be restored, got %q (%v)", link, err)
+	}
+}
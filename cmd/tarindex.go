@@ -0,0 +1,354 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// A tar archive can be uploaded with an index of the offsets of its files,
+// stored as a sidecar object. A single file is then extracted with HTTP
+// Range requests, without downloading the whole archive. This only works
+// when the archive is not compressed: with client-side encryption, only the
+// encrypted chunks holding the file are downloaded.
+
+const flagTarIndex = "tar-index"
+const flagOutput = "output"
+
+const tarIndexVersion = 1
+const tarIndexSuffix = ".tarindex.json"
+
+type tarIndexEntry struct {
+	Name    string      `json:"name"`
+	Offset  int64       `json:"offset"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Sha256  string      `json:"sha256"`
+}
+
+type tarIndex struct {
+	Version int `json:"version"`
+	// SHA-256 checksum of the archive before its encryption.
+	ArchiveChecksum string          `json:"archive_checksum"`
+	Entries         []tarIndexEntry `json:"entries"`
+}
+
+var extractCmd = &cobra.Command{
+	Use:   "extract [archive] [path in archive] [flags]",
+	Short: "Extract a single file from a tar archive",
+	Long: `Extract a single file from a tar archive uploaded with --tar-index, downloading
+only the bytes of this file.
+
+The file is verified against the SHA-256 checksum stored in the index.`,
+	Example: `securae extract backup.tar etc/nginx/nginx.conf --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
+# extract a file of a snapshot
+securae extract app-20250301T120000Z.tar config/app.yaml -o app.yaml --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := cobra.ExactArgs(2)(cmd, args); err != nil {
+			return fmt.Errorf("An archive and the path of a file in the archive must be specified.")
+		}
+		return nil
+	},
+	GroupID: "backup",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(flagBackupId, cmd.Flags().Lookup(flagBackupId))
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		apiURL := viper.GetString("api.url")
+		apiToken := viper.GetString("api.token")
+
+		backupId, err := getBackupId()
+		if err != nil {
+			return err
+		}
+		archiveName := filepath.Base(args[0])
+		member := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(args[1])), "/")
+		output, _ := cmd.Flags().GetString(flagOutput)
+		if output == "" {
+			output = path.Base(member)
+		}
+
+		indexURL, postData, err := presignedDownloadURL(apiURL, apiToken, backupId, archiveName+tarIndexSuffix)
+		if err != nil {
+			return err
+		}
+		encryptionKeyB64Encoded, err := getDownloadEncryptionKey(apiURL, apiToken, backupId, postData)
+		if err != nil {
+			return err
+		}
+
+		cmd.Printf("[%s] Downloading index... ", archiveName)
+		indexFile, err := createTempFile()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(indexFile.Name())
+		defer indexFile.Close()
+		if _, err := restoreFile(indexURL, encryptionKeyB64Encoded, indexFile.Name(), false, nil); err != nil {
+			return fmt.Errorf("%w\nThe archive may have been uploaded without --tar-index.", err)
+		}
+		var index tarIndex
+		if err := json.NewDecoder(indexFile).Decode(&index); err != nil {
+			return fmt.Errorf("error reading the index of the archive: %w", err)
+		}
+		if index.Version != tarIndexVersion {
+			return fmt.Errorf("The archive uses the index version %d, which is not supported by this version.", index.Version)
+		}
+		cmd.Printf("OK\n")
+
+		var entry *tarIndexEntry
+		for i := range index.Entries {
+			if index.Entries[i].Name == member {
+				entry = &index.Entries[i]
+			}
+		}
+		if entry == nil {
+			return fmt.Errorf("%s is not a file of the archive %s.", member, archiveName)
+		}
+
+		archiveURL, _, err := presignedDownloadURL(apiURL, apiToken, backupId, archiveName)
+		if err != nil {
+			return err
+		}
+		metadataURL, err := presignedMetadataURL(apiURL, apiToken, backupId, archiveName)
+		if err != nil {
+			return err
+		}
+		headers, encryption, err := fetchEncryptedObjectMetadata(metadataURL, encryptionKeyB64Encoded)
+		if err != nil {
+			return err
+		}
+		if encryption == encryptionAge {
+			return fmt.Errorf("The files encrypted with age can't be extracted, download the whole archive instead.")
+		}
+		if headers.Get(metadataCompression) != "" || headers.Get(metadataFormat) != "" {
+			return fmt.Errorf("The archive %s is compressed or chunked, download the whole archive instead.", archiveName)
+		}
+		sourceMAC, err := sourceChecksumMAC(encryptionKeyB64Encoded, index.ArchiveChecksum)
+		if err != nil {
+			return err
+		}
+		if stored := headers.Get(metadataSourceMAC); stored != "" && stored != sourceMAC {
+			return fmt.Errorf("The index doesn't match the archive %s, which was uploaded again without --tar-index.", archiveName)
+		}
+
+		cmd.Printf("[%s] Extracting %s... ", archiveName, member)
+		downloaded, err := extractTarMember(archiveURL, encryptionKeyB64Encoded, encryption, *entry, output)
+		if err != nil {
+			cmd.Printf("Error\n")
+			return err
+		}
+		cmd.Printf("OK (%s downloaded)\n", humanize.Bytes(uint64(downloaded)))
+		cmd.Printf("The file was saved as %s.\n", output)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(extractCmd)
+	extractCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) where the archive is stored. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+	extractCmd.Flags().StringP(flagOutput, "o", "", "Name of the extracted file (default: the name of the file in the archive)")
+}
+
+// countingReader counts the bytes read, which gives the offsets of the files
+// of a tar archive: the tar reader never reads ahead of the current header.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written.
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// buildTarIndex reads a tar archive and returns the offsets of its regular
+// files.
+func buildTarIndex(r io.Reader) ([]tarIndexEntry, error) {
+	var entries []tarIndexEntry
+	counter := &countingReader{reader: r}
+	tr := tar.NewReader(counter)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading the tar archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		entry := tarIndexEntry{
+			Name:    strings.TrimPrefix(path.Clean("/"+header.Name), "/"),
+			Offset:  counter.count,
+			Size:    header.Size,
+			Mode:    header.FileInfo().Mode(),
+			ModTime: header.ModTime.UTC(),
+		}
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, tr); err != nil {
+			return nil, fmt.Errorf("error reading the tar archive: %w", err)
+		}
+		entry.Sha256 = base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+		entries = append(entries, entry)
+	}
+}
+
+// uploadTarIndex uploads the index of the archive `name` as its sidecar.
+func uploadTarIndex(apiURL string, apiToken string, backupId string, encryptionKeyB64Encoded string, name string, index tarIndex) error {
+	index.Version = tarIndexVersion
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	file, err := prepareObject(encryptionKeyB64Encoded, "", 0, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	return uploadObject(apiURL, apiToken, backupId, encryptionKeyB64Encoded, name+tarIndexSuffix, file, nil)
+}
+
+// presignedMetadataURL returns the URL to get the metadata of a file of the
+// backup by name.
+func presignedMetadataURL(apiURL string, apiToken string, backupId string, name string) (string, error) {
+	nameKey, err := filenameKey()
+	if err != nil {
+		return "", err
+	}
+	remoteFilename, err := encryptFilename(name, nameKey)
+	if err != nil {
+		return "", err
+	}
+	postData, err := json.Marshal(map[string]interface{}{"filename": remoteFilename, "include_checksum": true})
+	if err != nil {
+		return "", err
+	}
+	return fetchPresignedURL(fmt.Sprintf("%s/backups/%s/metadata/", apiURL, backupId), apiToken, postData)
+}
+
+// fetchObjectRange downloads the bytes of an object from `start` to `end`
+// included.
+func fetchObjectRange(url string, encryptionKeyB64Encoded string, start int64, end int64) (io.ReadCloser, error) {
+	tr := &http.Transport{
+		TLSHandshakeTimeout:   5 * time.Second,
+		IdleConnTimeout:       5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+	}
+	client := &http.Client{Transport: tr}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	setEncryptionHeaders(req.Header, encryptionKeyB64Encoded)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status code: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// extractTarMember writes a file of the archive at `url`, uploaded with the
+// `encryption` mode, to `filename`, and returns the number of bytes
+// downloaded.
+func extractTarMember(url string, encryptionKeyB64Encoded string, encryption string, entry tarIndexEntry, filename string) (int64, error) {
+	var downloaded int64
+	sseKey := sseCustomerKey(encryptionKeyB64Encoded, encryption)
+	fetch := func(start, end int64) (io.ReadCloser, error) {
+		body, err := fetchObjectRange(url, sseKey, start, end)
+		if err != nil {
+			return nil, err
+		}
+		downloaded += end - start + 1
+		return body, nil
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create the file: %v", err)
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	dst := io.MultiWriter(file, hasher)
+
+	if encryption == encryptionEnvelope {
+		size, err := fetchObjectSize(url, sseKey)
+		if err == nil {
+			err = decryptEnvelopeRange(dst, fetch, size, entry.Offset, entry.Size, encryptionKeyB64Encoded)
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(filename)
+			return downloaded, err
+		}
+	} else if entry.Size > 0 {
+		body, err := fetch(entry.Offset, entry.Offset+entry.Size-1)
+		if err == nil {
+			_, err = io.CopyN(dst, body, entry.Size)
+			body.Close()
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(filename)
+			return downloaded, err
+		}
+	}
+
+	if checksum := base64.StdEncoding.EncodeToString(hasher.Sum(nil)); checksum != entry.Sha256 {
+		file.Close()
+		os.Remove(filename)
+		return downloaded, fmt.Errorf("The extracted file doesn't match its checksum in the index.")
+	}
+	if err := file.Chmod(entry.Mode.Perm()); err != nil {
+		return downloaded, err
+	}
+	if err := file.Close(); err != nil {
+		return downloaded, err
+	}
+	return downloaded, os.Chtimes(filename, entry.ModTime, entry.ModTime)
+}
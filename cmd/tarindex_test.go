@@ -0,0 +1,128 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func writeTestTar(t *testing.T, files map[string][]byte, names []string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0640, Size: int64(len(files[name])), Typeflag: tar.TypeReg, Format: tar.FormatPAX, PAXRecords: map[string]string{"comment": strings.Repeat("x", 600)}})
+		tw.Write(files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBuildTarIndex(t *testing.T) {
+	files := map[string][]byte{"etc/hosts": []byte("127.0.0.1 localhost\n"), "./var/log/app.log": randomData(3000, 3)}
+	archive := writeTestTar(t, files, []string{"etc/hosts", "./var/log/app.log"})
+
+	entries, err := buildTarIndex(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Name != "var/log/app.log" {
+		t.Fatalf("The index should list the two files, got %+v", entries)
+	}
+	for _, entry := range entries {
+		data := archive[entry.Offset : entry.Offset+entry.Size]
+		if !bytes.Equal(data, files[entry.Name]) && !bytes.Equal(data, files["./"+entry.Name]) {
+			t.Errorf("The offset of %s doesn't point to its content", entry.Name)
+		}
+	}
+}
+
+func TestExtractTarMember(t *testing.T) {
+	for _, clientSide := range []bool{false, true} {
+		storage := newMockStorage()
+		defer storage.Close()
+
+		config := testKeyConfig
+		if clientSide {
+			config += "client-side-encryption: true\n"
+		}
+		configFile := storage.writeConfig(t, config)
+		dir := t.TempDir()
+		// The file spans several chunks of the client-side encryption.
+		files := map[string][]byte{"big.bin": randomData(1024*1024, 4), "etc/nginx.conf": randomData(200*1024, 5), "end.bin": randomData(100, 6)}
+		filename := filepath.Join(dir, "backup.tar")
+		archive := writeTestTar(t, files, []string{"big.bin", "etc/nginx.conf", "end.bin"})
+		if err := os.WriteFile(filename, archive, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := new(bytes.Buffer)
+		RootCmd.SetOut(actual)
+		RootCmd.SetErr(actual)
+		defer uploadCmd.Flags().Set(flagTarIndex, "false")
+		RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--tar-index", "--backup-id", testBackupId})
+		if err := RootCmd.Execute(); err != nil {
+			t.Fatalf("%v\n%s", err, actual)
+		}
+		if storage.get("backup.tar.tarindex.json") == nil {
+			t.Fatalf("The index should be uploaded")
+		}
+
+		for _, member := range []string{"etc/nginx.conf", "end.bin"} {
+			output := filepath.Join(dir, filepath.Base(member))
+			actual.Reset()
+			RootCmd.SetArgs([]string{"--config", configFile, "extract", "backup.tar", member, "-o", output, "--backup-id", testBackupId})
+			if err := RootCmd.Execute(); err != nil {
+				t.Fatalf("%v\n%s", err, actual)
+			}
+			if content, _ := os.ReadFile(output); !bytes.Equal(content, files[member]) {
+				t.Errorf("%s should be extracted (client-side encryption: %v)", member, clientSide)
+			}
+			if info, _ := os.Stat(output); info.Mode().Perm() != 0640 {
+				t.Errorf("The mode of %s should be restored, got %v", member, info.Mode())
+			}
+		}
+		if !regexp.MustCompile(`OK \(\d+ k?B downloaded\)`).MatchString(actual.String()) {
+			t.Errorf("Only the bytes of the file should be downloaded:\n%s", actual)
+		}
+	}
+}
+
+func TestExtractSnapshotFile(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig+"client-side-encryption: true\n")
+	dir := t.TempDir()
+	source := filepath.Join(dir, "app")
+	os.MkdirAll(filepath.Join(source, "config"), 0755)
+	os.WriteFile(filepath.Join(source, "config", "app.yaml"), []byte("debug: false\n"), 0600)
+	os.WriteFile(filepath.Join(source, "data.db"), randomData(300*1024, 7), 0600)
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	defer snapshotCreateCmd.Flags().Set(flagTarIndex, "false")
+	RootCmd.SetArgs([]string{"--config", configFile, "snapshot", "create", source, "--tar-index", "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	snapshotId := regexp.MustCompile(`Snapshot (\S+) created.`).FindStringSubmatch(actual.String())[1]
+
+	output := filepath.Join(dir, "app.yaml")
+	RootCmd.SetArgs([]string{"--config", configFile, "extract", snapshotId + ".tar", "config/app.yaml", "-o", output, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if content, _ := os.ReadFile(output); string(content) != "debug: false\n" {
+		t.Errorf("The file of the snapshot should be extracted, got %q", content)
+	}
+}
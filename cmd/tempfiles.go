@@ -0,0 +1,67 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// Temporary files may hold downloaded or encrypted backups. They are created
+// in a directory private to the process (0700), itself in `temp-dir` or the
+// system temporary directory, and the whole directory is removed when the
+// command ends or is interrupted.
+
+const configTempDir = "temp-dir"
+
+var tempFiles struct {
+	sync.Mutex
+	dir string
+}
+
+// createTempFile creates a file only readable by the current user (0600).
+func createTempFile() (*os.File, error) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	if tempFiles.dir == "" {
+		parent := expandHome(viper.GetString(configTempDir))
+		if parent == "" {
+			parent = os.TempDir()
+		}
+		dir, err := os.MkdirTemp(parent, "securae-")
+		if err != nil {
+			return nil, err
+		}
+		tempFiles.dir = dir
+	}
+	return os.CreateTemp(tempFiles.dir, "securae-*")
+}
+
+func removeTempFiles() {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	if tempFiles.dir != "" {
+		os.RemoveAll(tempFiles.dir)
+		tempFiles.dir = ""
+	}
+}
+
+// removeTempFilesOnSignal removes the temporary files when the process is
+// interrupted with SIGINT or SIGTERM, and exits.
+func removeTempFilesOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		removeTempFiles()
+		if s, ok := sig.(syscall.Signal); ok {
+			os.Exit(128 + int(s))
+		}
+		os.Exit(1)
+	}()
+}
@@ -5,8 +5,14 @@ package cmd
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -16,13 +22,53 @@ import (
 	"github.com/spf13/viper"
 )
 
+// uploadAttempts is the number of times a file modified during the upload is
+// uploaded again.
+const uploadAttempts = 3
+
+var errFileChanged = errors.New("file changed while uploading")
+
 var uploadCmd = &cobra.Command{
-	Use:   "upload [filename] [flags]",
+	Use:   "upload [filename|directory] [flags]",
 	Short: "Upload backup files",
-	Long:  `Upload files into the backup ID (UUID format) defined in the web UI.`,
+	Long: `Upload files into the backup ID (UUID format) defined in the web UI.
+
+With client-side-encryption enabled in the configuration, the file is
+encrypted before it is uploaded, and the storage provider never receives the
+encryption key. With age.recipients, the file is encrypted to those public
+keys instead, and the host doesn't need any encryption key. The way each file
+is encrypted is stored with it, so the files uploaded before changing these
+settings can still be downloaded.
+
+With obfuscate-filenames enabled, the name of the file is encrypted before it
+is sent to the API.
+
+The mode, owner and modification time of the file are stored with it, and its
+extended attributes with --xattrs, to restore them with download --preserve.
+
+With a directory, each of its files is uploaded under its own name, except the
+ones excluded by the .securaeignore files of the directory and --exclude-from,
+like with snapshot create. Use ls-files to list them; the .securaeignore files
+themselves are not uploaded. Symbolic links to files are uploaded as the files
+they point to.`,
 	Example: `# using --backup-id
 securae upload database-dump.tar.gz --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
 
+# compress a SQL dump with zstd before uploading it
+securae upload database-dump.sql --compress zstd --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
+# don't upload the dump again when it hasn't changed
+securae upload database-dump.sql --skip-existing --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
+# only upload the parts of a VM image that changed since the last upload
+securae upload vm.img --chunked --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
+# index a tar archive to extract single files from it later
+securae upload backup.tar --tar-index --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
+# upload the files of a directory, except the ones in its .securaeignore
+securae upload ./exports --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
 # upload a file using an environment variable
 export SECURAE_BACKUP_ID=abcd1234-ab12-ab12-ab12-abcdef123456
 securae upload database-dump.tar.gz`,
@@ -38,6 +84,10 @@ securae upload database-dump.tar.gz`,
 	GroupID: "backup",
 	PreRun: func(cmd *cobra.Command, args []string) {
 		viper.BindPFlag(flagBackupId, cmd.Flags().Lookup(flagBackupId))
+		viper.BindPFlag(flagCompress, cmd.Flags().Lookup(flagCompress))
+		viper.BindPFlag(flagCompressLevel, cmd.Flags().Lookup(flagCompressLevel))
+		viper.BindPFlag(flagChunked, cmd.Flags().Lookup(flagChunked))
+		viper.BindPFlag(flagMerkle, cmd.Flags().Lookup(flagMerkle))
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		apiURL := viper.GetString("api.url")
@@ -48,84 +98,439 @@ securae upload database-dump.tar.gz`,
 			return err
 		}
 
-		encryptionKeyB64Encoded, err := getEncryptionKey()
+		var encryptionKeyB64Encoded string
+		if !ageEncryption() {
+			encryptionKeyB64Encoded, err = getUploadEncryptionKey(backupId)
+			if err != nil {
+				return err
+			}
+		}
+		filename := args[0]
+		if info, err := os.Stat(filename); err == nil && info.IsDir() {
+			filenames, err := directoryUploadFiles(cmd, filename)
+			if err != nil {
+				return err
+			}
+			for _, filename := range filenames {
+				if err := uploadWithRetries(cmd, apiURL, apiToken, backupId, encryptionKeyB64Encoded, filename, filepath.Base(filename)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return uploadWithRetries(cmd, apiURL, apiToken, backupId, encryptionKeyB64Encoded, filename, filepath.Base(filename))
+	},
+}
+
+// directoryUploadFiles returns the files of a directory to upload, without
+// the ignore files and the files they exclude. Each file is uploaded under
+// its name, which must be unique.
+func directoryUploadFiles(cmd *cobra.Command, dir string) ([]string, error) {
+	excludeFrom, _ := cmd.Flags().GetStringArray(flagExcludeFrom)
+	matcher, err := newIgnoreMatcher(dir, excludeFrom)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	seen := make(map[string]string)
+	err = matcher.walk(func(filename string, rel string, d fs.DirEntry) error {
+		if d.IsDir() || d.Name() == ignoreFilename {
+			return nil
+		}
+		info, err := os.Stat(filename)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name := filepath.Base(filename)
+		if other, exists := seen[name]; exists {
+			return fmt.Errorf("%s and %s have the same name, upload the directory with snapshot create instead.", other, rel)
+		}
+		seen[name] = rel
+		filenames = append(filenames, filename)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("There are no files to upload in %s.", dir)
+	}
+	return filenames, nil
+}
+
+// uploadWithRetries uploads the file under `name`, and uploads it again when
+// it is modified during the upload. The checksum is calculated again for the
+// next attempts, the cached one may be stale.
+func uploadWithRetries(cmd *cobra.Command, apiURL string, apiToken string, backupId string, encryptionKeyB64Encoded string, filename string, name string) error {
+	rehash, _ := cmd.Flags().GetBool(flagRehash)
+	for attempt := 1; ; attempt++ {
+		err := uploadOnce(cmd, apiURL, apiToken, backupId, encryptionKeyB64Encoded, filename, name, rehash)
+		if !errors.Is(err, errFileChanged) {
+			return err
+		}
+		forgetCachedChecksum(filename)
+		rehash = true
+		if attempt == uploadAttempts {
+			return fmt.Errorf("%w: %s was modified during each of the %d attempts, upload a copy of it that is not being written instead", errFileChanged, filepath.Base(filename), uploadAttempts)
+		}
+		cmd.Printf("[%s] The file changed while uploading, retrying (%d/%d)\n", name, attempt+1, uploadAttempts)
+	}
+}
+
+// uploadOnce makes one attempt at uploading the file under `name`. It returns
+// errFileChanged if the file is modified before the upload is complete, and
+// the upload can be attempted again. With `rehash`, the checksum is not read
+// from the cache.
+func uploadOnce(cmd *cobra.Command, apiURL string, apiToken string, backupId string, encryptionKeyB64Encoded string, filename string, name string, rehash bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	original := file
+	filenameOnly := name
+	// The size and modification time are checked again after the upload,
+	// and the data read during the upload is hashed again.
+	before, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	streamed := sha256.New()
+	counter := &countingWriter{writer: streamed}
+	source := io.TeeReader(file, counter)
+
+	cmd.Printf("[%s] Calculating integrity checksum (SHA-256)... ", filenameOnly)
+	sourceChecksum, cached, err := cachedChecksumSHA256(file, rehash)
+	if err != nil {
+		return err
+	} else if cached {
+		cmd.Printf("OK (cached)\n")
+	} else {
+		cmd.Printf("OK\n")
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+
+	if skipExisting, _ := cmd.Flags().GetBool(flagSkipExisting); skipExisting {
+		cmd.Printf("[%s] Looking for a file with the same content... ", filenameOnly)
+		existing, err := findIdenticalObject(apiURL, apiToken, backupId, encryptionKeyB64Encoded, sourceChecksum, before.Size())
 		if err != nil {
 			return err
 		}
+		if existing != "" {
+			nameKey, _ := filenameKey()
+			cmd.Printf("unchanged (same content as %s)\n", decryptFilename(existing, nameKey))
+			return nil
+		}
+		cmd.Printf("none\n")
+	}
 
-		filename := args[0]
-		file, err := os.Open(filename)
+	codec := viper.GetString(flagCompress)
+	if err := validateCompression(codec); err != nil {
+		return err
+	}
+	withXattrs, _ := cmd.Flags().GetBool(flagXattrs)
+	metadata, err := fileMetadata(file, before, withXattrs)
+	if err != nil {
+		return err
+	}
+	sourceMAC, err := sourceChecksumMAC(encryptionKeyB64Encoded, sourceChecksum)
+	if err != nil {
+		return err
+	}
+	if sourceMAC != "" {
+		metadata[metadataSourceMAC] = sourceMAC
+	}
+
+	var index *tarIndex
+	if withIndex, _ := cmd.Flags().GetBool(flagTarIndex); withIndex {
+		if codec != "" || viper.GetBool(flagChunked) || ageEncryption() {
+			return fmt.Errorf("--tar-index can't be used with compressed, chunked or age encrypted files, they can't be read at random positions.")
+		}
+		cmd.Printf("[%s] Indexing archive... ", filenameOnly)
+		entries, err := buildTarIndex(file)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
+		if _, err := file.Seek(0, 0); err != nil {
+			return err
+		}
+		index = &tarIndex{ArchiveChecksum: sourceChecksum, Entries: entries}
+		cmd.Printf("OK (%d files)\n", len(entries))
+	}
 
-		url := fmt.Sprintf("%s/backups/%s/preupload/", apiURL, backupId)
-		filenameOnly := filepath.Base(filename)
-		fi, _ := file.Stat()
+	// A chunked file is uploaded as its new chunks, followed by its
+	// index which takes the place of the file in the rest of the upload.
+	if viper.GetBool(flagChunked) {
+		store, err := newChunkStore(apiURL, apiToken, backupId, encryptionKeyB64Encoded)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		store.codec = codec
 
-		cmd.Printf("[%s] Calculating integrity checksum (SHA-256)... ", filenameOnly)
-		checksum, err := ChecksumSHA256(file)
-		if err == nil {
-			cmd.Printf("OK\n")
-		} else {
+		cmd.Printf("[%s] Uploading new chunks... ", filenameOnly)
+		index, newChunks, err := uploadChunks(store, source)
+		if err != nil {
 			return err
 		}
+		cmd.Printf("OK (%d new of %d chunks)\n", newChunks, len(index.Chunks))
 
-		presignedURL, err := fetchPresignedURL(url, apiToken, []byte(fmt.Sprintf(`{"filename": "%s", "size": %d, "checksum": "%s"}`, filenameOnly, fi.Size(), checksum)))
+		indexFile, err := createTempFile()
 		if err != nil {
 			return err
 		}
+		defer os.Remove(indexFile.Name())
+		defer indexFile.Close()
+		if err := json.NewEncoder(indexFile).Encode(index); err != nil {
+			return err
+		}
+		if _, err := indexFile.Seek(0, 0); err != nil {
+			return err
+		}
+		file = indexFile
+		metadata[metadataFormat] = formatChunked
+	}
 
-		cmd.Printf("[%s] Uploading file... ", filenameOnly)
-		err = uploadFile(presignedURL, encryptionKeyB64Encoded, file, checksum)
-		if err == nil {
-			cmd.Printf("OK\n")
-		} else {
+	// The file is compressed and encrypted in a single pass into a
+	// temporary file, as the size and the checksum are needed before
+	// the upload.
+	if codec != "" {
+		metadata[metadataCompression] = codec
+	}
+	metadata = withUploadEncryption(metadata)
+	encrypt := uploadEncryption() != ""
+	if codec != "" || encrypt {
+		switch {
+		case codec != "" && encrypt:
+			cmd.Printf("[%s] Compressing and encrypting file... ", filenameOnly)
+		case codec != "":
+			cmd.Printf("[%s] Compressing file... ", filenameOnly)
+		default:
+			cmd.Printf("[%s] Encrypting file... ", filenameOnly)
+		}
+		prepared, err := createTempFile()
+		if err != nil {
 			return err
 		}
-		return nil
+		defer os.Remove(prepared.Name())
+		defer prepared.Close()
 
-	},
+		var src io.Reader = file
+		if file == original {
+			src = source
+		}
+		if codec != "" {
+			compressed, err := compressReader(src, codec, viper.GetInt(flagCompressLevel))
+			if err != nil {
+				return err
+			}
+			defer compressed.Close()
+			src = compressed
+		}
+		if err := encryptForUpload(prepared, src, encryptionKeyB64Encoded); err != nil {
+			return err
+		}
+		if _, err := prepared.Seek(0, 0); err != nil {
+			return err
+		}
+		cmd.Printf("OK\n")
+		file = prepared
+	}
+	// What will be uploaded is already read from the file, except when the
+	// file itself is uploaded.
+	if file != original {
+		if err := verifyUnchanged(original, before, sourceChecksum, streamed); err != nil {
+			return err
+		}
+	}
+
+	url := fmt.Sprintf("%s/backups/%s/preupload/", apiURL, backupId)
+	fi, _ := file.Stat()
+
+	// The checksum sent to the storage provider is the one of the
+	// uploaded data.
+	checksum := sourceChecksum
+	if file != original {
+		checksum, err = ChecksumSHA256(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The sidecars are uploaded first, so the file remains the latest one
+	// of the backup.
+	if index != nil {
+		cmd.Printf("[%s] Uploading index... ", filenameOnly)
+		if err := uploadTarIndex(apiURL, apiToken, backupId, encryptionKeyB64Encoded, filenameOnly, *index); err != nil {
+			return err
+		}
+		cmd.Printf("OK\n")
+	}
+	if merkleEnabled() {
+		cmd.Printf("[%s] Uploading block manifest... ", filenameOnly)
+		root, err := uploadMerkleManifest(apiURL, apiToken, backupId, encryptionKeyB64Encoded, filenameOnly, file)
+		if err != nil {
+			return err
+		}
+		metadata[metadataMerkleRoot] = root
+		cmd.Printf("OK\n")
+	}
+
+	nameKey, err := filenameKey()
+	if err != nil {
+		return err
+	}
+	remoteFilename, err := encryptFilename(filenameOnly, nameKey)
+	if err != nil {
+		return err
+	}
+	presignedURL, err := fetchPresignedURL(url, apiToken, []byte(fmt.Sprintf(`{"filename": "%s", "size": %d, "checksum": "%s"}`, remoteFilename, fi.Size(), checksum)))
+	if err != nil {
+		return err
+	}
+
+	cmd.Printf("[%s] Uploading file... ", filenameOnly)
+	if file == original {
+		err = putObject(presignedURL, encryptionKeyB64Encoded, source, before.Size(), checksum, metadata)
+	} else {
+		err = uploadFile(presignedURL, encryptionKeyB64Encoded, file, checksum, metadata)
+	}
+	// A file modified during the upload, or since its checksum was cached,
+	// is also rejected by the storage provider, as its checksum doesn't
+	// match. The data is hashed entirely unless the upload stopped early.
+	if err != nil && counter.count != before.Size() {
+		streamed = nil
+	}
+	if changed := verifyUnchanged(original, before, sourceChecksum, streamed); changed != nil {
+		cmd.Printf("Error\n")
+		return changed
+	}
+	if err == nil {
+		cmd.Printf("OK\n")
+	} else {
+		return err
+	}
+	return nil
+}
+
+// uploadObject uploads a file that is already compressed and encrypted under
+// `name` in the backup.
+func uploadObject(apiURL string, apiToken string, backupId string, encryptionKeyB64Encoded string, name string, file *os.File, metadata map[string]string) error {
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+	checksum, err := ChecksumSHA256(file)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	nameKey, err := filenameKey()
+	if err != nil {
+		return err
+	}
+	remoteFilename, err := encryptFilename(name, nameKey)
+	if err != nil {
+		return err
+	}
+	postData, err := json.Marshal(map[string]interface{}{"filename": remoteFilename, "size": fi.Size(), "checksum": checksum})
+	if err != nil {
+		return err
+	}
+	presignedURL, err := fetchPresignedURL(fmt.Sprintf("%s/backups/%s/preupload/", apiURL, backupId), apiToken, postData)
+	if err != nil {
+		return err
+	}
+	return uploadFile(presignedURL, encryptionKeyB64Encoded, file, checksum, withUploadEncryption(metadata))
+}
+
+// encryptForUpload writes `src` to `dst` encrypted on the client side, with
+// age or client-side encryption, or as is when the storage provider encrypts
+// it.
+func encryptForUpload(dst io.Writer, src io.Reader, encryptionKeyB64Encoded string) error {
+	switch uploadEncryption() {
+	case encryptionAge:
+		return encryptAge(dst, src)
+	case encryptionEnvelope:
+		return encryptEnvelope(dst, src, encryptionKeyB64Encoded)
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// verifyUnchanged returns errFileChanged if the size or the modification time
+// of the file are not the ones from `before`, or if the data hashed in
+// `streamed`, if any, doesn't match the checksum calculated first.
+func verifyUnchanged(file *os.File, before os.FileInfo, checksum string, streamed hash.Hash) error {
+	after, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return errFileChanged
+	}
+	if streamed != nil && base64.StdEncoding.EncodeToString(streamed.Sum(nil)) != checksum {
+		return errFileChanged
+	}
+	return nil
 }
 
 func init() {
 	RootCmd.AddCommand(uploadCmd)
 	uploadCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) where your files will be stored. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+	uploadCmd.Flags().String(flagCompress, "", "Compress the file before uploading it: gzip or zstd")
+	uploadCmd.Flags().Int(flagCompressLevel, 0, "Compression level, from 1 (fastest) to 9 for gzip or 22 for zstd (default: the codec's default)")
+	uploadCmd.Flags().Bool(flagChunked, false, "Split the file into chunks and only upload the chunks that are not in the backup yet")
+	uploadCmd.Flags().Bool(flagMerkle, false, "Upload a manifest of the hashes of the blocks of the file, to verify it with validate --spot-check")
+	uploadCmd.Flags().Bool(flagTarIndex, false, "Upload an index of the files of the tar archive, to extract them with the extract command")
+	uploadCmd.Flags().Bool(flagRehash, false, "Calculate the checksum of the file even if it is unchanged since it was cached")
+	uploadCmd.Flags().Bool(flagXattrs, false, "Store the extended attributes of the file with it, they are not encrypted")
+	uploadCmd.Flags().StringArray(flagExcludeFrom, nil, "With a directory, exclude the files matching the patterns of this file, in the .securaeignore format. It can be repeated.")
+	uploadCmd.Flags().Bool(flagSkipExisting, false, "Don't upload the file if a file with the same content is already in the backup")
 }
 
-func uploadFile(url string, encryptionKeyB64Encoded string, file *os.File, checksum string) error {
+// uploadFile sends the file to the presigned URL. `metadata` holds the
+// X-Amz-Meta-* headers stored with the object, including its encryption
+// mode which gives the SSE-C key.
+func uploadFile(url string, encryptionKeyB64Encoded string, file *os.File, checksum string, metadata map[string]string) error {
 	// Reset file position
 	if _, err := file.Seek(0, 0); err != nil {
 		return err
 	}
 
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	return putObject(url, encryptionKeyB64Encoded, file, fileInfo.Size(), checksum, metadata)
+}
+
+func putObject(url string, encryptionKeyB64Encoded string, body io.Reader, size int64, checksum string, metadata map[string]string) error {
 	tr := &http.Transport{
 		TLSHandshakeTimeout:   5 * time.Second,
 		IdleConnTimeout:       5 * time.Second,
 		ResponseHeaderTimeout: 5 * time.Second,
 	}
 	client := &http.Client{Transport: tr}
-	request, err := http.NewRequest(http.MethodPut, url, file)
+	request, err := http.NewRequest(http.MethodPut, url, body)
 	if err != nil {
 		return err
 	}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
-	}
-	fileSize := fileInfo.Size()
-
-	request.ContentLength = fileSize
+	request.ContentLength = size
 	request.Header.Set("Content-Type", "multipart/form-data")
 
-	encryptionKeyMD5, _ := hashEncryptionKey(encryptionKeyB64Encoded)
-	request.Header.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
-	request.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key", encryptionKeyB64Encoded)
-	request.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key-MD5", encryptionKeyMD5)
+	setEncryptionHeaders(request.Header, sseCustomerKey(encryptionKeyB64Encoded, metadata[metadataEncryption]))
 	request.Header.Set("X-Amz-Checksum-SHA256", checksum)
 	request.Header.Set("User-Agent", userAgent)
+	for k, v := range metadata {
+		request.Header.Set(k, v)
+	}
 
 	resp, err := client.Do(request)
 	if err != nil {
@@ -144,12 +549,13 @@ func hashEncryptionKey(encryptionKeyB64Encoded string) (string, error) {
 	if encryptionKeyB64Encoded == "" {
 		return "", fmt.Errorf("There's no encryption key to hash")
 	}
-	encryptionKey, err := base64.StdEncoding.DecodeString(encryptionKeyB64Encoded)
+	encryptionKey, err := decodeKey(encryptionKeyB64Encoded)
 	if err != nil {
-		return "", fmt.Errorf("error decoding base64 key: %v", err)
+		return "", err
 	}
+	defer encryptionKey.Destroy()
 
-	hash := md5.Sum(encryptionKey)
+	hash := md5.Sum(encryptionKey.Bytes())
 	hashBase64 := base64.StdEncoding.EncodeToString(hash[:])
 
 	return hashBase64, nil
@@ -4,7 +4,13 @@ Copyright 2024-2025 Securae Backup
 package cmd
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHashEncryptionKey(t *testing.T) {
@@ -23,3 +29,134 @@ func TestHashEncryptionKeyEmpty(t *testing.T) {
 		t.Errorf("An error must be raised when passing an empty key")
 	}
 }
+
+func TestUploadFileChanged(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(filename, []byte("line 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log is written while the first attempt is uploaded.
+	writes := 1
+	storage.onPut = func(name string) {
+		if writes > 0 {
+			writes--
+			file, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+			file.WriteString("line 2\n")
+			file.Close()
+		}
+	}
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "The file changed while uploading, retrying (2/3)") {
+		t.Errorf("The upload should be attempted again:\n%s", actual)
+	}
+	if data := string(storage.get("app.log").Data); data != "line 1\nline 2\n" {
+		t.Errorf("The uploaded file should be the last version, got %q", data)
+	}
+
+	// The log is written during every attempt.
+	writes = uploadAttempts
+	actual.Reset()
+	err := RootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "file changed while uploading") {
+		t.Errorf("The upload should fail when the file keeps changing, got %v:\n%s", err, actual)
+	}
+}
+
+func TestUploadStaleCachedChecksum(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The checksums are only cached on Unix")
+	}
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "dump.sql")
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	os.WriteFile(filename, []byte("dump"), 0600)
+	os.Chtimes(filename, lastWeek, lastWeek)
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", filename, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+
+	// Modified without changing the size nor the modification time.
+	os.WriteFile(filename, []byte("DUMP"), 0600)
+	os.Chtimes(filename, lastWeek, lastWeek)
+	actual.Reset()
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("The checksum should be calculated again after a stale one: %v\n%s", err, actual)
+	}
+	if !strings.Contains(actual.String(), "retrying (2/") {
+		t.Errorf("The upload should be retried after the stale checksum:\n%s", actual)
+	}
+	if data := string(storage.get("dump.sql").Data); data != "DUMP" {
+		t.Errorf("The uploaded file should be the last version, got %q", data)
+	}
+}
+
+func TestUploadDirectory(t *testing.T) {
+	storage := newMockStorage()
+	defer storage.Close()
+
+	configFile := storage.writeConfig(t, testKeyConfig)
+	dir := t.TempDir()
+	files := map[string]string{
+		".securaeignore":       "*.log\ncache/\n",
+		"dump.sql":             "dump",
+		"debug.log":            "debug",
+		"cache/data":           "cache",
+		"media/logo.png":       "logo",
+		"media/.securaeignore": "*.tmp\n",
+		"media/upload.tmp":     "tmp",
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	actual := new(bytes.Buffer)
+	RootCmd.SetOut(actual)
+	RootCmd.SetErr(actual)
+	RootCmd.SetArgs([]string{"--config", configFile, "upload", dir, "--backup-id", testBackupId})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatalf("%v\n%s", err, actual)
+	}
+	for _, name := range []string{"dump.sql", "logo.png"} {
+		if storage.get(name) == nil {
+			t.Errorf("%s should be uploaded:\n%s", name, actual)
+		}
+	}
+	for _, name := range []string{".securaeignore", "debug.log", "data", "upload.tmp"} {
+		if storage.get(name) != nil {
+			t.Errorf("%s should not be uploaded", name)
+		}
+	}
+
+	// Two files with the same name can't be uploaded from a directory.
+	os.WriteFile(filepath.Join(dir, "media", "dump.sql"), []byte("other"), 0600)
+	actual.Reset()
+	err := RootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "have the same name") {
+		t.Errorf("The upload should fail with two files named dump.sql, got %v", err)
+	}
+}
@@ -47,3 +47,17 @@ func CheckCLIVersionHeaders(headers http.Header, ownVersion string) error {
 
 	return nil
 }
+
+// setEncryptionHeaders adds the SSE-C headers required by the storage
+// provider to encrypt or decrypt an object with the customer's key, as
+// returned by sseCustomerKey.
+func setEncryptionHeaders(headers http.Header, encryptionKeyB64Encoded string) {
+	// Files encrypted with age are stored without SSE-C.
+	if encryptionKeyB64Encoded == "" {
+		return
+	}
+	encryptionKeyMD5, _ := hashEncryptionKey(encryptionKeyB64Encoded)
+	headers.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+	headers.Set("X-Amz-Server-Side-Encryption-Customer-Key", encryptionKeyB64Encoded)
+	headers.Set("X-Amz-Server-Side-Encryption-Customer-Key-MD5", encryptionKeyMD5)
+}
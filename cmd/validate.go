@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -28,6 +29,9 @@ securae validate database-dump.tar.gz --backup-id=abcd1234-ab12-ab12-ab12-abcdef
 # without specifying a filename it validates the latest uploaded file
 securae validate --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
 
+# verify 3 random blocks of a large file uploaded with --merkle
+securae validate vm.img --spot-check 3 --backup-id=abcd1234-ab12-ab12-ab12-abcdef123456
+
 # validate a file using an environment variable
 export SECURAE_BACKUP_ID=abcd1234-ab12-ab12-ab12-abcdef123456
 securae validate database-dump.tar.gz`,
@@ -50,7 +54,7 @@ securae validate database-dump.tar.gz`,
 			return err
 		}
 
-		encryptionKeyB64Encoded, err := getEncryptionKey()
+		nameKey, err := filenameKey()
 		if err != nil {
 			return err
 		}
@@ -58,7 +62,10 @@ securae validate database-dump.tar.gz`,
 		postData := []byte(fmt.Sprintf(`{"include_checksum": true}`))
 		if len(args) > 0 {
 			filename := args[0]
-			filenameOnly := filepath.Base(filename)
+			filenameOnly, err := encryptFilename(filepath.Base(filename), nameKey)
+			if err != nil {
+				return err
+			}
 			postData = []byte(fmt.Sprintf(`{"filename": "%s", "include_checksum": true}`, filenameOnly))
 		}
 
@@ -69,29 +76,44 @@ securae validate database-dump.tar.gz`,
 		}
 
 		parsedURL, _ := url.Parse(presignedURL)
-		fileToDownload := filepath.Base(parsedURL.Path)
-		cmd.Printf("[%s] Verifying encryption key... ", fileToDownload)
-		checksumProvider, err := fetchChecksum(presignedURL, encryptionKeyB64Encoded)
+		fileToDownload := filepath.Base(decryptFilename(filepath.Base(parsedURL.Path), nameKey))
+		var encryptionKeyB64Encoded, encryption, checksumProvider string
+		if ageOnly() {
+			// Only the checksum of the ciphertext is verified, which doesn't
+			// need the private identity.
+			cmd.Printf("[%s] Fetching integrity checksum... ", fileToDownload)
+			var headers http.Header
+			headers, encryption, err = fetchEncryptedObjectMetadata(presignedURL, "")
+			checksumProvider = headers.Get("X-Amz-Checksum-Sha256")
+		} else {
+			cmd.Printf("[%s] Verifying encryption key... ", fileToDownload)
+			encryptionKeyB64Encoded, encryption, checksumProvider, err = findEncryptionKey(presignedURL)
+		}
 		if err == nil {
 			cmd.Printf("OK\n")
 		} else {
 			return err
 		}
 
+		if spotCheck, _ := cmd.Flags().GetInt(flagSpotCheck); spotCheck > 0 {
+			return validateSpotCheck(cmd, apiURL, apiToken, backupId, presignedURL, encryptionKeyB64Encoded, fileToDownload, spotCheck)
+		}
+
 		preDownloadURL := fmt.Sprintf("%s/backups/%s/predownload/", apiURL, backupId)
 		presignedURL, err = fetchPresignedURL(preDownloadURL, apiToken, postData)
 		if err != nil {
 			return err
 		}
 
-		tmpFile, err := os.CreateTemp("", "securae")
+		tmpFile, err := createTempFile()
 		if err != nil {
 			return err
 		}
 		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
 
 		cmd.Printf("[%s] Downloading file... ", fileToDownload)
-		err = downloadFile(presignedURL, encryptionKeyB64Encoded, tmpFile.Name())
+		err = downloadFile(presignedURL, sseCustomerKey(encryptionKeyB64Encoded, encryption), tmpFile.Name())
 		if err == nil {
 			cmd.Printf("OK\n")
 		} else {
@@ -114,6 +136,20 @@ securae validate database-dump.tar.gz`,
 			cmd.Printf("Error\n")
 		}
 
+		if encryption == encryptionAge && !viper.IsSet(configAgeIdentityFile) {
+			cmd.Printf("[%s] Decryption not verified, there is no age identity on this host.\n", fileToDownload)
+		} else if decrypt := clientSideDecrypter(encryption, encryptionKeyB64Encoded); decrypt != nil {
+			cmd.Printf("[%s] Verifying client-side encryption... ", fileToDownload)
+			if _, err := tmpFile.Seek(0, 0); err != nil {
+				return err
+			}
+			if err := decrypt(io.Discard, tmpFile); err == nil {
+				cmd.Printf("OK\n")
+			} else {
+				cmd.Printf("Error (%s)\n", err)
+			}
+		}
+
 		return nil
 
 	},
@@ -122,9 +158,21 @@ securae validate database-dump.tar.gz`,
 func init() {
 	RootCmd.AddCommand(validateCmd)
 	validateCmd.Flags().StringP(flagBackupId, flagShortBackupId, "", "A backup ID (`UUID` format) where your files were stored. It can also be specified using the environment variable SECURAE_BACKUP_ID.")
+	validateCmd.Flags().Int(flagSpotCheck, 0, "Only download and verify this number of random blocks of a file uploaded with --merkle")
 }
 
 func fetchChecksum(url string, encryptionKeyB64Encoded string) (string, error) {
+	headers, _, err := fetchEncryptedObjectMetadata(url, encryptionKeyB64Encoded)
+	if err != nil {
+		return "", err
+	}
+	return headers.Get("X-Amz-Checksum-Sha256"), nil
+}
+
+// fetchObjectMetadata sends a HEAD request for the object, and returns its
+// headers with the checksum and the X-Amz-Meta-* metadata. The key is the
+// one sent in the SSE-C headers, see fetchEncryptedObjectMetadata to find it.
+func fetchObjectMetadata(url string, encryptionKeyB64Encoded string) (http.Header, error) {
 	tr := &http.Transport{
 		TLSHandshakeTimeout:   5 * time.Second,
 		IdleConnTimeout:       5 * time.Second,
@@ -134,32 +182,30 @@ func fetchChecksum(url string, encryptionKeyB64Encoded string) (string, error) {
 
 	req, err := http.NewRequest(http.MethodHead, url, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create HTTP request: %v", err)
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
 	}
 
-	encryptionKeyMD5, _ := hashEncryptionKey(encryptionKeyB64Encoded)
-	req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
-	req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key", encryptionKeyB64Encoded)
-	req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key-MD5", encryptionKeyMD5)
+	setEncryptionHeaders(req.Header, encryptionKeyB64Encoded)
 	req.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
 	req.Header.Set("User-Agent", userAgent)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusForbidden {
+		// A wrong key is denied, while missing or unexpected SSE-C headers,
+		// for an object uploaded in another encryption mode, are invalid.
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusBadRequest {
 			msg := "the encryption key used to upload the file does not match " +
 				"the one used now.\nPlease, verify the value of " +
 				"`encryption-key-b64encoded` in your configuration file."
-			return "", fmt.Errorf(msg)
+			return nil, fmt.Errorf(msg)
 		}
-		return "", fmt.Errorf("status code: %s", resp.Status)
+		return nil, fmt.Errorf("status code: %s", resp.Status)
 	}
 
-	checksum := resp.Header.Get("X-Amz-Checksum-Sha256")
-	return checksum, nil
+	return resp.Header, nil
 }
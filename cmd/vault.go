@@ -0,0 +1,144 @@
+/*
+Copyright 2024-2025 Securae Backup
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultKeyProvider fetches the encryption key from HashiCorp Vault, either
+// stored in a KV secret (`vault.kv-path`) or wrapped by a transit key
+// (`vault.transit-key` and `vault.ciphertext`).
+type vaultKeyProvider struct {
+	address      string
+	token        string
+	namespace    string
+	kvPath       string
+	kvField      string
+	transitMount string
+	transitKey   string
+	ciphertext   string
+}
+
+func newVaultKeyProvider(get func(key string) string) vaultKeyProvider {
+	p := vaultKeyProvider{
+		address:      get("vault.address"),
+		token:        get("vault.token"),
+		namespace:    get("vault.namespace"),
+		kvPath:       strings.Trim(get("vault.kv-path"), "/"),
+		kvField:      get("vault.kv-field"),
+		transitMount: strings.Trim(get("vault.transit-mount"), "/"),
+		transitKey:   get("vault.transit-key"),
+		ciphertext:   get("vault.ciphertext"),
+	}
+	// Same environment variables as the Vault CLI.
+	if p.address == "" {
+		p.address = os.Getenv("VAULT_ADDR")
+	}
+	if p.token == "" {
+		p.token = os.Getenv("VAULT_TOKEN")
+	}
+	if p.namespace == "" {
+		p.namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if p.kvField == "" {
+		p.kvField = "key"
+	}
+	if p.transitMount == "" {
+		p.transitMount = "transit"
+	}
+	p.address = strings.TrimSuffix(p.address, "/")
+	return p
+}
+
+func (p vaultKeyProvider) Name() string {
+	if p.transitKey != "" {
+		return fmt.Sprintf("Vault transit key %s/%s", p.transitMount, p.transitKey)
+	}
+	return fmt.Sprintf("Vault secret %s", p.kvPath)
+}
+
+func (p vaultKeyProvider) EncryptionKey() (string, error) {
+	if p.address == "" {
+		return "", fmt.Errorf("The Vault address is missing, set `vault.address` or the environment variable VAULT_ADDR.")
+	}
+	if p.token == "" {
+		return "", fmt.Errorf("The Vault token is missing, set `vault.token` or the environment variable VAULT_TOKEN.")
+	}
+
+	if p.transitKey != "" {
+		if p.ciphertext == "" {
+			return "", fmt.Errorf("The wrapped encryption key is missing, set `vault.ciphertext`.")
+		}
+		url := fmt.Sprintf("%s/v1/%s/decrypt/%s", p.address, p.transitMount, p.transitKey)
+		data, err := json.Marshal(map[string]string{"ciphertext": p.ciphertext})
+		if err != nil {
+			return "", err
+		}
+		var response struct {
+			Data struct {
+				Plaintext string `json:"plaintext"`
+			} `json:"data"`
+		}
+		if err := p.request(http.MethodPost, url, data, &response); err != nil {
+			return "", err
+		}
+		// The transit plaintext is base64 encoded, like the key itself.
+		return response.Data.Plaintext, nil
+	}
+
+	url := fmt.Sprintf("%s/v1/%s", p.address, p.kvPath)
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := p.request(http.MethodGet, url, nil, &response); err != nil {
+		return "", err
+	}
+	secret := response.Data
+	// KV version 2 nests the secret in another `data` object.
+	if nested, ok := secret["data"].(map[string]interface{}); ok {
+		secret = nested
+	}
+	key, ok := secret[p.kvField].(string)
+	if !ok {
+		return "", fmt.Errorf("The field %q was not found in %s.", p.kvField, p.Name())
+	}
+	return key, nil
+}
+
+func (p vaultKeyProvider) request(method string, url string, data []byte, v interface{}) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error connecting to Vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error fetching encryption key from %s: %s", p.Name(), resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error parsing Vault response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build linux || darwin
+
+/*
+Copyright 2024-2025 Securae Backup
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of a file. A file system
+// without extended attributes has none.
+func readXattrs(file *os.File) (map[string][]byte, error) {
+	fd := int(file.Fd())
+	size, err := unix.Flistxattr(fd, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	list := make([]byte, size)
+	size, err = unix.Flistxattr(fd, list)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := map[string][]byte{}
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Fgetxattr(fd, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = unix.Fgetxattr(fd, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:size]
+	}
+	return xattrs, nil
+}
+
+func writeXattr(filename string, name string, value []byte) error {
+	return unix.Setxattr(filename, name, value, 0)
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+
+/*
+Copyright 2024-2025 Securae Backup
+*/
+
+package cmd
+
+import (
+	"errors"
+	"os"
+)
+
+var errXattrsNotSupported = errors.New("extended attributes are not supported on this platform")
+
+func readXattrs(file *os.File) (map[string][]byte, error) {
+	return nil, errXattrsNotSupported
+}
+
+func writeXattr(filename string, name string, value []byte) error {
+	return errXattrsNotSupported
+}